@@ -1,280 +1,293 @@
 package gateway
 
 import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"net"
 	"net/http"
-	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"fiufit.api.gateway/cmd/middleware"
 	"fiufit.api.gateway/internal/auth"
+	"fiufit.api.gateway/internal/certs"
 	"fiufit.api.gateway/internal/config"
+	"fiufit.api.gateway/internal/health"
+	"fiufit.api.gateway/internal/metrics"
+	"fiufit.api.gateway/internal/problem"
+	"fiufit.api.gateway/internal/tracing"
+	"fiufit.api.gateway/internal/upstream"
 	"github.com/gin-gonic/gin"
 	"github.com/mvrilo/go-redoc"
 	ginredoc "github.com/mvrilo/go-redoc/gin"
-	gintrace "gopkg.in/DataDog/dd-trace-go.v1/contrib/gin-gonic/gin"
+	log "github.com/sirupsen/logrus"
 )
 
 type RouterConfig func(*gin.Engine)
 
+const (
+	livenessPath  = "/healthz"
+	readinessPath = "/readyz"
+	metricsPath   = "/internal/metrics"
+)
+
+// Gateway serves requests with the router built from the current
+// configuration. The router can be replaced while serving, requests
+// already being handled finish with the router they started with.
 type Gateway struct {
-	router *gin.Engine
+	router   atomic.Value // *gin.Engine
+	tracer   tracing.Tracer
+	draining int32
 }
 
 func (g *Gateway) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	g.router.ServeHTTP(w, r)
+	if r.URL.Path == readinessPath && atomic.LoadInt32(&g.draining) == 1 {
+		writeReport(w, health.Report{Status: health.Down, Checks: map[string]health.Result{
+			"gateway": {Status: health.Down, Error: "shutting down", CheckedAt: time.Now()},
+		}})
+		return
+	}
+	g.router.Load().(*gin.Engine).ServeHTTP(w, r)
 }
 
-func (g *Gateway) Run(addr ...string) {
-	g.router.Run(addr...)
+// Serves on the addresses in settings until ctx is done, then shuts
+// down gracefully
+func (g *Gateway) Run(ctx context.Context, settings config.Server) error {
+	tlsConfig, err := certs.ServerConfig(ctx, settings.TLSCertFile, settings.TLSKeyFile, settings.ClientCAFile)
+	if err != nil {
+		return err
+	}
+	listener, err := net.Listen("tcp", settings.Addr)
+	if err != nil {
+		return err
+	}
+	if tlsConfig != nil {
+		listener = tls.NewListener(listener, tlsConfig)
+	}
+	var ops net.Listener
+	if settings.OpsAddr != "" {
+		ops, err = net.Listen("tcp", settings.OpsAddr)
+		if err != nil {
+			listener.Close()
+			return err
+		}
+	}
+	log.WithFields(log.Fields{
+		"address":     settings.Addr,
+		"tls":         tlsConfig != nil,
+		"mtls":        settings.ClientCAFile != "",
+		"ops_address": settings.OpsAddr,
+	}).Info("Gateway listening")
+	return g.Serve(ctx, settings, listener, ops)
 }
 
-func New(c *config.Config ,routers ...RouterConfig) *Gateway {
-	doc := redoc.Redoc{
-			Title:       "FiuFit API Gateway",
-			Description: "API Gateway for FiuFit App",
-			SpecFile:    "./openapi.json", // "./openapi.yaml"
-			SpecPath:    "/openapi.json",  // "/openapi.yaml"
-			DocsPath:    "/docs",
+// Serves the connections accepted by listener, and the health and
+// metrics endpoints on ops if it isn't nil, until ctx is done. Then
+// readiness fails for the shutdown delay, the listeners are closed and
+// in-flight requests have the grace period to finish before their
+// connections are closed.
+func (g *Gateway) Serve(ctx context.Context, settings config.Server, listener, ops net.Listener) error {
+	servers := []*http.Server{newServer(settings, g)}
+	listeners := []net.Listener{listener}
+	if ops != nil {
+		servers = []*http.Server{newServer(settings, g.only(false)), newServer(settings, g.only(true))}
+		listeners = append(listeners, ops)
 	}
-	router := gin.New()
-	if !c.IsDevEnviroment {
-		router.Use(ginredoc.New(doc))
+	stopped := make(chan error, len(servers))
+	for i := range servers {
+		go func(server *http.Server, listener net.Listener) {
+			stopped <- server.Serve(listener)
+		}(servers[i], listeners[i])
 	}
-	router.Use(gin.Recovery())
-	router.Use(middleware.Logger())
-
-	router.Use(gintrace.Middleware("service-external-gateway"))
-	router.Use(middleware.Cors())
 
+	select {
+	case err := <-stopped:
+		for _, server := range servers {
+			server.Close()
+		}
+		return err
+	case <-ctx.Done():
+	}
 
-	for _, option := range routers {
-		option(router)
+	log.WithFields(log.Fields{
+		"delay":        settings.ShutdownDelay.String(),
+		"grace_period": settings.ShutdownGracePeriod.String(),
+	}).Info("Gateway shutting down")
+	atomic.StoreInt32(&g.draining, 1)
+	for _, server := range servers {
+		server.SetKeepAlivesEnabled(false)
+	}
+	time.Sleep(settings.ShutdownDelay)
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), settings.ShutdownGracePeriod)
+	defer cancel()
+	var wg sync.WaitGroup
+	for _, server := range servers {
+		wg.Add(1)
+		go func(server *http.Server) {
+			defer wg.Done()
+			if err := server.Shutdown(shutdownCtx); err != nil {
+				log.WithFields(log.Fields{"error": err.Error()}).Warn("Grace period elapsed, closing in-flight requests")
+				server.Close()
+			}
+		}(server)
+	}
+	wg.Wait()
+	for range servers {
+		<-stopped
 	}
-	return &Gateway{router}
+	log.Info("Gateway stopped")
+	return nil
 }
 
-// Sets the routes for the users endpoint
-func Users(url *url.URL, s auth.Service) RouterConfig {
-	return func(router *gin.Engine) {
-		router.POST("/users",
-			middleware.CreateUser(s),
-			middleware.ReverseProxy(&*url))
-
-		router.GET("/users/:user_id",
-			middleware.AuthorizeUser(s),
-			middleware.ReverseProxy(&*url))
-
-		router.GET("/users",
-			middleware.AuthorizeUser(s),
-			middleware.SetQuery("admin", "false"),
-			middleware.ReverseProxy(&*url))
-
-		router.PUT("/users/:user_id",
-			middleware.AuthorizeUser(s),
-			middleware.ReverseProxy(&*url))
-
-		router.POST("/users/:user_id/followers/:follower_id",
-			middleware.AuthorizeUser(s),
-			middleware.ReverseProxy(&*url))
-
-		router.DELETE("/users/:user_id/followers/:follower_id",
-			middleware.AuthorizeUser(s),
-			middleware.ReverseProxy(&*url))
-
-		router.GET("/users/:user_id/followers",
-			middleware.ReverseProxy(&*url))
-
-		router.GET("/users/:user_id/following",
-			middleware.ReverseProxy(&*url))
-
-		router.GET("/trainingtypes", middleware.ReverseProxy(&*url))
-
-		router.POST("/certificates/:user_id",
-			middleware.AuthorizeUser(s),
-			middleware.ReverseProxy(&*url))
-		router.GET("/certificates/:user_id",
-			middleware.AuthorizeUser(s),
-			middleware.ReverseProxy(&*url))
-
-		router.GET("/users/:user_id/trainers",
-			middleware.AuthorizeUser(s),
-			middleware.ReverseProxy(&*url))
-
+func newServer(settings config.Server, handler http.Handler) *http.Server {
+	return &http.Server{
+		Handler:      handler,
+		ReadTimeout:  settings.ReadTimeout,
+		WriteTimeout: settings.WriteTimeout,
+		IdleTimeout:  settings.IdleTimeout,
 	}
 }
 
-func Admin(usersUrl *url.URL, trainersURL *url.URL, metricsURL *url.URL, s auth.Service) RouterConfig {
-	return func(router *gin.Engine) {
-		router.POST("/admins",
-			middleware.AuthorizeUser(s),
-			middleware.AuthorizeAdmin(&*usersUrl),
-			middleware.CreateAdmin(s),
-			middleware.ReverseProxy(&*usersUrl))
-
-		router.GET("/admins/users",
-			middleware.AuthorizeUser(s),
-			middleware.AuthorizeAdmin(&*usersUrl),
-			middleware.RemovePathFromRequestURL("/admins"),
-			middleware.SetQuery("admin", "true"),
-			middleware.ReverseProxy(&*usersUrl))
-
-		// TODO: Add middleware to block in firebase
-		router.PATCH("/admins/users",
-			middleware.AuthorizeUser(s),
-			middleware.AuthorizeAdmin(&*usersUrl),
-			middleware.RemovePathFromRequestURL("/admins"),
-			middleware.ChangeBlockStatusFirebase(s),
-			middleware.ReverseProxy(&*usersUrl))
-
-		router.GET("/admins/plans",
-			middleware.AuthorizeUser(s),
-			middleware.AuthorizeAdmin(&*usersUrl),
-			middleware.RemovePathFromRequestURL("/admins"),
-			middleware.SetQuery("admin", "true"),
-			middleware.ReverseProxy(&*trainersURL))
-
-		router.GET("/admins/plans/:trainer_id",
-			middleware.AuthorizeUser(s),
-			middleware.AuthorizeAdmin(&*usersUrl),
-			middleware.RemovePathFromRequestURL("/admins"),
-			middleware.SetQuery("admin", "true"),
-			middleware.ReverseProxy(&*trainersURL))
-
-		router.PATCH("/admins/plans",
-			middleware.AuthorizeUser(s),
-			middleware.AuthorizeAdmin(&*usersUrl),
-			middleware.SetQuery("admin", "true"),
-			middleware.RemovePathFromRequestURL("/admins"),
-			middleware.ReverseProxy(&*trainersURL))
-
-		router.GET("/admins/certificates",
-			middleware.AuthorizeUser(s),
-			middleware.AuthorizeAdmin(&*usersUrl),
-			middleware.RemovePathFromRequestURL("/admins"),
-			middleware.ReverseProxy(&*usersUrl))
-
-		router.PUT("/admins/certificates/:user_id/:id",
-			middleware.AuthorizeUser(s),
-			middleware.AuthorizeAdmin(&*usersUrl),
-			middleware.RemovePathFromRequestURL("/admins"),
-			middleware.ReverseProxy(&*usersUrl))
-
-		router.POST("/admins/metrics",
-			middleware.AuthorizeUser(s),
-			middleware.RemovePathFromRequestURL("/admins"),
-			middleware.ReverseProxy(&*metricsURL))
+type opsListenerKey struct{}
+
+// Serves only the health and metrics endpoints when ops is true, or
+// every route but the health ones otherwise. The metrics are served on
+// both, the ops listener doesn't ask for the metrics token.
+func (g *Gateway) only(ops bool) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if ops && !isOpsPath(r.URL.Path) || !ops && isHealthPath(r.URL.Path) {
+			problem.Write(w, r, problem.New(http.StatusNotFound, problem.NotFound, "no route for "+r.Method+" "+r.URL.Path))
+			return
+		}
+		if ops {
+			r = r.WithContext(context.WithValue(r.Context(), opsListenerKey{}, true))
+		}
+		g.ServeHTTP(w, r)
+	})
+}
 
-		router.GET("/admins/metrics",
-			middleware.AuthorizeUser(s),
-			middleware.AuthorizeAdmin(&*usersUrl),
-			middleware.RemovePathFromRequestURL("/admins"),
-			middleware.ReverseProxy(&*metricsURL))
+func isOpsPath(path string) bool {
+	return isHealthPath(path) || path == metricsPath
+}
 
-		router.GET("/admins/metrics/totals",
-			middleware.AuthorizeUser(s),
-			middleware.AuthorizeAdmin(&*usersUrl),
-			middleware.RemovePathFromRequestURL("/admins"),
-			middleware.ReverseProxy(&*metricsURL))
+func isHealthPath(path string) bool {
+	return path == livenessPath || path == readinessPath
+}
 
-		router.GET("/admins/metrics/locations",
-			middleware.AuthorizeUser(s),
-			middleware.AuthorizeAdmin(&*usersUrl),
-			middleware.RemovePathFromRequestURL("/admins"),
-			middleware.ReverseProxy(&*metricsURL))
+// Serves the metrics without a token on the ops listener, which isn't
+// exposed publicly, and elsewhere only to requests with the metrics
+// token, if one is configured
+func metricsHandler(token string) gin.HandlerFunc {
+	protected := middleware.MetricsHandler(token)
+	open := metrics.Default.Handler()
+	return func(c *gin.Context) {
+		if ops, _ := c.Request.Context().Value(opsListenerKey{}).(bool); ops {
+			open.ServeHTTP(c.Writer, c.Request)
+			return
+		}
+		if token == "" {
+			abortWithNoRoute(c)
+			return
+		}
+		protected(c)
 	}
 }
 
-func Trainings(url *url.URL, s auth.Service) RouterConfig {
-	return func(router *gin.Engine) {
-		router.POST("/plans",
-			middleware.AuthorizeUser(s),
-			middleware.ReverseProxy(&*url))
-
-		router.GET("/plans",
-			middleware.AuthorizeUser(s),
-			middleware.SetQuery("admin", "false"),
-			middleware.ReverseProxy(&*url))
-
-		router.PUT("/plans/:plan_id",
-			middleware.AuthorizeUser(s),
-			middleware.ReverseProxy(&*url))
-
-		router.GET("/plans/:plan_id",
-			middleware.AuthorizeUser(s),
-			middleware.SetQuery("admin", "false"),
-			middleware.ReverseProxy(&*url))
+// Replaces the routes and upstreams of the gateway with the ones built
+// from the given configuration.
+func (g *Gateway) Reload(c *config.Config, routers ...RouterConfig) {
+	g.router.Store(newRouter(c, g.tracer, routers...))
+	log.Info("Gateway routes reloaded")
+}
 
-		router.GET("/trainers/:trainer_id/plans",
-			middleware.AuthorizeUser(s),
-			middleware.SetQuery("admin", "false"),
-			middleware.ReverseProxy(&*url))
+// Returns a gateway serving the routes, the requests are traced with t
+// for as long as the gateway runs.
+func New(c *config.Config, t tracing.Tracer, routers ...RouterConfig) *Gateway {
+	gateway := &Gateway{tracer: t}
+	gateway.router.Store(newRouter(c, t, routers...))
+	return gateway
+}
 
-		router.DELETE("/plans/:trainer_id/:plan_id",
-			middleware.AuthorizeUser(s),
-			middleware.ReverseProxy(&*url))
+func newRouter(c *config.Config, t tracing.Tracer, routers ...RouterConfig) *gin.Engine {
+	doc := redoc.Redoc{
+		Title:       "FiuFit API Gateway",
+		Description: "API Gateway for FiuFit App",
+		SpecFile:    "./openapi.json", // "./openapi.yaml"
+		SpecPath:    "/openapi.json",  // "/openapi.yaml"
+		DocsPath:    "/docs",
+	}
+	router := gin.New()
+	router.Use(middleware.RequestID())
+	router.Use(middleware.UserHeaders(c.UserHeadersSecret))
+	router.Use(middleware.Trace(t))
+	router.Use(middleware.Logger(c.AccessLog))
+	router.Use(middleware.Metrics())
+	if !c.IsDevEnviroment {
+		router.Use(ginredoc.New(doc))
+	}
+	router.Use(gin.CustomRecovery(func(c *gin.Context, _ any) {
+		problem.Write(c.Writer, c.Request, problem.New(http.StatusInternalServerError, problem.Internal, ""))
+		c.Abort()
+	}))
+	router.NoRoute(abortWithNoRoute)
 
-		router.POST("/users/:user_id/trainings/favourites",
-			middleware.AuthorizeUser(s),
-			middleware.ReverseProxy(&*url))
+	router.Use(middleware.Cors())
 
-		router.GET("/users/:user_id/trainings/favourites",
-			middleware.AuthorizeUser(s),
-			middleware.ReverseProxy(&*url))
+	router.GET(metricsPath, metricsHandler(c.MetricsToken))
 
-		router.DELETE("/users/:user_id/trainings/favourites/:plan_id",
-			middleware.AuthorizeUser(s),
-			middleware.ReverseProxy(&*url))
+	for _, option := range routers {
+		option(router)
 	}
+	return router
 }
 
-func Reviews(url *url.URL, s auth.Service) RouterConfig {
+// Sets the admin endpoint exposing the circuit breakers of the upstreams
+func Breakers(upstreams upstream.Set, admins *middleware.AdminLookup, s auth.Service) RouterConfig {
+	verifier := auth.CheckRevoked(s)
 	return func(router *gin.Engine) {
-		router.POST("/reviews",
-			middleware.AuthorizeUser(s),
-			middleware.ReverseProxy(&*url))
-
-		router.GET("/reviews/:plan_id",
-			middleware.AuthorizeUser(s),
-			middleware.ReverseProxy(&*url))
-
-		router.GET("/reviews/:plan_id/mean", middleware.ReverseProxy(&*url))
-		router.PUT("/reviews/:review_id",
-			middleware.AuthorizeUser(s),
-			middleware.ReverseProxy(&*url))
+		router.GET("/admins/breakers",
+			middleware.AuthorizeUser(verifier, nil),
+			middleware.AuthorizeAdmin(admins),
+			middleware.BreakerStates(upstreams))
 	}
 }
 
-func Goals(url *url.URL, s auth.Service) RouterConfig {
+// Sets the route admins change the roles of the users with
+func Roles(admins *middleware.AdminLookup, s auth.Service) RouterConfig {
+	verifier := auth.CheckRevoked(s)
 	return func(router *gin.Engine) {
-		router.POST("/users/:user_id/goals",
-			middleware.AuthorizeUser(s),
-			middleware.ReverseProxy(&*url))
-
-		router.PUT("/users/:user_id/goals",
-			middleware.AuthorizeUser(s),
-			middleware.ReverseProxy(&*url))
-
-		router.GET("/users/:user_id/goals",
-			middleware.AuthorizeUser(s),
-			middleware.ReverseProxy(&*url))
-
-		router.POST("/users/:user_id/training",
-			middleware.AuthorizeUser(s),
-			middleware.ReverseProxy(*&url))
-
-		router.GET("/users/:user_id/training",
-			middleware.AuthorizeUser(s),
-			middleware.ReverseProxy(*&url))
-
-		router.GET("/users/:user_id/training/metrics",
-			middleware.AuthorizeUser(s),
-			middleware.ReverseProxy(*&url))
+		router.PUT("/admins/users/:user_id/roles",
+			middleware.AuthorizeUser(verifier, nil),
+			middleware.AuthorizeAdmin(admins),
+			middleware.SetRoles(s))
 	}
 }
 
-func Metrics(url *url.URL, s auth.Service) RouterConfig {
+// Sets the liveness and readiness endpoints. The gateway is ready when
+// every upstream can be reached and the auth service is initialised.
+func Health(c *config.Config, upstreams upstream.Set, s auth.Service) RouterConfig {
+	checker := health.NewChecker(c.ReadyCacheTTL, c.ReadyTimeout)
+	for _, u := range upstreams {
+		checker.Add(u.Name, u.Check)
+	}
+	checker.Add("auth", func(context.Context) error { return s.Ready() })
+
 	return func(router *gin.Engine) {
-		router.GET("/metrics/trainings/:plan_id",
-			middleware.AuthorizeUser(s),
-			middleware.ReverseProxy(*&url))
+		router.GET(livenessPath, middleware.Liveness())
+		router.GET(readinessPath, middleware.Readiness(checker))
 	}
 }
+
+func abortWithNoRoute(c *gin.Context) {
+	problem.Write(c.Writer, c.Request, problem.New(http.StatusNotFound, problem.NotFound, "no route for "+c.Request.Method+" "+c.Request.URL.Path))
+	c.Abort()
+}
+
+func writeReport(w http.ResponseWriter, report health.Report) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(http.StatusServiceUnavailable)
+	json.NewEncoder(w).Encode(report)
+}
@@ -2,19 +2,43 @@ package gateway
 
 import (
 	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
+	"encoding/pem"
 	"errors"
 	"io"
+	"math/big"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"net/http/httputil"
 	"os"
+	"path/filepath"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"net/url"
 	"testing"
 
+	"fiufit.api.gateway/cmd/middleware"
 	"fiufit.api.gateway/internal/auth"
+	"fiufit.api.gateway/internal/certs"
 	"fiufit.api.gateway/internal/config"
+	"fiufit.api.gateway/internal/health"
+	"fiufit.api.gateway/internal/problem"
+	"fiufit.api.gateway/internal/tracing"
+	"fiufit.api.gateway/internal/upstream"
 	"github.com/gin-gonic/gin"
 	log "github.com/sirupsen/logrus"
 )
@@ -52,13 +76,13 @@ func TestGateway(t *testing.T) {
 			}))
 			defer usersService.Close()
 
-			usersServiceURL, _ := url.Parse(usersService.URL)
+			usersServiceURL := testUpstream(usersService.URL)
 			s := AuthTestService{}
 			c := &config.Config{IsDevEnviroment: true}
-			gateway := New(c, Users(usersServiceURL, s))
+			gateway := New(c, tracing.Noop{}, defaultRoutes(t, upstream.Set{config.Users: usersServiceURL}, s, nil))
 
 			signUpData := auth.SignUpModel{
-				Email: "abc@xyz.com", Username: "abc", Password: "123",
+				Email: "abc@xyz.com", Username: "abc", Password: "secret123",
 			}
 			signUpDataJSON, _ := json.Marshal(signUpData)
 			w := CreateTestResponseRecorder()
@@ -84,11 +108,11 @@ func TestGateway(t *testing.T) {
 			}))
 			defer usersService.Close()
 
-			usersServiceURL, _ := url.Parse(usersService.URL)
+			usersServiceURL := testUpstream(usersService.URL)
 
 			s := AuthTestService{}
 			c := &config.Config{IsDevEnviroment: true}
-			gateway := New(c, Users(usersServiceURL, s))
+			gateway := New(c, tracing.Noop{}, defaultRoutes(t, upstream.Set{config.Users: usersServiceURL}, s, nil))
 
 			w := CreateTestResponseRecorder()
 			req, _ := http.NewRequest(http.MethodPut, "/users/123", bytes.NewReader(profileDataJSON))
@@ -108,15 +132,15 @@ func TestGateway(t *testing.T) {
 		}))
 		defer usersService.Close()
 
-		usersServiceURL, _ := url.Parse(usersService.URL)
-		trainersServiceURL, _ := url.Parse("")
-		metricsServiceURL, _ := url.Parse("")
+		usersServiceURL := testUpstream(usersService.URL)
+		trainersServiceURL := testUpstream("")
+		metricsServiceURL := testUpstream("")
 		s := AuthTestService{}
 		c := &config.Config{IsDevEnviroment: true}
-		gateway := New(c, Admin(usersServiceURL, trainersServiceURL, metricsServiceURL, s))
+		gateway := New(c, tracing.Noop{}, defaultRoutes(t, upstream.Set{config.Users: usersServiceURL, config.Trainings: trainersServiceURL, config.Metrics: metricsServiceURL}, s, nil))
 
 		signUpData := auth.SignUpModel{
-			Email: "abc@xyz.com", Username: "abc", Password: "123",
+			Email: "abc@xyz.com", Username: "abc", Password: "secret123",
 		}
 		signUpDataJSON, _ := json.Marshal(signUpData)
 		w := CreateTestResponseRecorder()
@@ -134,14 +158,14 @@ func TestGateway(t *testing.T) {
 		}))
 		defer usersService.Close()
 
-		usersServiceURL, _ := url.Parse(usersService.URL)
-		trainersServiceURL, _ := url.Parse("")
-		metricsServiceURL, _ := url.Parse("")
+		usersServiceURL := testUpstream(usersService.URL)
+		trainersServiceURL := testUpstream("")
+		metricsServiceURL := testUpstream("")
 		s := AuthTestService{}
 		c := &config.Config{IsDevEnviroment: true}
-		gateway := New(c, Admin(usersServiceURL, trainersServiceURL, metricsServiceURL, s))
+		gateway := New(c, tracing.Noop{}, defaultRoutes(t, upstream.Set{config.Users: usersServiceURL, config.Trainings: trainersServiceURL, config.Metrics: metricsServiceURL}, s, nil))
 		signUpData := auth.SignUpModel{
-			Email: "abc@xyz.com", Username: "abc", Password: "123",
+			Email: "abc@xyz.com", Username: "abc", Password: "secret123",
 		}
 		signUpDataJSON, _ := json.Marshal(signUpData)
 		w := CreateTestResponseRecorder()
@@ -165,18 +189,97 @@ func TestGateway(t *testing.T) {
 		}))
 		defer usersService.Close()
 
-		usersServiceURL, _ := url.Parse(usersService.URL)
-		trainersServiceURL, _ := url.Parse("")
-		metricsServiceURL, _ := url.Parse("")
+		usersServiceURL := testUpstream(usersService.URL)
+		trainersServiceURL := testUpstream("")
+		metricsServiceURL := testUpstream("")
 		s := AuthTestService{}
 		c := &config.Config{IsDevEnviroment: true}
-		gateway := New(c, Admin(usersServiceURL, trainersServiceURL, metricsServiceURL, s))
+		gateway := New(c, tracing.Noop{}, defaultRoutes(t, upstream.Set{config.Users: usersServiceURL, config.Trainings: trainersServiceURL, config.Metrics: metricsServiceURL}, s, nil))
 		w := CreateTestResponseRecorder()
 		req, _ := http.NewRequest(http.MethodGet, "/admins/users", nil)
 		req.Header.Set("Authorization", "abc")
 		gateway.ServeHTTP(w, req)
 	})
 
+	t.Run("Metrics are pushed with a service key, users are rejected even if they are admins", func(t *testing.T) {
+		metricsService := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			assertString(t, r.URL.Path, "/metrics")
+			w.WriteHeader(http.StatusCreated)
+		}))
+		defer metricsService.Close()
+		usersService := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusOK)
+		}))
+		defer usersService.Close()
+
+		hash := sha256.Sum256([]byte("secret"))
+		keys := middleware.NewServiceKeys([]config.ServiceKey{
+			{ID: "producer", Service: "producer", SHA256: hex.EncodeToString(hash[:]), Scopes: []string{config.MetricsWriteScope}},
+		})
+		c := &config.Config{IsDevEnviroment: true}
+		gateway := New(c, tracing.Noop{}, defaultRoutes(t, upstream.Set{config.Users: testUpstream(usersService.URL), config.Trainings: testUpstream(""), config.Metrics: testUpstream(metricsService.URL)}, AuthTestService{}, keys))
+
+		w := CreateTestResponseRecorder()
+		req, _ := http.NewRequest(http.MethodPost, "/admins/metrics", strings.NewReader("{}"))
+		req.Header.Set("Authorization", "abc")
+		gateway.ServeHTTP(w, req)
+		assertStatusCode(t, w.Code, http.StatusUnauthorized)
+
+		w = CreateTestResponseRecorder()
+		req, _ = http.NewRequest(http.MethodPost, "/admins/metrics", strings.NewReader("{}"))
+		req.Header.Set("X-API-Key", "secret")
+		gateway.ServeHTTP(w, req)
+		assertStatusCode(t, w.Code, http.StatusCreated)
+	})
+
+	t.Run("Users can only update their own profile", func(t *testing.T) {
+		usersService := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Method == http.MethodGet {
+				// Admin lookup, the user isn't an admin
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			assertString(t, r.URL.Path, "/users/123")
+			w.WriteHeader(http.StatusOK)
+		}))
+		defer usersService.Close()
+
+		c := &config.Config{IsDevEnviroment: true}
+		gateway := New(c, tracing.Noop{}, defaultRoutes(t, upstream.Set{config.Users: testUpstream(usersService.URL)}, AuthTestService{}, nil))
+		for path, want := range map[string]int{"/users/123": http.StatusOK, "/users/456": http.StatusForbidden} {
+			w := CreateTestResponseRecorder()
+			req, _ := http.NewRequest(http.MethodPut, path, strings.NewReader("{}"))
+			req.Header.Set("Authorization", "abc")
+			gateway.ServeHTTP(w, req)
+			assertStatusCode(t, w.Code, want)
+		}
+	})
+
+	t.Run("Only the follower can follow and unfollow a user", func(t *testing.T) {
+		usersService := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Method == http.MethodGet {
+				// Admin lookup, the user isn't an admin
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			assertString(t, r.URL.Path, "/users/456/followers/123")
+			w.WriteHeader(http.StatusOK)
+		}))
+		defer usersService.Close()
+
+		c := &config.Config{IsDevEnviroment: true}
+		gateway := New(c, tracing.Noop{}, defaultRoutes(t, upstream.Set{config.Users: testUpstream(usersService.URL)}, AuthTestService{}, nil))
+		for _, method := range []string{http.MethodPost, http.MethodDelete} {
+			for path, want := range map[string]int{"/users/456/followers/123": http.StatusOK, "/users/123/followers/456": http.StatusForbidden} {
+				w := CreateTestResponseRecorder()
+				req, _ := http.NewRequest(method, path, nil)
+				req.Header.Set("Authorization", "abc")
+				gateway.ServeHTTP(w, req)
+				assertStatusCode(t, w.Code, want)
+			}
+		}
+	})
+
 	t.Run("An user request all the profiles", func(t *testing.T) {
 		usersService := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			assertString(t, r.URL.Path, "/users")
@@ -185,31 +288,797 @@ func TestGateway(t *testing.T) {
 		}))
 		defer usersService.Close()
 
-		usersServiceURL, _ := url.Parse(usersService.URL)
+		usersServiceURL := testUpstream(usersService.URL)
 		s := AuthTestService{}
 		c := &config.Config{IsDevEnviroment: true}
-		gateway := New(c, Users(usersServiceURL, s))
+		gateway := New(c, tracing.Noop{}, defaultRoutes(t, upstream.Set{config.Users: usersServiceURL}, s, nil))
+		w := CreateTestResponseRecorder()
+		req, _ := http.NewRequest(http.MethodGet, "/users", nil)
+		req.Header.Set("Authorization", "xyz")
+		gateway.ServeHTTP(w, req)
+	})
+
+	t.Run("The metrics endpoint is only exposed when a metrics token is configured", func(t *testing.T) {
+		for token, want := range map[string]int{"": http.StatusNotFound, "secret": http.StatusOK} {
+			gateway := New(&config.Config{IsDevEnviroment: true, MetricsToken: token}, tracing.Noop{})
+			w := CreateTestResponseRecorder()
+			req, _ := http.NewRequest(http.MethodGet, "/internal/metrics", nil)
+			req.Header.Set("Authorization", "Bearer secret")
+			gateway.ServeHTTP(w, req)
+			assertStatusCode(t, w.Code, want)
+		}
+	})
+
+	t.Run("Requests to unknown routes and handlers that panic respond with a problem", func(t *testing.T) {
+		c := &config.Config{IsDevEnviroment: true}
+		gateway := New(c, tracing.Noop{}, func(router *gin.Engine) {
+			router.GET("/panic", func(*gin.Context) { panic("broken") })
+		})
+		for path, want := range map[string]string{"/unknown": problem.NotFound, "/panic": problem.Internal} {
+			w := CreateTestResponseRecorder()
+			req, _ := http.NewRequest(http.MethodGet, path, nil)
+			gateway.ServeHTTP(w, req)
+
+			var got problem.Problem
+			json.Unmarshal(w.Body.Bytes(), &got)
+			assertString(t, w.Header().Get("Content-Type"), problem.ContentType)
+			assertString(t, got.Code, want)
+			assertStatusCode(t, w.Code, got.Status)
+		}
+	})
+}
+
+func TestRouteManifest(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	t.Run("Every middleware accepted by the manifest can be built by the gateway", func(t *testing.T) {
+		for _, name := range config.MiddlewareNames() {
+			if _, found := middlewareFactories[name]; !found {
+				t.Errorf("Missing factory for middleware %s", name)
+			}
+		}
+	})
+
+	t.Run("The route manifest shipped with the gateway is valid", func(t *testing.T) {
+		_, err := config.DefaultRoutes()
+		if err != nil {
+			t.Errorf("Got %s, want no error", err.Error())
+		}
+	})
+
+	t.Run("A manifest referencing an unknown middleware is rejected", func(t *testing.T) {
+		manifest := `{"routes": [{"method": "GET", "path": "/users", "service": "users", "middleware": [{"name": "Unknown"}]}]}`
+		_, err := config.ParseManifest([]byte(manifest))
+		if err == nil {
+			t.Error("Expected an error")
+		}
+	})
+
+	t.Run("A manifest referencing an unknown service is rejected", func(t *testing.T) {
+		manifest := `{"routes": [{"method": "GET", "path": "/users", "service": "payments"}]}`
+		_, err := config.ParseManifest([]byte(manifest))
+		if err == nil {
+			t.Error("Expected an error")
+		}
+	})
+
+	t.Run("A manifest checking the owner of a parameter missing in the path is rejected", func(t *testing.T) {
+		manifest := `{"routes": [{"method": "PUT", "path": "/plans/:plan_id", "service": "trainings",
+			"middleware": [{"name": "AuthorizeUser"}, {"name": "RequireOwner", "args": ["trainer_id"]}]}]}`
+		_, err := config.ParseManifest([]byte(manifest))
+		if err == nil {
+			t.Error("Expected an error")
+		}
+	})
+
+	t.Run("A Timeout may set the connect and response header timeouts of the route", func(t *testing.T) {
+		for args, valid := range map[string]bool{
+			`["2s"]`:                   true,
+			`["2s", "100ms"]`:          true,
+			`["2s", "0s", "500ms"]`:    true,
+			`["2s", "3s"]`:             false,
+			`["2s", "1s", "-1s"]`:      false,
+			`["2s", "1s", "1s", "1s"]`: false,
+		} {
+			manifest := `{"routes": [{"method": "GET", "path": "/users", "service": "users",
+				"middleware": [{"name": "Timeout", "args": ` + args + `}]}]}`
+			_, err := config.ParseManifest([]byte(manifest))
+			if (err == nil) != valid {
+				t.Errorf("Got %v for %s, want valid %t", err, args, valid)
+			}
+		}
+	})
+
+	t.Run("A manifest route runs its middlewares in order and forwards the request to its service", func(t *testing.T) {
+		usersService := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path != "/users" || r.URL.Query().Get("admin") != "false" {
+				t.Errorf("Got %s, want /users?admin=false", r.URL.String())
+			}
+			w.WriteHeader(http.StatusOK)
+		}))
+		defer usersService.Close()
+
+		manifest := `{"routes": [{"method": "GET", "path": "/users", "service": "users",
+			"middleware": [{"name": "AuthorizeUser"}, {"name": "SetQuery", "args": ["admin", "false"]}]}]}`
+		parsed, err := config.ParseManifest([]byte(manifest))
+		if err != nil {
+			t.Fatal(err)
+		}
+		routes := parsed.Routes
+
+		usersServiceURL := testUpstream(usersService.URL)
+		services := upstream.Set{config.Users: usersServiceURL}
+		c := &config.Config{IsDevEnviroment: true, Routes: routes}
+		gateway := New(c, tracing.Noop{}, Routes(c.Routes, services, AuthTestService{}, nil, middleware.NewAdminLookup(services[config.Users]), nil))
+
 		w := CreateTestResponseRecorder()
 		req, _ := http.NewRequest(http.MethodGet, "/users", nil)
+		req.Header.Set("Authorization", "abc")
+		gateway.ServeHTTP(w, req)
+		if w.Code != http.StatusOK {
+			t.Errorf("Got %d, want %d", w.Code, http.StatusOK)
+		}
+
+		w = CreateTestResponseRecorder()
+		req, _ = http.NewRequest(http.MethodGet, "/users", nil)
 		req.Header.Set("Authorization", "xyz")
 		gateway.ServeHTTP(w, req)
+		if w.Code != http.StatusUnauthorized {
+			t.Errorf("Got %d, want %d", w.Code, http.StatusUnauthorized)
+		}
+	})
+}
+
+func TestReload(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	t.Run("After a reload new requests use the new upstream and in-flight requests finish with the old one", func(t *testing.T) {
+		started := make(chan struct{})
+		release := make(chan struct{})
+		oldService := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			close(started)
+			<-release
+			w.Write([]byte("old"))
+		}))
+		defer oldService.Close()
+		newService := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte("new"))
+		}))
+		defer newService.Close()
+
+		c := &config.Config{IsDevEnviroment: true}
+		oldURL := testUpstream(oldService.URL)
+		newURL := testUpstream(newService.URL)
+		gateway := New(c, tracing.Noop{}, defaultRoutes(t, upstream.Set{config.Trainings: oldURL}, AuthTestService{}, nil))
+
+		inFlight := CreateTestResponseRecorder()
+		done := make(chan struct{})
+		go func() {
+			req, _ := http.NewRequest(http.MethodGet, "/reviews/1/mean", nil)
+			gateway.ServeHTTP(inFlight, req)
+			close(done)
+		}()
+		<-started
+
+		gateway.Reload(c, defaultRoutes(t, upstream.Set{config.Trainings: newURL}, AuthTestService{}, nil))
+
+		w := CreateTestResponseRecorder()
+		req, _ := http.NewRequest(http.MethodGet, "/reviews/1/mean", nil)
+		gateway.ServeHTTP(w, req)
+		assertBody(t, w.Body.String(), "new")
+
+		close(release)
+		<-done
+		assertBody(t, inFlight.Body.String(), "old")
+	})
+}
+
+// Returns the routes of the default manifest forwarding to services
+func defaultRoutes(t testing.TB, services upstream.Set, s auth.Service, keys *middleware.ServiceKeys) RouterConfig {
+	t.Helper()
+	routes, err := config.DefaultRoutes()
+	if err != nil {
+		t.Fatalf("Invalid default route manifest: %s", err.Error())
+	}
+	return Routes(routes, services, s, keys, middleware.NewAdminLookup(services[config.Users]), nil)
+}
+
+func testUpstream(rawURL string) *upstream.Upstream {
+	u, _ := url.Parse(rawURL)
+	return upstream.New("test", []*url.URL{u}, upstream.Options{})
+}
+
+func assertBody(t testing.TB, got, want string) {
+	t.Helper()
+	if got != want {
+		t.Errorf("Got %s, want %s", got, want)
+	}
+}
+
+func TestBreakers(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	t.Run("An admin gets the state of the circuit breaker of each upstream", func(t *testing.T) {
+		usersService := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			assertBody(t, r.URL.Path, "/admins/123")
+			w.WriteHeader(http.StatusOK)
+		}))
+		defer usersService.Close()
+
+		upstreams := upstream.Set{
+			config.Users:     testUpstream(usersService.URL),
+			config.Trainings: testUpstream("http://trainings"),
+		}
+		c := &config.Config{IsDevEnviroment: true}
+		gateway := New(c, tracing.Noop{}, Breakers(upstreams, middleware.NewAdminLookup(upstreams[config.Users]), AuthTestService{}))
+
+		w := CreateTestResponseRecorder()
+		req, _ := http.NewRequest(http.MethodGet, "/admins/breakers", nil)
+		req.Header.Set("Authorization", "abc")
+		gateway.ServeHTTP(w, req)
+
+		var states []upstream.BreakerState
+		json.Unmarshal(w.Body.Bytes(), &states)
+		if w.Code != http.StatusOK || len(states) != 2 || states[0].State != upstream.Closed {
+			t.Errorf("Got %d %s, want the state of 2 closed breakers", w.Code, w.Body.String())
+		}
+	})
+}
+
+func TestAdminLookup(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	t.Run("The admin routes share the answers of the users service", func(t *testing.T) {
+		var lookups int64
+		usersService := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/admins/123" {
+				atomic.AddInt64(&lookups, 1)
+			}
+			w.WriteHeader(http.StatusOK)
+		}))
+		defer usersService.Close()
+
+		upstreams := upstream.Set{config.Users: testUpstream(usersService.URL)}
+		admins := middleware.NewAdminLookup(upstreams[config.Users])
+		c := &config.Config{IsDevEnviroment: true}
+		gateway := New(c, tracing.Noop{}, Breakers(upstreams, admins, AuthTestService{}), Roles(admins, AuthTestService{}))
+
+		for _, req := range []*http.Request{
+			httptest.NewRequest(http.MethodGet, "/admins/breakers", nil),
+			httptest.NewRequest(http.MethodPut, "/admins/users/456/roles", strings.NewReader(`{"roles": ["trainer"]}`)),
+		} {
+			w := CreateTestResponseRecorder()
+			req.Header.Set("Authorization", "abc")
+			gateway.ServeHTTP(w, req)
+			if w.Code != http.StatusOK {
+				t.Errorf("Got %d for %s, want %d", w.Code, req.URL.Path, http.StatusOK)
+			}
+		}
+		if got := atomic.LoadInt64(&lookups); got != 1 {
+			t.Errorf("Got %d lookups, want 1", got)
+		}
+	})
+}
+
+func TestHealth(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	t.Run("The gateway is alive and ready while every upstream answers its health check", func(t *testing.T) {
+		usersService := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			assertBody(t, r.URL.Path, "/health")
+			w.WriteHeader(http.StatusOK)
+		}))
+		defer usersService.Close()
+		u, _ := url.Parse(usersService.URL)
+		upstreams := upstream.Set{config.Users: upstream.New("users", []*url.URL{u}, upstream.Options{HealthPath: "/health"})}
+		c := &config.Config{IsDevEnviroment: true, ReadyCacheTTL: time.Minute, ReadyTimeout: time.Second}
+		gateway := New(c, tracing.Noop{}, Health(c, upstreams, AuthTestService{}))
+
+		w := CreateTestResponseRecorder()
+		req, _ := http.NewRequest(http.MethodGet, "/healthz", nil)
+		gateway.ServeHTTP(w, req)
+		if w.Code != http.StatusOK {
+			t.Errorf("Got %d, want %d", w.Code, http.StatusOK)
+		}
+
+		w = CreateTestResponseRecorder()
+		req, _ = http.NewRequest(http.MethodGet, "/readyz", nil)
+		gateway.ServeHTTP(w, req)
+		var report health.Report
+		json.Unmarshal(w.Body.Bytes(), &report)
+		if w.Code != http.StatusOK || report.Status != health.Up || report.Checks["users"].Status != health.Up || report.Checks["auth"].Status != health.Up {
+			t.Errorf("Got %d %s, want every dependency up", w.Code, w.Body.String())
+		}
+	})
+
+	t.Run("The gateway isn't ready while an upstream is down and reuses the result until it expires", func(t *testing.T) {
+		var probes int64
+		usersService := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt64(&probes, 1)
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}))
+		defer usersService.Close()
+		u, _ := url.Parse(usersService.URL)
+		upstreams := upstream.Set{config.Users: upstream.New("users", []*url.URL{u}, upstream.Options{HealthPath: "/health"})}
+		c := &config.Config{IsDevEnviroment: true, ReadyCacheTTL: time.Minute, ReadyTimeout: time.Second}
+		gateway := New(c, tracing.Noop{}, Health(c, upstreams, AuthTestService{}))
+
+		for i := 0; i < 3; i++ {
+			w := CreateTestResponseRecorder()
+			req, _ := http.NewRequest(http.MethodGet, "/readyz", nil)
+			gateway.ServeHTTP(w, req)
+			var report health.Report
+			json.Unmarshal(w.Body.Bytes(), &report)
+			if w.Code != http.StatusServiceUnavailable || report.Status != health.Down || report.Checks["users"].Status != health.Down || report.Checks["auth"].Status != health.Up {
+				t.Errorf("Got %d %s, want the users service down", w.Code, w.Body.String())
+			}
+		}
+		if probes := atomic.LoadInt64(&probes); probes != 1 {
+			t.Errorf("Got %d probes, want 1", probes)
+		}
+
+		w := CreateTestResponseRecorder()
+		req, _ := http.NewRequest(http.MethodGet, "/healthz", nil)
+		gateway.ServeHTTP(w, req)
+		if w.Code != http.StatusOK {
+			t.Errorf("Got %d, want %d", w.Code, http.StatusOK)
+		}
+	})
+
+	t.Run("Concurrent readiness probes run each expired check once", func(t *testing.T) {
+		var probes int64
+		usersService := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt64(&probes, 1)
+			time.Sleep(50 * time.Millisecond)
+			w.WriteHeader(http.StatusOK)
+		}))
+		defer usersService.Close()
+		u, _ := url.Parse(usersService.URL)
+		upstreams := upstream.Set{config.Users: upstream.New("users", []*url.URL{u}, upstream.Options{HealthPath: "/health"})}
+		c := &config.Config{IsDevEnviroment: true, ReadyCacheTTL: time.Minute, ReadyTimeout: time.Second}
+		gateway := New(c, tracing.Noop{}, Health(c, upstreams, AuthTestService{}))
+
+		var wg sync.WaitGroup
+		for i := 0; i < 10; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				w := CreateTestResponseRecorder()
+				req, _ := http.NewRequest(http.MethodGet, "/readyz", nil)
+				gateway.ServeHTTP(w, req)
+				if w.Code != http.StatusOK {
+					t.Errorf("Got %d %s, want every dependency up", w.Code, w.Body.String())
+				}
+			}()
+		}
+		wg.Wait()
+		if probes := atomic.LoadInt64(&probes); probes != 1 {
+			t.Errorf("Got %d probes, want 1", probes)
+		}
+	})
+}
+
+func TestShutdown(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	t.Run("When shutting down readiness fails and in-flight requests finish before the gateway stops", func(t *testing.T) {
+		received := make(chan bool)
+		release := make(chan bool)
+		trainingsService := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			received <- true
+			<-release
+			w.Write([]byte("4.5"))
+		}))
+		defer trainingsService.Close()
+
+		c := &config.Config{IsDevEnviroment: true}
+		gateway := New(c, tracing.Noop{}, defaultRoutes(t, upstream.Set{config.Trainings: testUpstream(trainingsService.URL)}, AuthTestService{}, nil))
+		listener, _ := net.Listen("tcp", "127.0.0.1:0")
+		ctx, cancel := context.WithCancel(context.Background())
+		settings := config.Server{ShutdownDelay: 50 * time.Millisecond, ShutdownGracePeriod: 5 * time.Second}
+		stopped := make(chan error, 1)
+		go func() { stopped <- gateway.Serve(ctx, settings, listener, nil) }()
+
+		response := make(chan *http.Response, 1)
+		go func() {
+			req, _ := http.NewRequest(http.MethodGet, "http://"+listener.Addr().String()+"/plans", nil)
+			req.Header.Set("Authorization", "abc")
+			res, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Errorf("In-flight request failed: %s", err.Error())
+			}
+			response <- res
+		}()
+		select {
+		case <-received:
+		case <-time.After(2 * time.Second):
+			t.Fatal("The request didn't reach the upstream")
+		}
+		cancel()
+
+		time.Sleep(10 * time.Millisecond)
+		w := CreateTestResponseRecorder()
+		req, _ := http.NewRequest(http.MethodGet, "/readyz", nil)
+		gateway.ServeHTTP(w, req)
+		if w.Code != http.StatusServiceUnavailable {
+			t.Errorf("Got %d, want readiness to fail while shutting down", w.Code)
+		}
+
+		select {
+		case <-stopped:
+			t.Fatal("The gateway stopped before the in-flight request finished")
+		case <-time.After(100 * time.Millisecond):
+		}
+		close(release)
+		if res := <-response; res != nil {
+			body, _ := io.ReadAll(res.Body)
+			res.Body.Close()
+			assertBody(t, string(body), "4.5")
+		}
+		if err := <-stopped; err != nil {
+			t.Errorf("Got %s, want the gateway to stop cleanly", err.Error())
+		}
+	})
+
+	t.Run("In-flight requests are cut once the grace period elapses", func(t *testing.T) {
+		trainingsService := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			<-r.Context().Done()
+		}))
+		defer trainingsService.Close()
+
+		c := &config.Config{IsDevEnviroment: true}
+		gateway := New(c, tracing.Noop{}, defaultRoutes(t, upstream.Set{config.Trainings: testUpstream(trainingsService.URL)}, AuthTestService{}, nil))
+		listener, _ := net.Listen("tcp", "127.0.0.1:0")
+		ctx, cancel := context.WithCancel(context.Background())
+		settings := config.Server{ShutdownGracePeriod: 50 * time.Millisecond}
+		stopped := make(chan error, 1)
+		go func() { stopped <- gateway.Serve(ctx, settings, listener, nil) }()
+
+		go func() {
+			req, _ := http.NewRequest(http.MethodGet, "http://"+listener.Addr().String()+"/plans", nil)
+			req.Header.Set("Authorization", "abc")
+			if res, err := http.DefaultClient.Do(req); err == nil {
+				res.Body.Close()
+			}
+		}()
+		time.Sleep(50 * time.Millisecond)
+		cancel()
+
+		select {
+		case err := <-stopped:
+			if err != nil {
+				t.Errorf("Got %s, want the gateway to stop cleanly", err.Error())
+			}
+		case <-time.After(2 * time.Second):
+			t.Error("The gateway didn't stop after the grace period")
+		}
+	})
+}
+
+func TestListeners(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	usersService := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer usersService.Close()
+	upstreams := upstream.Set{config.Users: testUpstream(usersService.URL)}
+	c := &config.Config{IsDevEnviroment: true, MetricsToken: "secret", ReadyCacheTTL: time.Second, ReadyTimeout: time.Second}
+
+	// Sends a GET to the listener with the Authorization header, if any
+	get := func(t *testing.T, l net.Listener, path, authorization string) int {
+		req, _ := http.NewRequest(http.MethodGet, "http://"+l.Addr().String()+path, nil)
+		if authorization != "" {
+			req.Header.Set("Authorization", authorization)
+		}
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Request to %s failed: %s", path, err.Error())
+		}
+		res.Body.Close()
+		return res.StatusCode
+	}
+	serve := func(t *testing.T, c *config.Config) (net.Listener, net.Listener) {
+		gateway := New(c, tracing.Noop{}, defaultRoutes(t, upstream.Set{config.Users: testUpstream(usersService.URL)}, AuthTestService{}, nil), Health(c, upstreams, AuthTestService{}))
+		ctx, cancel := context.WithCancel(context.Background())
+		t.Cleanup(cancel)
+		listener, _ := net.Listen("tcp", "127.0.0.1:0")
+		ops, _ := net.Listen("tcp", "127.0.0.1:0")
+		go gateway.Serve(ctx, config.Server{}, listener, ops)
+		return listener, ops
+	}
+
+	t.Run("With an ops listener the health endpoints are only served on it and the metrics need the token elsewhere", func(t *testing.T) {
+		listener, ops := serve(t, c)
+
+		for path, want := range map[string][2]int{
+			"/healthz":          {http.StatusNotFound, http.StatusOK},
+			"/readyz":           {http.StatusNotFound, http.StatusOK},
+			"/internal/metrics": {http.StatusUnauthorized, http.StatusOK},
+			"/users/123":        {http.StatusOK, http.StatusNotFound},
+		} {
+			authorization := "abc"
+			if path == "/internal/metrics" {
+				authorization = ""
+			}
+			if got := [2]int{get(t, listener, path, authorization), get(t, ops, path, authorization)}; got != want {
+				t.Errorf("Got %v for %s on the gateway and ops listeners, want %v", got, path, want)
+			}
+		}
+		if got := get(t, listener, "/internal/metrics", "Bearer secret"); got != http.StatusOK {
+			t.Errorf("Got %d for the metrics with the token, want %d", got, http.StatusOK)
+		}
+	})
+
+	t.Run("Without a metrics token the metrics are only served on the ops listener", func(t *testing.T) {
+		withoutToken := *c
+		withoutToken.MetricsToken = ""
+		listener, ops := serve(t, &withoutToken)
+
+		if got := [2]int{get(t, listener, "/internal/metrics", ""), get(t, ops, "/internal/metrics", "")}; got != [2]int{http.StatusNotFound, http.StatusOK} {
+			t.Errorf("Got %v on the gateway and ops listeners, want [404 200]", got)
+		}
+	})
+
+	t.Run("With TLS and a client CA only clients presenting a certificate signed by it are served", func(t *testing.T) {
+		dir := t.TempDir()
+		ca, caKey := testCertificate(t, nil, nil)
+		client, clientKey := testCertificate(t, ca, caKey)
+		settings := config.Server{
+			Addr:         "127.0.0.1:0",
+			TLSCertFile:  writePEM(t, dir, "cert.pem", "CERTIFICATE", ca.Raw),
+			TLSKeyFile:   writePEM(t, dir, "key.pem", "EC PRIVATE KEY", caKey),
+			ClientCAFile: writePEM(t, dir, "ca.pem", "CERTIFICATE", ca.Raw),
+		}
+		tlsConfig, err := certs.ServerConfig(context.Background(), settings.TLSCertFile, settings.TLSKeyFile, settings.ClientCAFile)
+		if err != nil {
+			t.Fatalf("Couldn't load the TLS configuration: %s", err.Error())
+		}
+		gateway := New(c, tracing.Noop{}, Health(c, upstreams, AuthTestService{}))
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		listener, _ := net.Listen("tcp", settings.Addr)
+		go gateway.Serve(ctx, settings, tls.NewListener(listener, tlsConfig), nil)
+
+		pool := x509.NewCertPool()
+		pool.AddCert(ca)
+		url := "https://" + listener.Addr().String() + "/healthz"
+		anonymous := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}}}
+		if res, err := anonymous.Get(url); err == nil {
+			res.Body.Close()
+			t.Errorf("Got %d, want the handshake to fail without a client certificate", res.StatusCode)
+		}
+
+		clientCert := tls.Certificate{Certificate: [][]byte{client.Raw}, PrivateKey: clientKey}
+		authenticated := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool, Certificates: []tls.Certificate{clientCert}}}}
+		res, err := authenticated.Get(url)
+		if err != nil {
+			t.Fatalf("Request with a client certificate failed: %s", err.Error())
+		}
+		res.Body.Close()
+		if res.StatusCode != http.StatusOK {
+			t.Errorf("Got %d, want %d", res.StatusCode, http.StatusOK)
+		}
+	})
+}
+
+func TestFirebaseEmulator(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	t.Run("With the Auth emulator the gateway verifies tokens without credentials for a Firebase project", func(t *testing.T) {
+		// Stands in for the emulator, the SDK looks the user up to check
+		// the token wasn't revoked
+		emulator := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			assertBody(t, r.URL.Path, "/identitytoolkit.googleapis.com/v1/projects/fiufit-test/accounts:lookup")
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(`{"users":[{"localId":"123"}]}`))
+		}))
+		defer emulator.Close()
+		emulatorHost := strings.TrimPrefix(emulator.URL, "http://")
+		t.Setenv("FIREBASE_AUTH_EMULATOR_HOST", emulatorHost)
+		f, err := auth.GetFirebase(context.Background(), config.Firebase{ProjectID: "fiufit-test", EmulatorHost: emulatorHost})
+		if err != nil {
+			t.Fatalf("Couldn't start firebase in emulator mode: %s", err.Error())
+		}
+		usersService := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			assertBody(t, r.URL.Path, "/users/123")
+			assertBody(t, r.Header.Get("X-User-UID"), "123")
+			assertBody(t, r.Header.Get("X-User-Email"), "abc@xyz.com")
+			assertBody(t, r.Header.Get("X-User-Roles"), "trainer")
+			w.WriteHeader(http.StatusOK)
+		}))
+		defer usersService.Close()
+		c := &config.Config{IsDevEnviroment: true}
+		gateway := New(c, tracing.Noop{}, defaultRoutes(t, upstream.Set{config.Users: testUpstream(usersService.URL)}, f, nil))
+
+		for token, want := range map[string]int{
+			emulatorToken("fiufit-test", "123"):   http.StatusOK,
+			emulatorToken("other-project", "123"): http.StatusUnauthorized,
+		} {
+			w := CreateTestResponseRecorder()
+			req, _ := http.NewRequest(http.MethodGet, "/users/123", nil)
+			req.Header.Set("Authorization", token)
+			gateway.ServeHTTP(w, req)
+			if w.Code != want {
+				t.Errorf("Got %d, want %d", w.Code, want)
+			}
+		}
+	})
+
+	t.Run("Looking up a user that isn't in Firebase returns ErrUserNotFound", func(t *testing.T) {
+		emulator := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(`{}`))
+		}))
+		defer emulator.Close()
+		emulatorHost := strings.TrimPrefix(emulator.URL, "http://")
+		t.Setenv("FIREBASE_AUTH_EMULATOR_HOST", emulatorHost)
+		f, err := auth.GetFirebase(context.Background(), config.Firebase{ProjectID: "fiufit-test", EmulatorHost: emulatorHost})
+		if err != nil {
+			t.Fatalf("Couldn't start firebase in emulator mode: %s", err.Error())
+		}
+
+		_, err = f.GetUser("missing")
+
+		if !auth.IsUserNotFound(err) {
+			t.Errorf("Got %v, want ErrUserNotFound", err)
+		}
+	})
+
+	t.Run("Errors reaching Firebase aren't taken for a missing user", func(t *testing.T) {
+		emulator := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}))
+		defer emulator.Close()
+		emulatorHost := strings.TrimPrefix(emulator.URL, "http://")
+		t.Setenv("FIREBASE_AUTH_EMULATOR_HOST", emulatorHost)
+		f, err := auth.GetFirebase(context.Background(), config.Firebase{ProjectID: "fiufit-test", EmulatorHost: emulatorHost})
+		if err != nil {
+			t.Fatalf("Couldn't start firebase in emulator mode: %s", err.Error())
+		}
+
+		_, err = f.GetUser("123")
+
+		if err == nil || auth.IsUserNotFound(err) {
+			t.Errorf("Got %v, want an error other than ErrUserNotFound", err)
+		}
+	})
+}
+
+// Returns an unsigned ID token as issued by the Auth emulator
+func emulatorToken(projectID, uid string) string {
+	encode := func(value interface{}) string {
+		content, _ := json.Marshal(value)
+		return base64.RawURLEncoding.EncodeToString(content)
+	}
+	now := time.Now().Unix()
+	return encode(map[string]string{"alg": "none", "typ": "JWT"}) + "." + encode(map[string]interface{}{
+		"iss":       "https://securetoken.google.com/" + projectID,
+		"aud":       projectID,
+		"sub":       uid,
+		"user_id":   uid,
+		"iat":       now,
+		"exp":       now + 3600,
+		"auth_time": now,
+		"email":     "abc@xyz.com",
+		"roles":     []string{"trainer"},
+	}) + "."
+}
+
+// Returns a certificate for 127.0.0.1 signed by parent, or self-signed
+// and usable as a CA when parent is nil
+func testCertificate(t testing.TB, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	t.Helper()
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: "fiufit"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  parent == nil,
+	}
+	if parent == nil {
+		parent, parentKey = template, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatalf("Couldn't create certificate: %s", err.Error())
+	}
+	cert, _ := x509.ParseCertificate(der)
+	return cert, key
+}
+
+func writePEM(t testing.TB, dir, name, kind string, content interface{}) string {
+	t.Helper()
+	der, ok := content.([]byte)
+	if !ok {
+		der, _ = x509.MarshalECPrivateKey(content.(*ecdsa.PrivateKey))
+	}
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: kind, Bytes: der}), 0600); err != nil {
+		t.Fatalf("Couldn't write %s: %s", name, err.Error())
+	}
+	return path
+}
+
+// Compares forwarding requests through the proxy shared by the
+// upstream against building a new reverse proxy per request, as the
+// gateway used to do. Besides allocations it reports the connections
+// opened to the upstream per request.
+func BenchmarkReverseProxy(b *testing.B) {
+	gin.SetMode(gin.TestMode)
+	var connections int64
+	trainingsService := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("4.5"))
+	}))
+	trainingsService.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			atomic.AddInt64(&connections, 1)
+		}
+	}
+	trainingsService.Start()
+	defer trainingsService.Close()
+	trainingsServiceURL, _ := url.Parse(trainingsService.URL)
+	c := &config.Config{IsDevEnviroment: true}
+
+	run := func(b *testing.B, gateway http.Handler) {
+		atomic.StoreInt64(&connections, 0)
+		b.ReportAllocs()
+		b.SetParallelism(16)
+		b.ResetTimer()
+		b.RunParallel(func(pb *testing.PB) {
+			for pb.Next() {
+				w := CreateTestResponseRecorder()
+				req, _ := http.NewRequest(http.MethodGet, "/reviews/1/mean", nil)
+				gateway.ServeHTTP(w, req)
+				if w.Code != http.StatusOK {
+					b.Errorf("Got %d, want %d", w.Code, http.StatusOK)
+				}
+			}
+		})
+		b.ReportMetric(float64(atomic.LoadInt64(&connections))/float64(b.N), "conns/op")
+	}
+
+	b.Run("Proxy per request", func(b *testing.B) {
+		gateway := New(c, tracing.Noop{}, func(router *gin.Engine) {
+			router.GET("/reviews/:plan_id/mean", func(c *gin.Context) {
+				proxy := httputil.NewSingleHostReverseProxy(trainingsServiceURL)
+				clientIP := c.ClientIP()
+				proxy.ErrorHandler = func(rw http.ResponseWriter, r *http.Request, e error) {
+					log.WithFields(log.Fields{"client_ip": clientIP}).Info("Reverse proxy failed")
+					rw.WriteHeader(http.StatusBadGateway)
+				}
+				c.Request.Host = trainingsServiceURL.Host
+				proxy.ServeHTTP(c.Writer, c.Request)
+			})
+		})
+		run(b, gateway)
+	})
+
+	b.Run("Shared proxy per upstream", func(b *testing.B) {
+		trainings := upstream.New("trainings", []*url.URL{trainingsServiceURL}, upstream.Options{
+			Transport: config.Transport{MaxIdleConns: 100, MaxIdleConnsPerHost: 100, IdleConnTimeout: time.Minute},
+		})
+		defer upstream.Set{config.Trainings: trainings}.Close()
+		gateway := New(c, tracing.Noop{}, defaultRoutes(b, upstream.Set{config.Trainings: trainings}, AuthTestService{}, nil))
+		run(b, gateway)
 	})
 }
 
 type AuthTestService struct{}
 
 func (a AuthTestService) CreateUser(s auth.SignUpModel) (auth.UserModel, error) {
-	if len(s.Password) < 3 {
-		return auth.UserModel{}, errors.New("too short")
+	if s.Email == "taken@xyz.com" {
+		return auth.UserModel{}, errors.New("email already in use")
 	}
 	return auth.UserModel{UID: "123", Username: "abc", Email: "abc@xyz.com"}, nil
 }
 
-func (a AuthTestService) VerifyToken(token string) (string, error) {
+func (a AuthTestService) VerifyToken(token string) (auth.Claims, error) {
 	if token != "abc" {
-		return "", errors.New("unauthorized")
+		return auth.Claims{}, errors.New("unauthorized")
 	}
-	return "123", nil
+	return auth.Claims{UID: "123"}, nil
+}
+
+func (a AuthTestService) VerifyTokenAndCheckRevoked(token string) (auth.Claims, error) {
+	return a.VerifyToken(token)
 }
 
 func (a AuthTestService) GetUser(uid string) (auth.UserModel, error) {
@@ -220,6 +1089,18 @@ func (a AuthTestService) SetBlockStatus(uid string, blocked bool) error {
 	return nil
 }
 
+func (a AuthTestService) SetRoles(uid string, roles []string) error {
+	return nil
+}
+
+func (a AuthTestService) DeleteUser(uid string) error {
+	return nil
+}
+
+func (a AuthTestService) Ready() error {
+	return nil
+}
+
 // The types below are necessary for tests to run Gin requires that
 // the recorder implements the CloseNotify interface. So we generated
 // a wrapper that implements it.
@@ -0,0 +1,110 @@
+package gateway
+
+import (
+	"fiufit.api.gateway/cmd/middleware"
+	"fiufit.api.gateway/internal/auth"
+	"fiufit.api.gateway/internal/config"
+	"fiufit.api.gateway/internal/ratelimit"
+	"fiufit.api.gateway/internal/upstream"
+	"github.com/gin-gonic/gin"
+)
+
+// What the middlewares of the route manifest are built with, shared by
+// all the routes
+type dependencies struct {
+	services upstream.Set
+	auth     auth.Service
+	limiter  *ratelimit.Limiter
+	admins   *middleware.AdminLookup
+	keys     *middleware.ServiceKeys
+}
+
+// Builds the middleware referenced by name in the route manifest
+type middlewareFactory func(args []string, d dependencies) gin.HandlerFunc
+
+// Every middleware known by config must have a factory here
+var middlewareFactories = map[string]middlewareFactory{
+	"AuthorizeUser": func(args []string, d dependencies) gin.HandlerFunc {
+		if len(args) == 0 {
+			return middleware.AuthorizeUser(d.auth, d.limiter)
+		}
+		if args[0] == config.CheckRevoked {
+			return middleware.AuthorizeUser(auth.CheckRevoked(d.auth), d.limiter)
+		}
+		return middleware.AuthorizeUser(auth.Uncached(d.auth), d.limiter)
+	},
+	"AuthorizeService": func(args []string, d dependencies) gin.HandlerFunc {
+		return middleware.AuthorizeService(d.keys, args[0])
+	},
+	"AuthorizeAdmin": func(_ []string, d dependencies) gin.HandlerFunc {
+		return middleware.AuthorizeAdmin(d.admins)
+	},
+	"CreateUser": func(_ []string, d dependencies) gin.HandlerFunc {
+		return middleware.CreateUser(d.auth)
+	},
+	"CreateAdmin": func(_ []string, d dependencies) gin.HandlerFunc {
+		return middleware.CreateAdmin(d.auth)
+	},
+	"DeleteUser": func(_ []string, d dependencies) gin.HandlerFunc {
+		return middleware.DeleteUser(d.auth)
+	},
+	"ChangeBlockStatusFirebase": func(_ []string, d dependencies) gin.HandlerFunc {
+		return middleware.ChangeBlockStatusFirebase(d.auth)
+	},
+	"AddUIDToRequestURL": func(_ []string, _ dependencies) gin.HandlerFunc {
+		return middleware.AddUIDToRequestURL()
+	},
+	"SetQuery": func(args []string, _ dependencies) gin.HandlerFunc {
+		return middleware.SetQuery(args[0], args[1])
+	},
+	"RemovePathFromRequestURL": func(args []string, _ dependencies) gin.HandlerFunc {
+		return middleware.RemovePathFromRequestURL(args[0])
+	},
+	"Timeout": func(args []string, _ dependencies) gin.HandlerFunc {
+		timeouts, _ := config.ParseTimeouts(args)
+		return middleware.Timeout(timeouts)
+	},
+	"Retry": func(args []string, _ dependencies) gin.HandlerFunc {
+		policy, _ := config.ParseRetry(args)
+		return middleware.Retry(policy)
+	},
+	"RequireRole": func(args []string, d dependencies) gin.HandlerFunc {
+		return middleware.RequireRole(d.admins, args...)
+	},
+	"RequireOwner": func(args []string, d dependencies) gin.HandlerFunc {
+		if len(args) == 0 {
+			return middleware.RequireOwner(d.admins, config.DefaultOwnerParam)
+		}
+		return middleware.RequireOwner(d.admins, args[0])
+	},
+	"RateLimit": func(args []string, d dependencies) gin.HandlerFunc {
+		if len(args) == 0 || d.limiter == nil {
+			return middleware.RateLimit(d.limiter)
+		}
+		quota, _ := config.ParseQuota(args[0])
+		return middleware.RateLimit(d.limiter.WithQuota(quota))
+	},
+}
+
+// Sets the routes defined in the route manifest. Each route runs its
+// middlewares in order and then forwards the request to its service.
+// The routes must be validated by config beforehand.
+func Routes(routes []config.Route, services upstream.Set, s auth.Service, keys *middleware.ServiceKeys, admins *middleware.AdminLookup, l *ratelimit.Limiter) RouterConfig {
+	d := dependencies{
+		services: services,
+		auth:     s,
+		limiter:  l,
+		admins:   admins,
+		keys:     keys,
+	}
+	return func(router *gin.Engine) {
+		for _, route := range routes {
+			handlers := make([]gin.HandlerFunc, 0, len(route.Middleware)+1)
+			for _, spec := range route.Middleware {
+				handlers = append(handlers, middlewareFactories[spec.Name](spec.Args, d))
+			}
+			handlers = append(handlers, middleware.ReverseProxy(services[route.ServiceKey()]))
+			router.Handle(route.Method, route.Path, handlers...)
+		}
+	}
+}
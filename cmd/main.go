@@ -2,15 +2,25 @@ package main
 
 import (
 	"context"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"fiufit.api.gateway/cmd/gateway"
+	"fiufit.api.gateway/cmd/middleware"
 	"fiufit.api.gateway/internal/auth"
 	"fiufit.api.gateway/internal/config"
+	"fiufit.api.gateway/internal/ratelimit"
+	"fiufit.api.gateway/internal/tracing"
+	"fiufit.api.gateway/internal/upstream"
 
 	log "github.com/sirupsen/logrus"
-	"gopkg.in/DataDog/dd-trace-go.v1/ddtrace/tracer"
 )
 
+// Time the spans and logs have to be flushed after the gateway stops
+const flushTimeout = 5 * time.Second
+
 func main() {
 	c, err := config.New()
 	if err != nil {
@@ -19,27 +29,103 @@ func main() {
 
 	config.InitLogger(c)
 
-	ctx := context.Background()
-	f, err := auth.GetFirebase(ctx)
+	f, err := auth.GetFirebase(context.Background(), c.Firebase)
 	if err != nil {
 		log.Fatalf("Couldn't start firebase service: %s", err.Error())
 	}
 
-	usersURL := c.URLS[config.Users]
-	trainingsURL := c.URLS[config.Trainings]
-	metricsURL := c.URLS[config.Metrics]
-	goalsURL := c.URLS[config.Goals]
+	// The cache outlives reloads, tokens verified before one are still
+	// valid after it
+	s := auth.NewTokenCache(f, c.TokenCache.Size, c.TokenCache.TTL)
+
+	t, err := tracing.New(c.Tracing)
+	if err != nil {
+		log.Fatalf("Couldn't start tracer: %s", err.Error())
+	}
+
+	// Cancelled on SIGTERM or SIGINT, stopping the health checks, the
+	// reloads and then the gateway
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, syscall.SIGINT)
+	defer stop()
+
+	// The buckets outlive reloads, only the quotas are reloaded
+	store := ratelimit.NewStore(c.RateLimit)
+	upstreams := upstream.NewSet(c.URLS)
+	stopHealthChecks := startHealthChecks(ctx, upstreams)
+	gateway := gateway.New(c, t, routers(c, upstreams, s, ratelimit.New(store, c.RateLimit))...)
+	go reloadOnChange(ctx, gateway, s, store, upstreams, stopHealthChecks)
 
-	tracer.Start(tracer.WithService(config.ServiceName))
-	defer tracer.Stop()
+	err = gateway.Run(ctx, c.Server)
+	if err != nil {
+		log.Fatalf("Gateway stopped: %s", err.Error())
+	}
+
+	// In-flight requests finished, send the spans they left behind
+	flushCtx, cancel := context.WithTimeout(context.Background(), flushTimeout)
+	defer cancel()
+	if err := t.Shutdown(flushCtx); err != nil {
+		log.WithFields(log.Fields{"error": err.Error()}).Warn("Couldn't flush spans")
+	}
+	flushLogs()
+}
 
-	gateway := gateway.New(c,
-		gateway.Users(usersURL, f),
-		gateway.Admin(usersURL, trainingsURL, metricsURL, f),
-		gateway.Trainings(trainingsURL, f),
-		gateway.Reviews(trainingsURL, f),
-		gateway.Goals(goalsURL, f),
-		gateway.Metrics(metricsURL, f))
+// Syncs the log output to disk if it's a file, logrus doesn't buffer
+func flushLogs() {
+	if file, ok := log.StandardLogger().Out.(*os.File); ok {
+		file.Sync()
+	}
+}
+
+// Returns the routes of the gateway, the ones of the route manifest
+// and the admin and health endpoints not forwarded to a service. They
+// share one admin lookup, so every route sees the same cached roles.
+func routers(c *config.Config, upstreams upstream.Set, f auth.Service, l *ratelimit.Limiter) []gateway.RouterConfig {
+	keys := middleware.NewServiceKeys(c.ServiceKeys)
+	admins := middleware.NewAdminLookup(upstreams[config.Users])
+	return []gateway.RouterConfig{
+		gateway.Routes(c.Routes, upstreams, f, keys, admins, l),
+		gateway.Breakers(upstreams, admins, f),
+		gateway.Roles(admins, f),
+		gateway.Health(c, upstreams, f),
+	}
+}
+
+// Reloads the configuration and swaps the gateway routes when the
+// process receives SIGHUP or the route manifest changes. An invalid
+// configuration is logged and the current routes are kept.
+func reloadOnChange(ctx context.Context, g *gateway.Gateway, f auth.Service, store ratelimit.Store, upstreams upstream.Set, stopHealthChecks context.CancelFunc) {
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+	defer signal.Stop(hangup)
+	changes := config.WatchManifest(ctx)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hangup:
+		case <-changes:
+		}
+
+		c, err := config.New()
+		if err != nil {
+			log.WithFields(log.Fields{"error": err.Error()}).Error("Invalid gateway configuration, keeping current routes")
+			continue
+		}
+		config.InitLogger(c)
+		previous, stopPrevious := upstreams, stopHealthChecks
+		upstreams = upstream.NewSet(c.URLS)
+		stopHealthChecks = startHealthChecks(ctx, upstreams)
+		g.Reload(c, routers(c, upstreams, f, ratelimit.New(store, c.RateLimit))...)
+		stopPrevious()
+		previous.Close()
+	}
+}
 
-	gateway.Run("0.0.0.0:8080")
+// Starts probing the instances of the upstreams, the returned function
+// stops it
+func startHealthChecks(ctx context.Context, upstreams upstream.Set) context.CancelFunc {
+	ctx, cancel := context.WithCancel(ctx)
+	upstreams.Start(ctx)
+	return cancel
 }
@@ -1,21 +1,76 @@
 package middleware
 
 import (
+	"bufio"
 	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
+	mathrand "math/rand"
+	"net"
 	"net/http"
-	"net/http/httputil"
 	"net/url"
 	"path"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"fiufit.api.gateway/internal/auth"
+	"fiufit.api.gateway/internal/config"
+	"fiufit.api.gateway/internal/health"
+	"fiufit.api.gateway/internal/metrics"
+	"fiufit.api.gateway/internal/problem"
+	"fiufit.api.gateway/internal/ratelimit"
+	"fiufit.api.gateway/internal/tracing"
+	"fiufit.api.gateway/internal/upstream"
 	"github.com/gin-gonic/gin"
 	log "github.com/sirupsen/logrus"
 )
 
 const uidKey string = "User-UID"
+const claimsKey string = "User-Claims"
+const userHeadersSecretKey string = "User-Headers-Secret"
+const requestIDKey string = "Request-ID"
+const upstreamKey string = "Upstream"
+const instanceKey string = "Upstream-Instance"
+const serviceKeyKey string = "Service-Key"
+
+// Header internal services send their API key in
+const apiKeyHeader string = "X-API-Key"
+
+// Headers forwarded to the upstreams with the claims of the user. The
+// gateway drops any sent by the client, so the services can trust them.
+const (
+	userHeaderPrefix        = "X-User-"
+	userUIDHeader           = "X-User-UID"
+	userEmailHeader         = "X-User-Email"
+	userEmailVerifiedHeader = "X-User-Email-Verified"
+	userProviderHeader      = "X-User-Provider"
+	userRolesHeader         = "X-User-Roles"
+	userAuthTimeHeader      = "X-User-Auth-Time"
+	userSignatureHeader     = "X-User-Signature"
+)
+
+// Value logged in place of the redacted fields
+const redacted string = "[REDACTED]"
+const retryPolicyKey string = "Retry-Policy"
+const timeoutsKey string = "Route-Timeouts"
+
+// Largest body buffered to be replayed on retries, requests with
+// bigger bodies aren't retried
+const maxRetryBodySize int64 = 1 << 20
+
+// Header sent to the upstreams with the milliseconds left before the
+// gateway gives up on the request
+const deadlineHeader string = "X-Request-Deadline"
 const authorizedKey string = "Authorized"
 const allowedHeaders string = "Authorization, Content-Type, Content-Length"
 const allowedMethods string = "POST, GET, PUT, DELETE, OPTIONS, PATCH"
@@ -32,14 +87,14 @@ func ChangeBlockStatusFirebase(s auth.Service) gin.HandlerFunc {
 		var users []BlockModel
 		err := c.BindJSON(&users)
 		if err != nil {
-			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			abortWithProblem(c, http.StatusBadRequest, problem.InvalidBody, err.Error())
 			return
 		}
 
 		for _, user := range users {
 			_, err := s.GetUser(user.UID)
 			if err != nil {
-				c.AbortWithStatusJSON(http.StatusNotFound, err.Error())
+				abortWithUserError(c, user.UID, err)
 				return
 			}
 		}
@@ -48,14 +103,14 @@ func ChangeBlockStatusFirebase(s auth.Service) gin.HandlerFunc {
 			// Shouldn't fail
 			err = s.SetBlockStatus(user.UID, user.Blocked)
 			if err != nil {
-				c.AbortWithStatusJSON(http.StatusInternalServerError, err.Error())
+				abortWithProblem(c, http.StatusInternalServerError, problem.Internal, err.Error())
 				return
 			}
 		}
 
 		buf, err := json.Marshal(users)
 		if err != nil {
-			c.AbortWithStatusJSON(http.StatusInternalServerError, err.Error())
+			abortWithProblem(c, http.StatusInternalServerError, problem.Internal, err.Error())
 			return
 		}
 
@@ -71,27 +126,223 @@ func SetQuery(key, value string) gin.HandlerFunc {
 	}
 }
 
-func ReverseProxy(url *url.URL) gin.HandlerFunc {
+// Longest request ID accepted from clients
+const maxRequestIDLength = 128
+
+// Identifies each request with the X-Request-ID sent by the client, or
+// a new one if it didn't send a valid one. The ID is forwarded to the
+// services, echoed in the response and included in the logs.
+func RequestID() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id := c.Request.Header.Get(problem.RequestIDHeader)
+		if !validRequestID(id) {
+			id = newRequestID()
+		}
+		c.Set(requestIDKey, id)
+		c.Request.Header.Set(problem.RequestIDHeader, id)
+		c.Header(problem.RequestIDHeader, id)
+	}
+}
+
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for _, r := range id {
+		valid := r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || strings.ContainsRune("-_.:", r)
+		if !valid {
+			return false
+		}
+	}
+	return true
+}
+
+func newRequestID() string {
+	id := make([]byte, 16)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+// Returns a log entry carrying the ID of the request
+func logger(c *gin.Context) *log.Entry {
+	if id := c.GetString(requestIDKey); id != "" {
+		return log.WithField("request_id", id)
+	}
+	return log.NewEntry(log.StandardLogger())
+}
+
+// Aborts the request responding with a problem
+func abortWithProblem(c *gin.Context, status int, code, detail string) {
+	problem.Write(c.Writer, c.Request, problem.New(status, code, detail))
+	c.Abort()
+}
+
+// Forwards the request to one of the instances of the upstream. The
+// outcome is reported back to the upstream so failing instances are
+// ejected, while the circuit breaker of the upstream is open requests
+// are rejected with 503. If the route didn't set a timeout the one of
+// the upstream is used, the time left is sent to the instance in
+// X-Request-Deadline.
+func ReverseProxy(u *upstream.Upstream) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if allowed, wait := u.Allow(); !allowed {
+			logger(c).WithFields(log.Fields{"uri": c.Request.RequestURI, "upstream": u.Name}).Info("Circuit breaker open, rejecting request")
+			c.Header("Retry-After", strconv.Itoa(upstream.RetryAfter(wait)))
+			abortWithProblem(c, http.StatusServiceUnavailable, problem.UpstreamUnavailable, "upstream "+u.Name+" is unavailable")
+			return
+		}
+
+		ctx := c.Request.Context()
+		if _, found := ctx.Deadline(); !found && u.Timeout() > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, u.Timeout())
+			defer cancel()
+		}
+		setDeadlineHeader(c.Request.Header, ctx)
+
+		policy := u.Retry()
+		if routePolicy, found := c.Get(retryPolicyKey); found {
+			policy = routePolicy.(config.Retry)
+		}
+		if policy.Attempts > 1 && upstream.IsIdempotent(c.Request) && bufferBody(c.Request) {
+			ctx = upstream.WithRetry(ctx, policy)
+		}
+		if timeouts, found := c.Get(timeoutsKey); found {
+			ctx = upstream.WithTimeouts(ctx, timeouts.(config.Timeouts))
+		}
+		ctx = upstream.WithClientIP(ctx, c.ClientIP())
+
+		key := balancingKey(c)
+		instance := u.Pick(key)
+		c.Set(upstreamKey, u.Name)
+		c.Set(instanceKey, instance.URL.Host)
+		c.Request.Host = instance.URL.Host
+
+		u.ServeHTTP(c.Writer, c.Request.WithContext(upstream.WithInstance(ctx, instance, key)))
+	}
+}
+
+// Sets the retry policy of the route, overriding the one of the
+// upstream. Only idempotent requests, or those carrying an
+// Idempotency-Key header, are retried.
+func Retry(policy config.Retry) gin.HandlerFunc {
 	return func(c *gin.Context) {
-		proxy := httputil.NewSingleHostReverseProxy(url)
-		clientIp := c.ClientIP()
-		proxy.ErrorHandler = getErrorHandler(clientIp)
-		c.Request.Host = url.Host
-		proxy.ServeHTTP(c.Writer, c.Request)
+		c.Set(retryPolicyKey, policy)
 	}
 }
 
-func getErrorHandler(clientIP string) func(http.ResponseWriter, *http.Request, error) {
-	return func(rw http.ResponseWriter, r *http.Request, e error) {
-		log.WithFields(log.Fields{"uri": r.RequestURI, "client_ip": clientIP, "error": e.Error()}).Info("Reverse proxy failed")
-		rw.WriteHeader(http.StatusBadGateway)
+// Reads the body of the request into memory so it can be sent again on
+// retries. Returns false, leaving the body readable, if it's too big.
+func bufferBody(r *http.Request) bool {
+	if r.Body == nil || r.Body == http.NoBody {
+		return true
 	}
+
+	buf, err := io.ReadAll(io.LimitReader(r.Body, maxRetryBodySize+1))
+	if err != nil || int64(len(buf)) > maxRetryBodySize {
+		r.Body = io.NopCloser(io.MultiReader(bytes.NewReader(buf), r.Body))
+		return false
+	}
+
+	r.Body.Close()
+	r.Body = io.NopCloser(bytes.NewReader(buf))
+	r.GetBody = func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(buf)), nil
+	}
+	return true
+}
+
+// Limits the time the rest of the chain may take, including the
+// request to the upstream. On expiry the gateway responds with 504. The
+// connect and response header timeouts, when set, override those of
+// the upstream for this route.
+func Timeout(timeouts config.Timeouts) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ctx, cancel := context.WithTimeout(c.Request.Context(), timeouts.Total)
+		defer cancel()
+		c.Request = c.Request.WithContext(ctx)
+		c.Set(timeoutsKey, timeouts)
+		c.Next()
+	}
+}
+
+// Replaces any deadline sent by the client with the time left before
+// the context expires
+func setDeadlineHeader(header http.Header, ctx context.Context) {
+	deadline, found := ctx.Deadline()
+	if !found {
+		header.Del(deadlineHeader)
+		return
+	}
+	remaining := time.Until(deadline).Milliseconds()
+	if remaining < 0 {
+		remaining = 0
+	}
+	header.Set(deadlineHeader, strconv.FormatInt(remaining, 10))
+}
+
+// Returns the key used by balancers that keep clients on the same
+// instance, the UID of the user if authenticated or its IP otherwise
+func balancingKey(c *gin.Context) string {
+	if UID, ok := getUID(c); ok {
+		return UID
+	}
+	return c.ClientIP()
+}
+
+// Limits the requests each client sends to the route, identifying it by
+// its UID when authenticated or its IP otherwise, so it must run after
+// AuthorizeUser. The quota is reported in the X-RateLimit-* headers and
+// requests over it are rejected with 429. A nil limiter allows every
+// request.
+func RateLimit(l *ratelimit.Limiter) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if l == nil {
+			return
+		}
+		key := "ip:" + c.ClientIP()
+		if UID, ok := getUID(c); ok {
+			key = "uid:" + UID
+		} else if serviceKey, ok := c.Get(serviceKeyKey); ok {
+			key = "service:" + serviceKey.(config.ServiceKey).ID
+		}
+		takeToken(c, l, key)
+	}
+}
+
+// Takes a token from the bucket of the client identified by key for the
+// route and reports the quota in the X-RateLimit-* headers. Returns
+// false, having aborted with 429, if the bucket is empty.
+func takeToken(c *gin.Context, l *ratelimit.Limiter, key string) bool {
+	result, limited := l.Allow(c.Request.Context(), key, c.Request.Method, c.FullPath())
+	if !limited {
+		return true
+	}
+	c.Header("X-RateLimit-Limit", strconv.Itoa(result.Limit))
+	c.Header("X-RateLimit-Remaining", strconv.Itoa(result.Remaining))
+	c.Header("X-RateLimit-Reset", strconv.Itoa(upstream.RetryAfter(result.Reset)))
+	if !result.Allowed {
+		logger(c).WithFields(log.Fields{"uri": c.Request.RequestURI, "client": key}).Info("Rate limit exceeded")
+		c.Header("Retry-After", strconv.Itoa(upstream.RetryAfter(result.RetryAfter)))
+		abortWithProblem(c, http.StatusTooManyRequests, problem.RateLimited, "rate limit exceeded")
+		return false
+	}
+	return true
 }
 
-func AuthorizeUser(s auth.Service) gin.HandlerFunc {
+// Verifies the Firebase token of the request. Requests whose token
+// can't be verified never reach RateLimit, so they take a token from
+// the bucket of their IP with l, if not nil, and once it's empty get
+// 429 instead of 401.
+func AuthorizeUser(s auth.Service, l *ratelimit.Limiter) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		token := c.Request.Header.Get("Authorization")
-		uid, err := s.VerifyToken(token)
+		_, span := tracing.StartSpan(c.Request.Context(), "firebase.verify_token")
+		claims, err := s.VerifyToken(token)
+		if err != nil {
+			span.SetError(err)
+		}
+		span.End()
 		logContext := log.Fields{
 			"method":    c.Request.Method,
 			"client_ip": c.ClientIP(),
@@ -101,43 +352,389 @@ func AuthorizeUser(s auth.Service) gin.HandlerFunc {
 		if err != nil {
 			logContext["authorized"] = true
 			logContext["error"] = err.Error()
-			log.WithFields(logContext).Info("Firebase Authorization failed")
-			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+			logger(c).WithFields(logContext).Info("Firebase Authorization failed")
+			metrics.AuthFailures.Inc()
+			if l != nil && !takeToken(c, l, "ip:"+c.ClientIP()) {
+				return
+			}
+			abortWithProblem(c, http.StatusUnauthorized, problem.Unauthorized, err.Error())
 			return
 		}
 		logContext["authorized"] = true
-		log.WithFields(logContext).Info("Firebase Authorization done")
-		c.Set(uidKey, uid)
+		logger(c).WithFields(logContext).Info("Firebase Authorization done")
+		c.Set(uidKey, claims.UID)
+		c.Set(claimsKey, claims)
+		setUserHeaders(c, claims)
 	}
 }
 
-func AuthorizeAdmin(url *url.URL) gin.HandlerFunc {
+// Drops the user headers sent by the client, AuthorizeUser sets them
+// again from the verified token. When secret isn't empty they're
+// signed with it in X-User-Signature.
+func UserHeaders(secret string) gin.HandlerFunc {
 	return func(c *gin.Context) {
+		for name := range c.Request.Header {
+			if strings.HasPrefix(http.CanonicalHeaderKey(name), userHeaderPrefix) {
+				c.Request.Header.Del(name)
+			}
+		}
+		if secret != "" {
+			c.Set(userHeadersSecretKey, secret)
+		}
+	}
+}
 
-		UID, ok := getUID(c)
+func setUserHeaders(c *gin.Context, claims auth.Claims) {
+	values := []struct{ name, value string }{
+		{userUIDHeader, claims.UID},
+		{userEmailHeader, claims.Email},
+		{userEmailVerifiedHeader, strconv.FormatBool(claims.EmailVerified)},
+		{userProviderHeader, claims.Provider},
+		{userRolesHeader, strings.Join(claims.Roles(), ",")},
+		{userAuthTimeHeader, strconv.FormatInt(claims.AuthTime.Unix(), 10)},
+	}
+	signed := make([]string, 0, len(values)+1)
+	for _, header := range values {
+		c.Request.Header.Set(header.name, header.value)
+		signed = append(signed, header.value)
+	}
+	if secret := c.GetString(userHeadersSecretKey); secret != "" {
+		// The request ID ties the signature to this request
+		signed = append(signed, c.GetString(requestIDKey))
+		mac := hmac.New(sha256.New, []byte(secret))
+		mac.Write([]byte(strings.Join(signed, "\n")))
+		c.Request.Header.Set(userSignatureHeader, hex.EncodeToString(mac.Sum(nil)))
+	}
+}
+
+// Returns the claims of the token verified by AuthorizeUser
+func GetClaims(c *gin.Context) (auth.Claims, bool) {
+	claims, found := c.Get(claimsKey)
+	if !found {
+		return auth.Claims{}, false
+	}
+	typed, ok := claims.(auth.Claims)
+	return typed, ok
+}
+
+// Time the answers of the users service about a user being an admin
+// are reused
+const (
+	adminCacheTTL    = 5 * time.Minute
+	notAdminCacheTTL = 30 * time.Second
+	// Answers kept before the expired ones are dropped
+	maxAdminResults = 10000
+)
+
+// AdminLookup asks the users service whether users are admins, for the
+// ones whose token doesn't carry the admin role yet. The answers are
+// cached, the negative ones for less time so new admins are let in
+// soon.
+type AdminLookup struct {
+	users   *upstream.Upstream
+	mu      sync.Mutex
+	results map[string]adminResult
+}
+
+type adminResult struct {
+	admin   bool
+	expires time.Time
+}
+
+// Returns nil, looking nobody up, when there's no users service
+func NewAdminLookup(users *upstream.Upstream) *AdminLookup {
+	if users == nil {
+		return nil
+	}
+	return &AdminLookup{users: users, results: make(map[string]adminResult)}
+}
+
+// Returns true if the users service knows the user as an admin. Errors
+// reaching it count as not being an admin and aren't cached.
+func (l *AdminLookup) IsAdmin(c *gin.Context, uid string) bool {
+	l.mu.Lock()
+	result, found := l.results[uid]
+	l.mu.Unlock()
+	if found && time.Now().Before(result.expires) {
+		return result.admin
+	}
+
+	admin, err := l.lookup(c, uid)
+	if err != nil {
+		logger(c).WithFields(log.Fields{"error": err.Error()}).Warn("Couldn't look up admin in users service")
+		return false
+	}
+	ttl := notAdminCacheTTL
+	if admin {
+		ttl = adminCacheTTL
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if len(l.results) >= maxAdminResults {
+		now := time.Now()
+		for uid, result := range l.results {
+			if !now.Before(result.expires) {
+				delete(l.results, uid)
+			}
+		}
+	}
+	l.results[uid] = adminResult{admin: admin, expires: time.Now().Add(ttl)}
+	return admin
+}
+
+func (l *AdminLookup) lookup(c *gin.Context, uid string) (bool, error) {
+	ctx, span := tracing.StartSpan(c.Request.Context(), "users.admin_lookup")
+	defer span.End()
+	span.SetAttribute(tracing.KindAttribute, "client")
+	adminURL := *l.users.Pick(uid).URL
+	adminURL.Path = path.Join(adminURL.Path, "admins", uid)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, adminURL.String(), nil)
+	if err != nil {
+		span.SetError(err)
+		return false, err
+	}
+	req.Header.Set(problem.RequestIDHeader, c.GetString(requestIDKey))
+	tracing.Inject(ctx, req.Header)
+	response, err := l.users.Client().Do(req)
+	if err != nil {
+		span.SetError(err)
+		return false, err
+	}
+	response.Body.Close()
+	span.SetAttribute("http.status_code", response.StatusCode)
+	if response.StatusCode >= http.StatusInternalServerError {
+		return false, fmt.Errorf("users service responded %d", response.StatusCode)
+	}
+	return response.StatusCode == http.StatusOK, nil
+}
+
+// Lets in the users with the admin role in their token or, while the
+// roles are being migrated to custom claims, the ones the users service
+// knows as admins. Must run after AuthorizeUser.
+func AuthorizeAdmin(admins *AdminLookup) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		claims, ok := currentClaims(c)
 		if !ok {
-			log.WithFields(log.Fields{"error": "UID not set in context"}).Error("Admin authentication failed")
-			c.AbortWithStatus(http.StatusInternalServerError)
+			logger(c).WithFields(log.Fields{"error": "UID not set in context"}).Error("Admin authentication failed")
+			abortWithProblem(c, http.StatusInternalServerError, problem.Internal, "")
 			return
 		}
-		adminURL := *url
-		adminURL.Path = path.Join(adminURL.Path, "admins", UID)
-		resultChannel := make(chan bool)
-		go func(rawURL string) {
-			response, err := http.Get(rawURL)
-			if err != nil || response.StatusCode != http.StatusOK {
-				resultChannel <- false
-				return
-			}
-			resultChannel <- true
-		}(adminURL.String())
+		if !hasRole(c, admins, claims, auth.RoleAdmin) {
+			logger(c).WithFields(log.Fields{"error": "Not an admin"}).Info("Admin authentication failed")
+			metrics.AdminCheckFailures.Inc()
+			abortWithProblem(c, http.StatusUnauthorized, problem.NotAdmin, "the user is not an admin")
+			return
+		}
+	}
+}
 
-		ok = <-resultChannel
+// Lets in the users with any of the roles in their token. The admin
+// role is also looked up with admins, if not nil, while the roles are
+// being migrated. Must run after AuthorizeUser.
+func RequireRole(admins *AdminLookup, roles ...string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		claims, ok := currentClaims(c)
+		if !ok {
+			logger(c).WithFields(log.Fields{"error": "UID not set in context"}).Error("Role check failed")
+			abortWithProblem(c, http.StatusInternalServerError, problem.Internal, "")
+			return
+		}
+		if !hasRole(c, admins, claims, roles...) {
+			logger(c).WithFields(log.Fields{"roles": roles, "uid": claims.UID}).Info("User lacks the roles of the route")
+			abortWithProblem(c, http.StatusForbidden, problem.MissingRole, "the route requires one of the roles "+strings.Join(roles, ", "))
+			return
+		}
+	}
+}
+
+// Lets in the user whose UID is in the param path parameter, e.g.
+// user_id, and the admins, so users can only act on their own data.
+// Every write route on a resource of a user runs it. Must run after
+// AuthorizeUser.
+func RequireOwner(admins *AdminLookup, param string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		claims, ok := currentClaims(c)
 		if !ok {
-			log.WithFields(log.Fields{"error": "Not an admin"}).Info("Admin authentication failed")
-			c.AbortWithStatus(http.StatusUnauthorized)
+			logger(c).WithFields(log.Fields{"error": "UID not set in context"}).Error("Ownership check failed")
+			abortWithProblem(c, http.StatusInternalServerError, problem.Internal, "")
+			return
+		}
+		owner := c.Param(param)
+		if owner == claims.UID || hasRole(c, admins, claims, auth.RoleAdmin) {
+			return
+		}
+		logger(c).WithFields(log.Fields{"uid": claims.UID, "owner": owner}).Info("User isn't the owner of the resource")
+		abortWithProblem(c, http.StatusForbidden, problem.NotOwner, "the resource belongs to another user")
+	}
+}
+
+// ServiceKeys finds the API keys of the internal services by their
+// hash
+type ServiceKeys struct {
+	keys map[[sha256.Size]byte]config.ServiceKey
+}
+
+func NewServiceKeys(keys []config.ServiceKey) *ServiceKeys {
+	k := &ServiceKeys{keys: make(map[[sha256.Size]byte]config.ServiceKey, len(keys))}
+	for _, key := range keys {
+		var hash [sha256.Size]byte
+		hex.Decode(hash[:], []byte(key.SHA256))
+		k.keys[hash] = key
+	}
+	return k
+}
+
+func (k *ServiceKeys) find(key string) (config.ServiceKey, bool) {
+	if k == nil || key == "" {
+		return config.ServiceKey{}, false
+	}
+	serviceKey, found := k.keys[sha256.Sum256([]byte(key))]
+	return serviceKey, found
+}
+
+// Lets in the internal services sending a key with the scope in the
+// X-API-Key header, rejecting everyone else, end users included. Every
+// attempt is logged for auditing and the key isn't forwarded.
+func AuthorizeService(keys *ServiceKeys, scope string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		key, found := keys.find(c.Request.Header.Get(apiKeyHeader))
+		c.Request.Header.Del(apiKeyHeader)
+		audit := logger(c).WithFields(log.Fields{
+			"audit":  true,
+			"key_id": key.ID,
+			"caller": key.Service,
+			"scope":  scope,
+			"method": c.Request.Method,
+			"uri":    c.Request.RequestURI,
+			"client": c.ClientIP(),
+		})
+
+		result := "accepted"
+		switch {
+		case !found:
+			result = "unknown"
+		case !key.Expires.IsZero() && !time.Now().Before(key.Expires):
+			result = "expired"
+		case !hasScope(key, scope):
+			result = "missing_scope"
+		}
+		metrics.ServiceKeyRequests.Inc(key.ID, result)
+		audit = audit.WithFields(log.Fields{"result": result})
+
+		switch result {
+		case "accepted":
+			audit.Info("Service request authenticated")
+			c.Set(serviceKeyKey, key)
+		case "missing_scope":
+			audit.Warn("Service request rejected")
+			abortWithProblem(c, http.StatusForbidden, problem.MissingScope, "the key lacks the scope "+scope)
+		default:
+			audit.Warn("Service request rejected")
+			abortWithProblem(c, http.StatusUnauthorized, problem.Unauthorized, "invalid service key")
+		}
+	}
+}
+
+func hasScope(key config.ServiceKey, scope string) bool {
+	for _, s := range key.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the claims of the token, or just the UID if it was set
+// without them
+func currentClaims(c *gin.Context) (auth.Claims, bool) {
+	if claims, ok := GetClaims(c); ok {
+		return claims, true
+	}
+	uid, ok := getUID(c)
+	return auth.Claims{UID: uid}, ok
+}
+
+func hasRole(c *gin.Context, admins *AdminLookup, claims auth.Claims, roles ...string) bool {
+	if claims.HasRole(roles...) {
+		return true
+	}
+	for _, role := range roles {
+		if role == auth.RoleAdmin && admins != nil {
+			return admins.IsAdmin(c, claims.UID)
+		}
+	}
+	return false
+}
+
+type RolesModel struct {
+	Roles []string `json:"roles" binding:"required"`
+}
+
+// Sets the roles of the user in the user_id parameter, responding with
+// them. The user gets them in the tokens issued from then on.
+func SetRoles(s auth.Service) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var body RolesModel
+		if err := c.ShouldBindJSON(&body); err != nil {
+			abortWithProblem(c, http.StatusBadRequest, problem.InvalidBody, err.Error())
 			return
 		}
+		for _, role := range body.Roles {
+			if !auth.ValidRole(role) {
+				abortWithProblem(c, http.StatusBadRequest, problem.InvalidBody, "unknown role "+role)
+				return
+			}
+		}
+		uid := c.Param("user_id")
+		if _, err := s.GetUser(uid); err != nil {
+			abortWithUserError(c, uid, err)
+			return
+		}
+		if err := s.SetRoles(uid, body.Roles); err != nil {
+			logger(c).WithFields(log.Fields{"error": err.Error(), "uid": uid}).Error("Couldn't set roles in firebase")
+			abortWithProblem(c, http.StatusInternalServerError, problem.Internal, "")
+			return
+		}
+		logger(c).WithFields(log.Fields{"uid": uid, "roles": body.Roles}).Info("User roles set")
+		c.JSON(http.StatusOK, body)
+	}
+}
+
+// Aborts the request with 404 if the user doesn't exist, or 500 if it
+// couldn't be looked up
+func abortWithUserError(c *gin.Context, uid string, err error) {
+	if auth.IsUserNotFound(err) {
+		abortWithProblem(c, http.StatusNotFound, problem.UserNotFound, err.Error())
+		return
+	}
+	logger(c).WithFields(log.Fields{"error": err.Error(), "uid": uid}).Error("Couldn't look up user in firebase")
+	abortWithProblem(c, http.StatusInternalServerError, problem.Internal, "")
+}
+
+// Responds with the state of the circuit breaker of each upstream
+func BreakerStates(upstreams upstream.Set) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.JSON(http.StatusOK, upstreams.BreakerStates())
+	}
+}
+
+// Responds that the gateway is alive
+func Liveness() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.JSON(http.StatusOK, gin.H{"status": health.Up})
+	}
+}
+
+// Responds with the status of every dependency of the gateway, with 503
+// if any of them is down
+func Readiness(checker *health.Checker) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		report := checker.Report(c.Request.Context())
+		status := http.StatusOK
+		if report.Status != health.Up {
+			status = http.StatusServiceUnavailable
+		}
+		c.JSON(status, report)
 	}
 }
 
@@ -145,7 +742,7 @@ func AddUIDToRequestURL() gin.HandlerFunc {
 	return func(c *gin.Context) {
 		UID, ok := getUID(c)
 		if !ok {
-			c.AbortWithStatus(http.StatusInternalServerError)
+			abortWithProblem(c, http.StatusInternalServerError, problem.Internal, "")
 			return
 		}
 		// Set the endpoint to request in the users service
@@ -167,94 +764,261 @@ func getUID(c *gin.Context) (string, bool) {
 	return UID, true
 }
 
-// Returns the handler charged with creating an user. It takes the URL
-// of the users service and an auth Service as argument.
-// TODO: Delete user
+// Account describes the accounts created by a provisioning route
+type Account struct {
+	// Path of the users service the account is sent to
+	Path string
+	// Role set on the account in firebase, none when empty
+	Role string
+	// Whether federated sign ins, whose account is already in firebase,
+	// are accepted
+	Federated bool
+}
+
+// Accounts of the users signing up, they may sign in with a federated
+// identity
+var userAccount = Account{Path: "/users", Federated: true}
+
+// Accounts of the admins, created by other admins
+var adminAccount = Account{Path: "/admins", Role: auth.RoleAdmin}
+
+// Returns the handler charged with creating an user, in firebase and
+// then in the users service. Users may sign up with a federated
+// identity.
 func CreateUser(s auth.Service) gin.HandlerFunc {
+	return Provision(s, userAccount)
+}
+
+// Returns the handler charged with creating an admin, in firebase with
+// the admin role and then in the users service
+func CreateAdmin(s auth.Service) gin.HandlerFunc {
+	return Provision(s, adminAccount)
+}
+
+// Validates the sign up data, creates the account in firebase and
+// sends it to the users service. The firebase account is deleted if the
+// users service doesn't create it.
+func Provision(s auth.Service, account Account) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		var signUpData auth.SignUpModel
-		// FIX: Doesn't check that all fields are present
-		err := c.ShouldBindJSON(&signUpData)
-		if err != nil {
-			log.WithFields(log.Fields{"error": err.Error()}).Info("couldn't bind to json sign up form")
-			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		if err := c.ShouldBindJSON(&signUpData); err != nil {
+			logger(c).WithFields(log.Fields{"error": err.Error()}).Info("couldn't bind to json sign up form")
+			abortWithProblem(c, http.StatusBadRequest, problem.InvalidBody, err.Error())
+			return
+		}
+		if signUpData.Federated && !account.Federated {
+			abortWithFieldErrors(c, []problem.FieldError{{Field: "is_federated", Reason: "not accepted for " + account.Path}})
+			return
+		}
+		if errs := signUpData.Validate(); len(errs) > 0 {
+			logger(c).WithFields(log.Fields{"errors": errs}).Info("Invalid sign up data")
+			abortWithFieldErrors(c, errs)
 			return
 		}
 
 		var userData auth.UserModel
+		var err error
 		if signUpData.Federated {
 			userData, err = s.GetUser(signUpData.UID)
+			if auth.IsUserNotFound(err) {
+				logger(c).WithFields(log.Fields{"uid": signUpData.UID}).Info("Federated sign up of a user not in firebase")
+				abortWithFieldErrors(c, []problem.FieldError{{Field: "uid", Reason: "no federated account with this UID"}})
+				return
+			}
+			if err != nil {
+				abortWithUserError(c, signUpData.UID, err)
+				return
+			}
 		} else {
 			userData, err = s.CreateUser(signUpData)
 		}
-
-		log.WithFields(log.Fields{"user": userData}).Info("Creating user in firebase")
+		logger(c).WithFields(log.Fields{"user": userData, "path": account.Path}).Info("Creating account in firebase")
 		if err != nil {
-			log.WithFields(log.Fields{"user": userData}).Info("Failed to create user in firebase")
-			c.AbortWithStatusJSON(http.StatusConflict, gin.H{"error": err.Error()})
+			logger(c).WithFields(log.Fields{"user": userData, "error": err.Error()}).Info("Failed to create account in firebase")
+			abortWithProblem(c, http.StatusConflict, problem.UserConflict, err.Error())
 			return
 		}
+		// Federated accounts were created by the client when signing in,
+		// they are kept
+		created := !signUpData.Federated
+
+		if account.Role != "" {
+			if err := s.SetRoles(userData.UID, []string{account.Role}); err != nil {
+				logger(c).WithFields(log.Fields{"error": err.Error(), "uid": userData.UID}).Error("Couldn't set role in firebase")
+				rollBackSignUp(c, s, userData.UID, created)
+				abortWithProblem(c, http.StatusInternalServerError, problem.Internal, "")
+				return
+			}
+		}
+
 		// Should never fail unless the userData
 		// representation becomes an unsupported type
 		userDataJSON, err := json.Marshal(userData)
 		if err != nil {
-			// Delete user from firebase
-			log.WithFields(log.Fields{"data": userData, "error": err.Error()}).Error("couldn't marshall data to json ")
-			c.AbortWithStatus(http.StatusInternalServerError)
+			logger(c).WithFields(log.Fields{"data": userData, "error": err.Error()}).Error("couldn't marshall data to json ")
+			rollBackSignUp(c, s, userData.UID, created)
+			abortWithProblem(c, http.StatusInternalServerError, problem.Internal, "")
 			return
 		}
-		log.WithFields(log.Fields{"user": string(userDataJSON)}).Info("initialized user in users service")
-		req, err := http.NewRequest(http.MethodPost, "/users", bytes.NewBuffer(userDataJSON))
+		logger(c).WithFields(log.Fields{"user": string(userDataJSON), "path": account.Path}).Info("initialized account in users service")
+		req, err := http.NewRequestWithContext(c.Request.Context(), http.MethodPost, account.Path, bytes.NewBuffer(userDataJSON))
 		if err != nil {
-			// delete user from firebase
-			log.WithFields(log.Fields{"error": err.Error(), "user": string(userDataJSON)}).Error("couldn't reach users service")
-			c.AbortWithStatus(http.StatusInternalServerError)
+			logger(c).WithFields(log.Fields{"error": err.Error(), "user": string(userDataJSON)}).Error("couldn't reach users service")
+			rollBackSignUp(c, s, userData.UID, created)
+			abortWithProblem(c, http.StatusInternalServerError, problem.Internal, "")
 			return
 		}
+		req.Header.Set(problem.RequestIDHeader, c.Request.Header.Get(problem.RequestIDHeader))
 		c.Request = req
 
-		// C.next()
-		// delete user from firebase
+		c.Next()
+		status := c.Writer.Status()
+		if status == http.StatusGatewayTimeout {
+			// The users service may still create the user, the account is
+			// kept so it isn't left without one
+			logger(c).WithFields(log.Fields{"uid": userData.UID}).Warn("Users service timed out, sign up not rolled back")
+			return
+		}
+		if !isSuccess(status) {
+			rollBackSignUp(c, s, userData.UID, created)
+		}
 	}
 }
 
-//TODO: Duplicate code with CreateUser
-func CreateAdmin(s auth.Service) gin.HandlerFunc {
+func abortWithFieldErrors(c *gin.Context, errs []problem.FieldError) {
+	p := problem.New(http.StatusBadRequest, problem.InvalidBody, "the sign up data isn't valid")
+	p.Errors = errs
+	problem.Write(c.Writer, c.Request, p)
+	c.Abort()
+}
+
+// Deletes the firebase account of a sign up the users service didn't
+// complete, so the user can sign up again
+func rollBackSignUp(c *gin.Context, s auth.Service, uid string, created bool) {
+	if !created {
+		return
+	}
+	fields := log.Fields{"uid": uid, "status": c.Writer.Status()}
+	if err := s.DeleteUser(uid); err != nil {
+		fields["error"] = err.Error()
+		logger(c).WithFields(fields).Error("Couldn't roll back sign up, user left in firebase")
+		return
+	}
+	logger(c).WithFields(fields).Info("Sign up rolled back, user deleted from firebase")
+}
+
+func isSuccess(status int) bool {
+	return status >= 200 && status < 300
+}
+
+// Deletes the user in the user_id parameter from the users service and
+// then from firebase. Users already deleted from the users service are
+// deleted from firebase too, so a failed deletion can be retried, and
+// the retry responds 204. The response of the users service is held
+// until then, if firebase fails the client gets a 502 telling the
+// deletion was partial.
+func DeleteUser(s auth.Service) gin.HandlerFunc {
 	return func(c *gin.Context) {
-		var signUpData auth.SignUpModel
-		// FIX: Doesn't check that all fields are present
-		err := c.ShouldBindJSON(&signUpData)
-		if err != nil {
-			log.WithFields(log.Fields{"error": err.Error()}).Info("couldn't bind to json sign up form")
-			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
-			return
-		}
+		writer := c.Writer
+		buffered := newBufferedWriter(writer)
+		c.Writer = buffered
+		c.Next()
+		c.Writer = writer
 
-		userData, err := s.CreateUser(signUpData)
-		log.WithFields(log.Fields{"admin": userData}).Info("Creating admin in firebase")
-		if err != nil {
-			log.WithFields(log.Fields{"user": userData}).Info("Failed to create admin in firebase")
-			c.AbortWithStatusJSON(http.StatusConflict, gin.H{"error": err.Error()})
+		status := buffered.Status()
+		if !isSuccess(status) && status != http.StatusNotFound {
+			buffered.flush()
 			return
 		}
-
-		// Should never fail unless the userData
-		// representation becomes an unsupported type
-		userDataJSON, err := json.Marshal(userData)
-		if err != nil {
-			log.WithFields(log.Fields{"data": userData, "error": err.Error()}).Error("couldn't marshall data to json ")
-			c.AbortWithStatus(http.StatusInternalServerError)
+		uid := c.Param("user_id")
+		if err := s.DeleteUser(uid); err != nil {
+			logger(c).WithFields(log.Fields{"error": err.Error(), "uid": uid}).Error("Couldn't delete user from firebase, retry the deletion")
+			abortWithProblem(c, http.StatusBadGateway, problem.PartialDeletion, "the user was deleted from the users service but not from firebase, retry the deletion")
 			return
 		}
-		log.WithFields(log.Fields{"admin": string(userDataJSON)}).Info("initialized admin in users service")
-		req, err := http.NewRequest(http.MethodPost, "/admins", bytes.NewBuffer(userDataJSON))
-		if err != nil {
-			log.WithFields(log.Fields{"error": err.Error(), "user": string(userDataJSON)}).Error("couldn't reach users service")
-			c.AbortWithStatus(http.StatusInternalServerError)
+		logger(c).WithFields(log.Fields{"uid": uid}).Info("User deleted")
+		if status == http.StatusNotFound {
+			// Retry of a partial deletion, which is now complete
+			c.Status(http.StatusNoContent)
 			return
 		}
-		c.Request = req
+		buffered.flush()
+	}
+}
+
+// Holds the response written by the rest of the chain, so the handler
+// can still replace it, until flush is called. The connection can't be
+// hijacked nor used for pushes, which would skip the buffer.
+type bufferedWriter struct {
+	gin.ResponseWriter
+	header  http.Header
+	status  int
+	written bool
+	body    bytes.Buffer
+}
+
+func newBufferedWriter(w gin.ResponseWriter) *bufferedWriter {
+	return &bufferedWriter{ResponseWriter: w, header: make(http.Header), status: http.StatusOK}
+}
+
+func (w *bufferedWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *bufferedWriter) WriteHeader(status int) {
+	if !w.written {
+		w.status = status
+	}
+}
+
+func (w *bufferedWriter) WriteHeaderNow() {
+	w.written = true
+}
+
+func (w *bufferedWriter) Write(data []byte) (int, error) {
+	w.written = true
+	return w.body.Write(data)
+}
+
+func (w *bufferedWriter) WriteString(data string) (int, error) {
+	w.written = true
+	return w.body.WriteString(data)
+}
+
+func (w *bufferedWriter) Status() int {
+	return w.status
+}
+
+func (w *bufferedWriter) Size() int {
+	if !w.written {
+		return -1
 	}
+	return w.body.Len()
+}
+
+func (w *bufferedWriter) Written() bool {
+	return w.written
+}
+
+// Nothing is sent before flush
+func (w *bufferedWriter) Flush() {}
+
+func (w *bufferedWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return nil, nil, errors.New("the response is buffered, the connection can't be hijacked")
+}
+
+func (w *bufferedWriter) Pusher() http.Pusher {
+	return nil
+}
+
+// Sends the held response
+func (w *bufferedWriter) flush() {
+	for name, values := range w.header {
+		w.ResponseWriter.Header()[name] = values
+	}
+	w.ResponseWriter.WriteHeader(w.status)
+	w.ResponseWriter.WriteHeaderNow()
+	w.ResponseWriter.Write(w.body.Bytes())
 }
 
 func Cors() gin.HandlerFunc {
@@ -288,26 +1052,139 @@ func RemovePathFromRequestURL(path string) gin.HandlerFunc {
 	}
 }
 
-func Logger() gin.HandlerFunc {
-	return func(ctx *gin.Context) {
-		// Request method
-		requestMethod := ctx.Request.Method
+// Logs each request once it was handled, with its status, duration,
+// size, the upstream it was sent to and the user that sent it. Requests
+// are sampled at settings.SampleRate except server errors, which are
+// always logged. The values of the redacted fields, and of the query
+// parameters with their names, are hidden.
+func Logger(settings config.AccessLog) gin.HandlerFunc {
+	redact := make(map[string]bool, len(settings.Redact))
+	for _, field := range settings.Redact {
+		redact[field] = true
+	}
 
-		// Request route
-		requestURI := ctx.Request.RequestURI
+	return func(ctx *gin.Context) {
+		start := time.Now()
+		// Middlewares may replace the request, keep the one received
+		request := ctx.Request
+		ctx.Next()
 
-		// status code
 		statusCode := ctx.Writer.Status()
+		if statusCode < http.StatusInternalServerError && mathrand.Float64() >= settings.SampleRate {
+			return
+		}
 
-		// Request IP
-		clientIP := ctx.ClientIP()
+		fields := log.Fields{
+			"method":      request.Method,
+			"route":       ctx.FullPath(),
+			"uri":         redactQuery(request.RequestURI, redact),
+			"status":      statusCode,
+			"duration_ms": float64(time.Since(start).Microseconds()) / 1000,
+			"bytes_in":    maxInt64(request.ContentLength, 0),
+			"bytes_out":   maxInt64(int64(ctx.Writer.Size()), 0),
+			"client_ip":   ctx.ClientIP(),
+			"request_id":  ctx.GetString(requestIDKey),
+		}
+		if name := ctx.GetString(upstreamKey); name != "" {
+			fields["upstream"] = name
+			fields["instance"] = ctx.GetString(instanceKey)
+		}
+		if UID, ok := getUID(ctx); ok {
+			fields["uid"] = UID
+		}
+		for field := range fields {
+			if redact[field] {
+				fields[field] = redacted
+			}
+		}
+		log.WithFields(fields).Info("HTTP Request")
+	}
+}
+
+// Traces the request with t, continuing the trace of the client if it
+// sent a traceparent header. The tracer is kept in the request context
+// for the spans started by the middlewares and the upstreams.
+func Trace(t tracing.Tracer) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		route := c.FullPath()
+		if route == "" {
+			route = "unmatched"
+		}
+		ctx, span := t.Start(tracing.WithTracer(c.Request.Context(), t), c.Request.Method+" "+route, c.Request)
+		defer span.End()
+		span.SetAttribute(tracing.KindAttribute, "server")
+		span.SetAttribute("http.method", c.Request.Method)
+		span.SetAttribute("http.route", route)
+		span.SetAttribute("request_id", c.GetString(requestIDKey))
+		c.Request = c.Request.WithContext(ctx)
+
+		c.Next()
 
-		log.WithFields(log.Fields{
-			"method":    requestMethod,
-			"uri":       requestURI,
-			"status":    statusCode,
-			"client_ip": clientIP,
-		}).Info("HTTP Request")
+		status := c.Writer.Status()
+		span.SetAttribute("http.status_code", status)
+		if UID, ok := getUID(c); ok {
+			span.SetAttribute("user.uid", UID)
+		}
+		if status >= http.StatusInternalServerError {
+			span.SetError(errors.New(http.StatusText(status)))
+		}
+	}
+}
+
+// Records the count, duration and status of the requests by route,
+// method and upstream, and the requests in flight
+func Metrics() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		route := c.FullPath()
+		if route == "" {
+			route = "unmatched"
+		}
+		method := c.Request.Method
+		start := time.Now()
+		metrics.InFlight.Add(1, route, method)
+		defer metrics.InFlight.Add(-1, route, method)
+
+		c.Next()
+
+		status := metrics.StatusClass(c.Writer.Status())
+		upstream := c.GetString(upstreamKey)
+		metrics.Requests.Inc(route, method, status, upstream)
+		metrics.RequestDuration.Observe(time.Since(start).Seconds(), route, method, status, upstream)
+	}
+}
+
+// Serves the metrics of the gateway to the requests bearing token
+func MetricsHandler(token string) gin.HandlerFunc {
+	handler := metrics.Default.Handler()
+	return func(c *gin.Context) {
+		bearer := strings.TrimPrefix(c.Request.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(bearer), []byte(token)) != 1 {
+			abortWithProblem(c, http.StatusUnauthorized, problem.Unauthorized, "invalid metrics token")
+			return
+		}
+		handler.ServeHTTP(c.Writer, c.Request)
+	}
+}
+
+// Hides the values of the query parameters in redact
+func redactQuery(uri string, redact map[string]bool) string {
+	u, err := url.ParseRequestURI(uri)
+	if err != nil || u.RawQuery == "" {
+		return uri
+	}
+	query := u.Query()
+	for name := range query {
+		if redact[name] {
+			query.Set(name, redacted)
+		}
+	}
+	u.RawQuery = query.Encode()
+	return u.RequestURI()
+}
 
+func maxInt64(a, b int64) int64 {
+	if a > b {
+		return a
 	}
+	return b
 }
@@ -1,17 +1,34 @@
 package middleware
 
 import (
+	"bufio"
 	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"io"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
 	"os"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"fiufit.api.gateway/internal/auth"
+	"fiufit.api.gateway/internal/config"
+	"fiufit.api.gateway/internal/metrics"
+	"fiufit.api.gateway/internal/problem"
+	"fiufit.api.gateway/internal/ratelimit"
+	"fiufit.api.gateway/internal/tracing"
+	"fiufit.api.gateway/internal/upstream"
 	"github.com/gin-gonic/gin"
 	log "github.com/sirupsen/logrus"
 )
@@ -38,7 +55,7 @@ func TestAuthorize(t *testing.T) {
 		req.Header.Set("Authorization", "abc")
 		c.Request = req
 
-		AuthorizeUser(s)(c)
+		AuthorizeUser(s, nil)(c)
 
 		anyUID, found := c.Get("User-UID")
 		if !found {
@@ -59,14 +76,14 @@ func TestAuthorize(t *testing.T) {
 		req, _ := http.NewRequest(http.MethodGet, "/test", nil)
 		req.Header.Set("Authorization", "xyz")
 		c.Request = req
-		AuthorizeUser(s)(c)
+		AuthorizeUser(s, nil)(c)
 
 		_, found := c.Get("User-UID")
 		if found {
 			t.Errorf("Key %s should't exist found", "User-UID")
 		}
 
-		assert_eq(t, c.Writer.Status(), http.StatusUnauthorized)
+		assertProblem(t, w, http.StatusUnauthorized, problem.Unauthorized)
 		assert_eq(t, c.IsAborted(), true)
 	})
 }
@@ -150,177 +167,1875 @@ func TestReverseProxy(t *testing.T) {
 		}))
 		defer server.Close()
 
-		url, _ := url.Parse(server.URL)
+		u := testUpstream(server.URL)
 		w := CreateTestResponseRecorder()
 		_, r := gin.CreateTestContext(w)
-		r.GET("/test", ReverseProxy(url))
+		r.GET("/test", ReverseProxy(u))
 		req, _ := http.NewRequest(http.MethodGet, "/test", nil)
 
 		r.ServeHTTP(w, req)
 
 		assert_eq(t, w.Body.String(), "reverse-proxy")
 	})
+
+	t.Run("Failures are logged with the IP of the client, not of the load balancer", func(t *testing.T) {
+		buf := bytes.Buffer{}
+		log.SetOutput(&buf)
+		defer log.SetOutput(io.Discard)
+		log.SetFormatter(&log.JSONFormatter{})
+		server := httptest.NewServer(http.NotFoundHandler())
+		server.Close()
+
+		_, r := gin.CreateTestContext(CreateTestResponseRecorder())
+		r.GET("/test", ReverseProxy(testUpstream(server.URL)))
+		req, _ := http.NewRequest(http.MethodGet, "/test", nil)
+		req.RemoteAddr = "10.0.0.1:4321"
+		req.Header.Set("X-Forwarded-For", "203.0.113.7")
+		r.ServeHTTP(CreateTestResponseRecorder(), req)
+
+		var entry struct {
+			Msg      string `json:"msg"`
+			ClientIP string `json:"client_ip"`
+		}
+		for decoder := json.NewDecoder(&buf); decoder.More() && entry.Msg != "Reverse proxy failed"; {
+			decoder.Decode(&entry)
+		}
+		assert_eq(t, entry.Msg, "Reverse proxy failed")
+		assert_eq(t, entry.ClientIP, "203.0.113.7")
+	})
+}
+
+func TestReverseProxyBalancing(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	newInstance := func(name string, status int) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(status)
+			w.Write([]byte(name))
+		}))
+	}
+	send := func(r *gin.Engine) string {
+		w := CreateTestResponseRecorder()
+		req, _ := http.NewRequest(http.MethodGet, "/test", nil)
+		r.ServeHTTP(w, req)
+		return w.Body.String()
+	}
+
+	t.Run("Round robin spreads the requests among all the instances", func(t *testing.T) {
+		a, b := newInstance("a", http.StatusOK), newInstance("b", http.StatusOK)
+		defer a.Close()
+		defer b.Close()
+		aURL, _ := url.Parse(a.URL)
+		bURL, _ := url.Parse(b.URL)
+		u := upstream.New("test", []*url.URL{aURL, bURL}, upstream.Options{Balancer: upstream.RoundRobin})
+
+		_, r := gin.CreateTestContext(CreateTestResponseRecorder())
+		r.GET("/test", ReverseProxy(u))
+
+		assert_eq(t, send(r)+send(r)+send(r)+send(r), "abab")
+	})
+
+	t.Run("An instance failing consecutively is ejected and the requests go to the healthy one", func(t *testing.T) {
+		a, b := newInstance("a", http.StatusInternalServerError), newInstance("b", http.StatusOK)
+		defer a.Close()
+		defer b.Close()
+		aURL, _ := url.Parse(a.URL)
+		bURL, _ := url.Parse(b.URL)
+		u := upstream.New("test", []*url.URL{aURL, bURL}, upstream.Options{
+			Balancer: upstream.RoundRobin, MaxFailures: 2, EjectionTime: time.Minute,
+		})
+
+		_, r := gin.CreateTestContext(CreateTestResponseRecorder())
+		r.GET("/test", ReverseProxy(u))
+
+		assert_eq(t, send(r)+send(r)+send(r)+send(r), "abab")
+		assert_eq(t, send(r)+send(r)+send(r), "bbb")
+	})
+
+	t.Run("Consistent hashing sends the requests of a user to the same instance", func(t *testing.T) {
+		a, b := newInstance("a", http.StatusOK), newInstance("b", http.StatusOK)
+		defer a.Close()
+		defer b.Close()
+		aURL, _ := url.Parse(a.URL)
+		bURL, _ := url.Parse(b.URL)
+		u := upstream.New("test", []*url.URL{aURL, bURL}, upstream.Options{Balancer: upstream.ConsistentHash})
+
+		_, r := gin.CreateTestContext(CreateTestResponseRecorder())
+		r.GET("/test", func(c *gin.Context) { c.Set(uidKey, c.Query("uid")) }, ReverseProxy(u))
+
+		for _, uid := range []string{"1", "2", "3", "4"} {
+			w := CreateTestResponseRecorder()
+			req, _ := http.NewRequest(http.MethodGet, "/test?uid="+uid, nil)
+			r.ServeHTTP(w, req)
+			first := w.Body.String()
+			for i := 0; i < 5; i++ {
+				w := CreateTestResponseRecorder()
+				req, _ := http.NewRequest(http.MethodGet, "/test?uid="+uid, nil)
+				r.ServeHTTP(w, req)
+				assert_eq(t, w.Body.String(), first)
+			}
+		}
+	})
+
+	t.Run("An instance failing its health probe isn't picked", func(t *testing.T) {
+		a, b := newInstance("a", http.StatusServiceUnavailable), newInstance("b", http.StatusOK)
+		defer a.Close()
+		defer b.Close()
+		aURL, _ := url.Parse(a.URL)
+		bURL, _ := url.Parse(b.URL)
+		u := upstream.New("test", []*url.URL{aURL, bURL}, upstream.Options{
+			HealthPath: "/health", HealthInterval: time.Hour,
+		})
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		go u.Start(ctx)
+		for i := 0; i < 100 && u.Instances()[0].Available(time.Now()); i++ {
+			time.Sleep(10 * time.Millisecond)
+		}
+
+		_, r := gin.CreateTestContext(CreateTestResponseRecorder())
+		r.GET("/test", ReverseProxy(u))
+
+		assert_eq(t, send(r)+send(r)+send(r), "bbb")
+	})
+}
+
+func TestTimeout(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	t.Run("A route timeout shorter than the upstream response returns Gateway Timeout with a problem body", func(t *testing.T) {
+		release := make(chan struct{})
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			<-release
+		}))
+		defer server.Close()
+		defer close(release)
+
+		w := CreateTestResponseRecorder()
+		_, r := gin.CreateTestContext(w)
+		r.GET("/test", Timeout(config.Timeouts{Total: 20 * time.Millisecond}), ReverseProxy(testUpstream(server.URL)))
+		req, _ := http.NewRequest(http.MethodGet, "/test", nil)
+		r.ServeHTTP(w, req)
+
+		assertProblem(t, w, http.StatusGatewayTimeout, problem.UpstreamTimeout)
+	})
+
+	t.Run("The upstream timeout applies when the route doesn't set one", func(t *testing.T) {
+		release := make(chan struct{})
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			<-release
+		}))
+		defer server.Close()
+		defer close(release)
+
+		serverURL, _ := url.Parse(server.URL)
+		u := upstream.New("test", []*url.URL{serverURL}, upstream.Options{Timeout: 20 * time.Millisecond})
+		w := CreateTestResponseRecorder()
+		_, r := gin.CreateTestContext(w)
+		r.GET("/test", ReverseProxy(u))
+		req, _ := http.NewRequest(http.MethodGet, "/test", nil)
+		r.ServeHTTP(w, req)
+
+		assert_eq(t, w.Code, http.StatusGatewayTimeout)
+	})
+
+	t.Run("The remaining time is sent to the upstream replacing the one sent by the client", func(t *testing.T) {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			remaining, _ := strconv.Atoi(r.Header.Get(deadlineHeader))
+			assert_eq(t, remaining > 0 && remaining <= 1000, true)
+		}))
+		defer server.Close()
+
+		w := CreateTestResponseRecorder()
+		_, r := gin.CreateTestContext(w)
+		r.GET("/test", Timeout(config.Timeouts{Total: time.Second}), ReverseProxy(testUpstream(server.URL)))
+		req, _ := http.NewRequest(http.MethodGet, "/test", nil)
+		req.Header.Set(deadlineHeader, "100000")
+		r.ServeHTTP(w, req)
+
+		assert_eq(t, w.Code, http.StatusOK)
+	})
+
+	t.Run("A route response header timeout gives up on a slow instance and retries on the next one", func(t *testing.T) {
+		release := make(chan struct{})
+		slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			<-release
+		}))
+		defer slow.Close()
+		defer close(release)
+		fast := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte("fast"))
+		}))
+		defer fast.Close()
+		slowURL, _ := url.Parse(slow.URL)
+		fastURL, _ := url.Parse(fast.URL)
+		u := upstream.New("test", []*url.URL{slowURL, fastURL}, upstream.Options{
+			Balancer: upstream.RoundRobin, RetryBudget: 1, MaxFailures: 1, EjectionTime: time.Minute,
+		})
+		policy := config.Retry{Attempts: 2, Statuses: []int{http.StatusServiceUnavailable}}
+
+		w := CreateTestResponseRecorder()
+		_, r := gin.CreateTestContext(w)
+		r.GET("/test", Timeout(config.Timeouts{Total: 5 * time.Second, ResponseHeader: 20 * time.Millisecond}), Retry(policy), ReverseProxy(u))
+		req, _ := http.NewRequest(http.MethodGet, "/test", nil)
+		r.ServeHTTP(w, req)
+
+		assert_eq(t, w.Code, http.StatusOK)
+		assert_eq(t, w.Body.String(), "fast")
+		assert_eq(t, u.Instances()[0].Available(time.Now()), false)
+	})
+
+	t.Run("A route response header timeout without retries returns Gateway Timeout", func(t *testing.T) {
+		release := make(chan struct{})
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			<-release
+		}))
+		defer server.Close()
+		defer close(release)
+
+		w := CreateTestResponseRecorder()
+		_, r := gin.CreateTestContext(w)
+		r.GET("/test", Timeout(config.Timeouts{Total: 5 * time.Second, ResponseHeader: 20 * time.Millisecond}), ReverseProxy(testUpstream(server.URL)))
+		req, _ := http.NewRequest(http.MethodGet, "/test", nil)
+		r.ServeHTTP(w, req)
+
+		assertProblem(t, w, http.StatusGatewayTimeout, problem.UpstreamTimeout)
+	})
+
+	t.Run("The response header timeout doesn't bound reading the body", func(t *testing.T) {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte("headers "))
+			w.(http.Flusher).Flush()
+			time.Sleep(60 * time.Millisecond)
+			w.Write([]byte("and body"))
+		}))
+		defer server.Close()
+
+		w := CreateTestResponseRecorder()
+		_, r := gin.CreateTestContext(w)
+		r.GET("/test", Timeout(config.Timeouts{Total: 5 * time.Second, ResponseHeader: 20 * time.Millisecond}), ReverseProxy(testUpstream(server.URL)))
+		req, _ := http.NewRequest(http.MethodGet, "/test", nil)
+		r.ServeHTTP(w, req)
+
+		assert_eq(t, w.Code, http.StatusOK)
+		assert_eq(t, w.Body.String(), "headers and body")
+	})
+}
+
+func TestRetry(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	policy := config.Retry{Attempts: 3, Statuses: []int{http.StatusServiceUnavailable}, Backoff: time.Millisecond, MaxBackoff: time.Millisecond}
+	// Fails the first request and echoes the body of the next ones
+	newFlakyServer := func(attempts *int) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			*attempts += 1
+			if *attempts == 1 {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+			body, _ := io.ReadAll(r.Body)
+			w.Write(body)
+		}))
+	}
+
+	t.Run("An idempotent request is retried after a retryable status", func(t *testing.T) {
+		attempts := 0
+		server := newFlakyServer(&attempts)
+		defer server.Close()
+
+		w := CreateTestResponseRecorder()
+		_, r := gin.CreateTestContext(w)
+		r.GET("/test", Retry(policy), ReverseProxy(testUpstream(server.URL)))
+		req, _ := http.NewRequest(http.MethodGet, "/test", nil)
+		r.ServeHTTP(w, req)
+
+		assert_eq(t, w.Code, http.StatusOK)
+		assert_eq(t, attempts, 2)
+	})
+
+	t.Run("A POST request without Idempotency-Key isn't retried", func(t *testing.T) {
+		attempts := 0
+		server := newFlakyServer(&attempts)
+		defer server.Close()
+
+		w := CreateTestResponseRecorder()
+		_, r := gin.CreateTestContext(w)
+		r.POST("/test", Retry(policy), ReverseProxy(testUpstream(server.URL)))
+		req, _ := http.NewRequest(http.MethodPost, "/test", bytes.NewBufferString("data"))
+		r.ServeHTTP(w, req)
+
+		assert_eq(t, w.Code, http.StatusServiceUnavailable)
+		assert_eq(t, attempts, 1)
+	})
+
+	t.Run("A POST request with Idempotency-Key is retried replaying its body", func(t *testing.T) {
+		attempts := 0
+		server := newFlakyServer(&attempts)
+		defer server.Close()
+
+		w := CreateTestResponseRecorder()
+		_, r := gin.CreateTestContext(w)
+		r.POST("/test", Retry(policy), ReverseProxy(testUpstream(server.URL)))
+		req, _ := http.NewRequest(http.MethodPost, "/test", bytes.NewBufferString("data"))
+		req.Header.Set("Idempotency-Key", "abc")
+		r.ServeHTTP(w, req)
+
+		assert_eq(t, w.Code, http.StatusOK)
+		assert_eq(t, w.Body.String(), "data")
+		assert_eq(t, attempts, 2)
+	})
+
+	t.Run("Retries stop when the retry budget of the upstream is exhausted", func(t *testing.T) {
+		attempts := 0
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			attempts += 1
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}))
+		defer server.Close()
+
+		serverURL, _ := url.Parse(server.URL)
+		u := upstream.New("test", []*url.URL{serverURL}, upstream.Options{Retry: policy, RetryBudget: 0})
+		w := CreateTestResponseRecorder()
+		_, r := gin.CreateTestContext(w)
+		r.GET("/test", ReverseProxy(u))
+		for i := 0; i < 10; i++ {
+			req, _ := http.NewRequest(http.MethodGet, "/test", nil)
+			r.ServeHTTP(CreateTestResponseRecorder(), req)
+		}
+
+		// The initial budget allows 10 retries
+		assert_eq(t, attempts, 20)
+	})
+
+	t.Run("Each attempt is reported against the instance it was sent to", func(t *testing.T) {
+		failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}))
+		defer failing.Close()
+		unreachable := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+		unreachable.Close()
+		failingURL, _ := url.Parse(failing.URL)
+		unreachableURL, _ := url.Parse(unreachable.URL)
+		retryOnce := policy
+		retryOnce.Attempts = 2
+		u := upstream.New("test", []*url.URL{failingURL, unreachableURL}, upstream.Options{
+			Balancer: upstream.RoundRobin, Retry: retryOnce, RetryBudget: 1, MaxFailures: 1, EjectionTime: time.Minute,
+		})
+
+		w := CreateTestResponseRecorder()
+		_, r := gin.CreateTestContext(w)
+		r.GET("/test", ReverseProxy(u))
+		req, _ := http.NewRequest(http.MethodGet, "/test", nil)
+		r.ServeHTTP(w, req)
+
+		assert_eq(t, w.Code, http.StatusBadGateway)
+		assert_eq(t, u.Instances()[0].Available(time.Now()), false)
+		assert_eq(t, u.Instances()[1].Available(time.Now()), false)
+	})
+
+	t.Run("Only the instance handling the current attempt counts it as outstanding", func(t *testing.T) {
+		failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}))
+		defer failing.Close()
+		arrived, release := make(chan struct{}), make(chan struct{})
+		slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			close(arrived)
+			<-release
+		}))
+		defer slow.Close()
+		failingURL, _ := url.Parse(failing.URL)
+		slowURL, _ := url.Parse(slow.URL)
+		u := upstream.New("test", []*url.URL{failingURL, slowURL}, upstream.Options{
+			Balancer: upstream.RoundRobin, Retry: policy, RetryBudget: 1,
+		})
+
+		_, r := gin.CreateTestContext(CreateTestResponseRecorder())
+		r.GET("/test", ReverseProxy(u))
+		served := make(chan struct{})
+		go func() {
+			req, _ := http.NewRequest(http.MethodGet, "/test", nil)
+			r.ServeHTTP(CreateTestResponseRecorder(), req)
+			close(served)
+		}()
+
+		<-arrived
+		assert_eq(t, u.Instances()[0].Outstanding(), 0)
+		assert_eq(t, u.Instances()[1].Outstanding(), 1)
+		close(release)
+		<-served
+		assert_eq(t, u.Instances()[1].Outstanding(), 0)
+	})
+
+	t.Run("A retry cancelled during its backoff gives back its half-open probe", func(t *testing.T) {
+		statuses := []int{http.StatusInternalServerError, http.StatusInternalServerError, http.StatusTooManyRequests}
+		ctx, cancel := context.WithCancel(context.Background())
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if len(statuses) == 0 {
+				return
+			}
+			if statuses[0] == http.StatusTooManyRequests {
+				// The client gives up while the retry waits its backoff
+				time.AfterFunc(20*time.Millisecond, cancel)
+			}
+			w.WriteHeader(statuses[0])
+			statuses = statuses[1:]
+		}))
+		defer server.Close()
+
+		serverURL, _ := url.Parse(server.URL)
+		u := upstream.New("test", []*url.URL{serverURL}, upstream.Options{
+			Retry:       config.Retry{Attempts: 2, Statuses: []int{http.StatusTooManyRequests}, Backoff: time.Hour, MaxBackoff: time.Hour},
+			RetryBudget: 1,
+			Breaker:     config.Breaker{FailureRate: 0.5, MinRequests: 2, Window: time.Minute, OpenTime: 50 * time.Millisecond, HalfOpenRequests: 2},
+		})
+		_, r := gin.CreateTestContext(CreateTestResponseRecorder())
+		r.GET("/test", ReverseProxy(u))
+		for i := 0; i < 2; i++ {
+			req, _ := http.NewRequest(http.MethodGet, "/test", nil)
+			r.ServeHTTP(CreateTestResponseRecorder(), req)
+		}
+		time.Sleep(60 * time.Millisecond)
+
+		req, _ := http.NewRequestWithContext(ctx, http.MethodGet, "/test", nil)
+		r.ServeHTTP(CreateTestResponseRecorder(), req)
+		w := CreateTestResponseRecorder()
+		req, _ = http.NewRequest(http.MethodGet, "/test", nil)
+		r.ServeHTTP(w, req)
+
+		assert_eq(t, w.Code, http.StatusOK)
+		assert_eq(t, upstream.Set{0: u}.BreakerStates()[0].State, upstream.Closed)
+	})
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	t.Run("The breaker opens after failures, rejects requests fast and closes once a probe succeeds", func(t *testing.T) {
+		requests := 0
+		status := http.StatusInternalServerError
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			requests += 1
+			w.WriteHeader(status)
+		}))
+		defer server.Close()
+
+		serverURL, _ := url.Parse(server.URL)
+		u := upstream.New("test", []*url.URL{serverURL}, upstream.Options{Breaker: config.Breaker{
+			FailureRate: 0.5, MinRequests: 2, Window: time.Minute, OpenTime: 50 * time.Millisecond, HalfOpenRequests: 1,
+		}})
+		_, r := gin.CreateTestContext(CreateTestResponseRecorder())
+		r.GET("/test", ReverseProxy(u))
+		send := func() *TestResponseRecorder {
+			w := CreateTestResponseRecorder()
+			req, _ := http.NewRequest(http.MethodGet, "/test", nil)
+			r.ServeHTTP(w, req)
+			return w
+		}
+
+		send()
+		send()
+		w := send()
+		assertProblem(t, w, http.StatusServiceUnavailable, problem.UpstreamUnavailable)
+		assert_eq(t, w.Header().Get("Retry-After"), "1")
+		assert_eq(t, requests, 2)
+
+		time.Sleep(60 * time.Millisecond)
+		status = http.StatusOK
+		assert_eq(t, send().Code, http.StatusOK)
+		assert_eq(t, send().Code, http.StatusOK)
+		assert_eq(t, requests, 4)
+		assert_eq(t, upstream.Set{0: u}.BreakerStates()[0].State, upstream.Closed)
+	})
+}
+
+func TestTracing(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	t.Run("The request, the token verification, the admin lookup and the upstream hop are traced and propagated", func(t *testing.T) {
+		traceparents := make(chan string, 2)
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			traceparents <- r.Header.Get("traceparent")
+		}))
+		defer server.Close()
+
+		exporter := tracing.NewMemoryExporter()
+		u := testUpstream(server.URL)
+		_, r := gin.CreateTestContext(CreateTestResponseRecorder())
+		r.GET("/test/:id", Trace(tracing.NewTracer("gateway", exporter)), AuthorizeUser(&AuthTestService{}, nil), AuthorizeAdmin(NewAdminLookup(u)), ReverseProxy(u))
+		req, _ := http.NewRequest(http.MethodGet, "/test/1", nil)
+		req.Header.Set("Authorization", "abc")
+		r.ServeHTTP(CreateTestResponseRecorder(), req)
+
+		spans := exporter.Spans()
+		if len(spans) != 4 {
+			t.Fatalf("Got %d spans, want 4", len(spans))
+		}
+		verify, lookup, hop, request := spans[0], spans[1], spans[2], spans[3]
+		assert_eq(t, verify.Name, "firebase.verify_token")
+		assert_eq(t, lookup.Name, "users.admin_lookup")
+		assert_eq(t, hop.Name, "upstream test")
+		assert_eq(t, request.Name, "GET /test/:id")
+		assert_eq(t, request.ParentID, "")
+		assert_eq(t, request.Attributes["http.status_code"].(int), http.StatusOK)
+		for _, span := range spans[:3] {
+			assert_eq(t, span.TraceID, request.TraceID)
+			assert_eq(t, span.ParentID, request.SpanID)
+		}
+		assert_eq(t, <-traceparents, "00-"+request.TraceID+"-"+lookup.SpanID+"-01")
+		assert_eq(t, <-traceparents, "00-"+request.TraceID+"-"+hop.SpanID+"-01")
+	})
+
+	t.Run("The trace sent by the client in traceparent is continued", func(t *testing.T) {
+		exporter := tracing.NewMemoryExporter()
+		_, r := gin.CreateTestContext(CreateTestResponseRecorder())
+		r.GET("/test", Trace(tracing.NewTracer("gateway", exporter)), AuthorizeUser(&AuthTestService{}, nil))
+		req, _ := http.NewRequest(http.MethodGet, "/test", nil)
+		req.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+		r.ServeHTTP(CreateTestResponseRecorder(), req)
+
+		spans := exporter.Spans()
+		if len(spans) != 2 {
+			t.Fatalf("Got %d spans, want 2", len(spans))
+		}
+		assert_eq(t, spans[1].TraceID, "4bf92f3577b34da6a3ce929d0e0e4736")
+		assert_eq(t, spans[1].ParentID, "00f067aa0ba902b7")
+		assert_eq(t, spans[0].Error, "unauthorized")
+	})
+
+	t.Run("Unsampled traces are propagated but not exported", func(t *testing.T) {
+		exporter := tracing.NewMemoryExporter()
+		_, r := gin.CreateTestContext(CreateTestResponseRecorder())
+		r.GET("/test", Trace(tracing.NewTracer("gateway", exporter)))
+		req, _ := http.NewRequest(http.MethodGet, "/test", nil)
+		req.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00")
+		r.ServeHTTP(CreateTestResponseRecorder(), req)
+
+		assert_eq(t, len(exporter.Spans()), 0)
+	})
+
+	t.Run("The OTLP exporter sends the spans to the collector when shut down", func(t *testing.T) {
+		received := make(chan map[string]interface{}, 1)
+		collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			assert_eq(t, r.URL.Path, "/v1/traces")
+			body := make(map[string]interface{})
+			json.NewDecoder(r.Body).Decode(&body)
+			received <- body
+		}))
+		defer collector.Close()
+
+		tracer := tracing.NewTracer("gateway", tracing.NewOTLPExporter(collector.URL, "gateway"))
+		_, span := tracer.Start(context.Background(), "operation", nil)
+		span.SetAttribute(tracing.KindAttribute, "server")
+		span.End()
+		tracer.Shutdown(context.Background())
+
+		body := <-received
+		resourceSpans := body["resourceSpans"].([]interface{})[0].(map[string]interface{})
+		scopeSpans := resourceSpans["scopeSpans"].([]interface{})[0].(map[string]interface{})
+		otlpSpan := scopeSpans["spans"].([]interface{})[0].(map[string]interface{})
+		assert_eq(t, otlpSpan["name"].(string), "operation")
+		assert_eq(t, otlpSpan["kind"].(float64), 2)
+		assert_eq(t, len(otlpSpan["traceId"].(string)), 32)
+	})
+}
+
+func TestTokenCache(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	authorize := func(r *gin.Engine, token string) int {
+		w := CreateTestResponseRecorder()
+		req, _ := http.NewRequest(http.MethodGet, "/test", nil)
+		req.Header.Set("Authorization", token)
+		r.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	t.Run("A verified token isn't verified again until the cache ttl elapses", func(t *testing.T) {
+		s := &AuthTestService{}
+		_, r := gin.CreateTestContext(CreateTestResponseRecorder())
+		r.GET("/test", AuthorizeUser(auth.NewTokenCache(s, 10, 50*time.Millisecond), nil))
+
+		for i := 0; i < 3; i++ {
+			assert_eq(t, authorize(r, "abc"), http.StatusOK)
+		}
+		assert_eq(t, s.VerifyTokenCalls, 1)
+		time.Sleep(60 * time.Millisecond)
+		assert_eq(t, authorize(r, "abc"), http.StatusOK)
+		assert_eq(t, s.VerifyTokenCalls, 2)
+	})
+
+	t.Run("A token is cached at most until it expires", func(t *testing.T) {
+		s := &AuthTestService{Claims: auth.Claims{UID: "123", Expires: time.Now()}}
+		_, r := gin.CreateTestContext(CreateTestResponseRecorder())
+		r.GET("/test", AuthorizeUser(auth.NewTokenCache(s, 10, time.Hour), nil))
+
+		assert_eq(t, authorize(r, "abc"), http.StatusOK)
+		assert_eq(t, authorize(r, "abc"), http.StatusOK)
+		assert_eq(t, s.VerifyTokenCalls, 2)
+
+		s.Claims.Expires = time.Now().Add(time.Hour)
+		assert_eq(t, authorize(r, "1.e30.abc"), http.StatusOK)
+		assert_eq(t, authorize(r, "1.e30.abc"), http.StatusOK)
+		assert_eq(t, s.VerifyTokenCalls, 3)
+	})
+
+	t.Run("Rejected tokens aren't cached and the least recently used token is evicted when full", func(t *testing.T) {
+		s := &AuthTestService{}
+		_, r := gin.CreateTestContext(CreateTestResponseRecorder())
+		r.GET("/test", AuthorizeUser(auth.NewTokenCache(s, 2, time.Hour), nil))
+
+		assert_eq(t, authorize(r, "invalid"), http.StatusUnauthorized)
+		assert_eq(t, authorize(r, "invalid"), http.StatusUnauthorized)
+		assert_eq(t, s.VerifyTokenCalls, 2)
+
+		first, second, third := "1.e30.abc", "2.e30.abc", "3.e30.abc"
+		authorize(r, first)
+		authorize(r, second)
+		authorize(r, first)
+		authorize(r, third)
+		assert_eq(t, s.VerifyTokenCalls, 5)
+		authorize(r, first)
+		assert_eq(t, s.VerifyTokenCalls, 5)
+		authorize(r, second)
+		assert_eq(t, s.VerifyTokenCalls, 6)
+	})
+
+	t.Run("Once a user is blocked routes checking revocation reject its tokens right away", func(t *testing.T) {
+		s := &AuthTestService{}
+		cache := auth.NewTokenCache(s, 10, time.Hour)
+		_, r := gin.CreateTestContext(CreateTestResponseRecorder())
+		r.GET("/test", AuthorizeUser(cache, nil))
+		r.POST("/test", AuthorizeUser(auth.CheckRevoked(cache), nil))
+		write := func() int {
+			w := CreateTestResponseRecorder()
+			req, _ := http.NewRequest(http.MethodPost, "/test", nil)
+			req.Header.Set("Authorization", "abc")
+			r.ServeHTTP(w, req)
+			return w.Code
+		}
+
+		assert_eq(t, authorize(r, "abc"), http.StatusOK)
+		assert_eq(t, write(), http.StatusOK)
+		assert_eq(t, write(), http.StatusOK)
+		assert_eq(t, s.VerifyTokenCalls, 3)
+
+		cache.SetBlockStatus("123", true)
+		assert_eq(t, write(), http.StatusUnauthorized)
+		assert_eq(t, authorize(r, "abc"), http.StatusOK)
+	})
+
+	t.Run("Uncached routes verify every token and blocking a user forgets its tokens", func(t *testing.T) {
+		s := &AuthTestService{}
+		cache := auth.NewTokenCache(s, 10, time.Hour)
+		_, r := gin.CreateTestContext(CreateTestResponseRecorder())
+		r.GET("/test", AuthorizeUser(cache, nil))
+		r.GET("/admin", AuthorizeUser(auth.Uncached(cache), nil))
+
+		authorize(r, "abc")
+		authorize(r, "abc")
+		assert_eq(t, s.VerifyTokenCalls, 1)
+		for i := 0; i < 2; i++ {
+			w := CreateTestResponseRecorder()
+			req, _ := http.NewRequest(http.MethodGet, "/admin", nil)
+			req.Header.Set("Authorization", "abc")
+			r.ServeHTTP(w, req)
+			assert_eq(t, w.Code, http.StatusOK)
+		}
+		assert_eq(t, s.VerifyTokenCalls, 3)
+
+		cache.SetBlockStatus("123", true)
+		authorize(r, "abc")
+		assert_eq(t, s.VerifyTokenCalls, 4)
+	})
+
+	t.Run("Deleting a user forgets its tokens", func(t *testing.T) {
+		s := &AuthTestService{}
+		cache := auth.NewTokenCache(s, 10, time.Hour)
+		_, r := gin.CreateTestContext(CreateTestResponseRecorder())
+		r.GET("/test", AuthorizeUser(cache, nil))
+
+		authorize(r, "abc")
+		cache.DeleteUser("123")
+		authorize(r, "abc")
+		assert_eq(t, s.VerifyTokenCalls, 2)
+		assert_eq(t, s.DeleteUserCalls, 1)
+	})
+}
+
+func TestUserHeaders(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	claims := auth.Claims{
+		UID:           "123",
+		Email:         "abc@xyz.com",
+		EmailVerified: true,
+		Provider:      "password",
+		AuthTime:      time.Unix(1700000000, 0),
+		Custom:        map[string]interface{}{"roles": []interface{}{"trainer", "athlete"}},
+	}
+
+	t.Run("The claims of the token are forwarded to the upstream and kept in the context", func(t *testing.T) {
+		upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			assert_eq(t, r.Header.Get("X-User-UID"), "123")
+			assert_eq(t, r.Header.Get("X-User-Email"), "abc@xyz.com")
+			assert_eq(t, r.Header.Get("X-User-Email-Verified"), "true")
+			assert_eq(t, r.Header.Get("X-User-Provider"), "password")
+			assert_eq(t, r.Header.Get("X-User-Roles"), "trainer,athlete")
+			assert_eq(t, r.Header.Get("X-User-Auth-Time"), "1700000000")
+			assert_eq(t, r.Header.Get("X-User-Signature"), "")
+		}))
+		defer upstream.Close()
+
+		var got auth.Claims
+		_, r := gin.CreateTestContext(CreateTestResponseRecorder())
+		r.GET("/test", UserHeaders(""), AuthorizeUser(&AuthTestService{Claims: claims}, nil), func(c *gin.Context) {
+			got, _ = GetClaims(c)
+		}, ReverseProxy(testUpstream(upstream.URL)))
+		w := CreateTestResponseRecorder()
+		req, _ := http.NewRequest(http.MethodGet, "/test", nil)
+		req.Header.Set("Authorization", "abc")
+		r.ServeHTTP(w, req)
+
+		assert_eq(t, w.Code, http.StatusOK)
+		assert_eq(t, got.UID, "123")
+		assert_eq(t, got.Email, "abc@xyz.com")
+	})
+
+	t.Run("User headers sent by the client are dropped, with or without a token", func(t *testing.T) {
+		var forwarded []http.Header
+		upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			forwarded = append(forwarded, r.Header.Clone())
+		}))
+		defer upstream.Close()
+
+		_, r := gin.CreateTestContext(CreateTestResponseRecorder())
+		r.GET("/public", UserHeaders(""), ReverseProxy(testUpstream(upstream.URL)))
+		r.GET("/private", UserHeaders(""), AuthorizeUser(&AuthTestService{}, nil), ReverseProxy(testUpstream(upstream.URL)))
+		for _, path := range []string{"/public", "/private"} {
+			req, _ := http.NewRequest(http.MethodGet, path, nil)
+			req.Header.Set("Authorization", "abc")
+			req.Header.Set("X-User-UID", "admin")
+			req.Header.Set("X-User-Roles", "admin")
+			req.Header.Set("x-user-custom", "forged")
+			r.ServeHTTP(CreateTestResponseRecorder(), req)
+		}
+
+		assert_eq(t, len(forwarded), 2)
+		assert_eq(t, forwarded[0].Get("X-User-UID"), "")
+		assert_eq(t, forwarded[0].Get("X-User-Roles"), "")
+		assert_eq(t, forwarded[0].Get("X-User-Custom"), "")
+		assert_eq(t, forwarded[1].Get("X-User-UID"), "123")
+		assert_eq(t, forwarded[1].Get("X-User-Roles"), "")
+		assert_eq(t, forwarded[1].Get("X-User-Custom"), "")
+	})
+
+	t.Run("With a secret the user headers are signed along the request ID", func(t *testing.T) {
+		var header http.Header
+		upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			header = r.Header.Clone()
+		}))
+		defer upstream.Close()
+
+		_, r := gin.CreateTestContext(CreateTestResponseRecorder())
+		r.GET("/test", RequestID(), UserHeaders("secret"), AuthorizeUser(&AuthTestService{Claims: claims}, nil), ReverseProxy(testUpstream(upstream.URL)))
+		req, _ := http.NewRequest(http.MethodGet, "/test", nil)
+		req.Header.Set("Authorization", "abc")
+		req.Header.Set("X-Request-ID", "request-1")
+		req.Header.Set("X-User-Signature", "forged")
+		r.ServeHTTP(CreateTestResponseRecorder(), req)
+
+		mac := hmac.New(sha256.New, []byte("secret"))
+		mac.Write([]byte("123\nabc@xyz.com\ntrue\npassword\ntrainer,athlete\n1700000000\nrequest-1"))
+		assert_eq(t, header.Get("X-User-Signature"), hex.EncodeToString(mac.Sum(nil)))
+	})
+}
+
+func TestMetrics(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	// Returns the value of the series in the exported metrics, 0 if it
+	// wasn't exported
+	metricValue := func(t testing.TB, series string) float64 {
+		t.Helper()
+		buf := bytes.Buffer{}
+		metrics.Default.Write(&buf)
+		for _, line := range strings.Split(buf.String(), "\n") {
+			if strings.HasPrefix(line, series+" ") {
+				value, _ := strconv.ParseFloat(strings.TrimPrefix(line, series+" "), 64)
+				return value
+			}
+		}
+		return 0
+	}
+
+	t.Run("Token cache lookups are counted by result", func(t *testing.T) {
+		hits := metricValue(t, `gateway_token_cache_lookups_total{result="hit"}`)
+		misses := metricValue(t, `gateway_token_cache_lookups_total{result="miss"}`)
+		bypasses := metricValue(t, `gateway_token_cache_lookups_total{result="bypass"}`)
+		cache := auth.NewTokenCache(&AuthTestService{}, 10, time.Hour)
+		cache.VerifyToken("abc")
+		cache.VerifyToken("abc")
+		auth.Uncached(cache).VerifyToken("abc")
+
+		assert_eq(t, metricValue(t, `gateway_token_cache_lookups_total{result="hit"}`), hits+1)
+		assert_eq(t, metricValue(t, `gateway_token_cache_lookups_total{result="miss"}`), misses+1)
+		assert_eq(t, metricValue(t, `gateway_token_cache_lookups_total{result="bypass"}`), bypasses+1)
+	})
+
+	t.Run("Requests are counted and timed by route, method, status class and upstream", func(t *testing.T) {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusAccepted)
+		}))
+		defer server.Close()
+
+		_, r := gin.CreateTestContext(CreateTestResponseRecorder())
+		r.GET("/metrics-test/:id", Metrics(), ReverseProxy(testUpstream(server.URL)))
+		for i := 0; i < 2; i++ {
+			req, _ := http.NewRequest(http.MethodGet, "/metrics-test/1", nil)
+			r.ServeHTTP(CreateTestResponseRecorder(), req)
+		}
+
+		labels := `{route="/metrics-test/:id",method="GET",status="2xx",upstream="test"}`
+		assert_eq(t, metricValue(t, "gateway_requests_total"+labels), 2)
+		assert_eq(t, metricValue(t, "gateway_request_duration_seconds_count"+labels), 2)
+		assert_eq(t, metricValue(t, `gateway_request_duration_seconds_bucket{route="/metrics-test/:id",method="GET",status="2xx",upstream="test",le="+Inf"}`), 2)
+		assert_eq(t, metricValue(t, `gateway_requests_in_flight{route="/metrics-test/:id",method="GET"}`), 0)
+	})
+
+	t.Run("Failed verifications, admin checks and proxy errors are counted", func(t *testing.T) {
+		authFailures := metricValue(t, "gateway_auth_failures_total")
+		adminFailures := metricValue(t, "gateway_admin_check_failures_total")
+		proxyErrors := metricValue(t, `gateway_proxy_errors_total{upstream="test",kind="connection"}`)
+
+		users := httptest.NewServer(http.NotFoundHandler())
+		defer users.Close()
+		closed := httptest.NewServer(http.NotFoundHandler())
+		closed.Close()
+
+		_, r := gin.CreateTestContext(CreateTestResponseRecorder())
+		r.GET("/admin", AuthorizeUser(&AuthTestService{}, nil), AuthorizeAdmin(NewAdminLookup(testUpstream(users.URL))))
+		r.GET("/closed", ReverseProxy(testUpstream(closed.URL)))
+		for _, token := range []string{"xyz", "abc"} {
+			req, _ := http.NewRequest(http.MethodGet, "/admin", nil)
+			req.Header.Set("Authorization", token)
+			r.ServeHTTP(CreateTestResponseRecorder(), req)
+		}
+		req, _ := http.NewRequest(http.MethodGet, "/closed", nil)
+		r.ServeHTTP(CreateTestResponseRecorder(), req)
+
+		assert_eq(t, metricValue(t, "gateway_auth_failures_total"), authFailures+1)
+		assert_eq(t, metricValue(t, "gateway_admin_check_failures_total"), adminFailures+1)
+		assert_eq(t, metricValue(t, `gateway_proxy_errors_total{upstream="test",kind="connection"}`), proxyErrors+1)
+	})
+
+	t.Run("The metrics are only served to requests bearing the token", func(t *testing.T) {
+		_, r := gin.CreateTestContext(CreateTestResponseRecorder())
+		r.GET("/internal/metrics", MetricsHandler("secret"))
+		send := func(token string) *TestResponseRecorder {
+			w := CreateTestResponseRecorder()
+			req, _ := http.NewRequest(http.MethodGet, "/internal/metrics", nil)
+			req.Header.Set("Authorization", token)
+			r.ServeHTTP(w, req)
+			return w
+		}
+
+		assertProblem(t, send("Bearer wrong"), http.StatusUnauthorized, problem.Unauthorized)
+		w := send("Bearer secret")
+		assert_eq(t, w.Code, http.StatusOK)
+		assert_eq(t, w.Header().Get("Content-Type"), metrics.ContentType)
+		assert_eq(t, strings.Contains(w.Body.String(), "# TYPE gateway_requests_total counter"), true)
+	})
+}
+
+func TestRequestID(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	send := func(r *gin.Engine, method, id, body string) *TestResponseRecorder {
+		w := CreateTestResponseRecorder()
+		req, _ := http.NewRequest(method, "/test", bytes.NewBufferString(body))
+		req.Header.Set("Authorization", "abc")
+		if id != "" {
+			req.Header.Set("X-Request-ID", id)
+		}
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	t.Run("A request without ID gets a new one, forwarded to the upstream and echoed in the response", func(t *testing.T) {
+		forwarded := ""
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			forwarded = r.Header.Get("X-Request-ID")
+		}))
+		defer server.Close()
+
+		_, r := gin.CreateTestContext(CreateTestResponseRecorder())
+		r.GET("/test", RequestID(), ReverseProxy(testUpstream(server.URL)))
+		first := send(r, http.MethodGet, "", "").Header().Get("X-Request-ID")
+		assert_eq(t, len(first), 32)
+		assert_eq(t, forwarded, first)
+		assert_eq(t, send(r, http.MethodGet, "", "").Header().Get("X-Request-ID") != first, true)
+	})
+
+	t.Run("A valid ID sent by the client is kept, an invalid one is replaced", func(t *testing.T) {
+		_, r := gin.CreateTestContext(CreateTestResponseRecorder())
+		r.GET("/test", RequestID())
+		assert_eq(t, send(r, http.MethodGet, "client-id.1", "").Header().Get("X-Request-ID"), "client-id.1")
+		assert_eq(t, send(r, http.MethodGet, "not valid", "").Header().Get("X-Request-ID") != "not valid", true)
+		long := strings.Repeat("a", 129)
+		assert_eq(t, send(r, http.MethodGet, long, "").Header().Get("X-Request-ID") != long, true)
+	})
+
+	t.Run("The admin lookup and the requests built to create users carry the ID", func(t *testing.T) {
+		forwarded := make(chan string, 2)
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			forwarded <- r.Method + " " + r.Header.Get("X-Request-ID")
+		}))
+		defer server.Close()
+
+		u := testUpstream(server.URL)
+		_, r := gin.CreateTestContext(CreateTestResponseRecorder())
+		r.GET("/test", RequestID(), AuthorizeUser(&AuthTestService{}, nil), AuthorizeAdmin(NewAdminLookup(u)))
+		r.POST("/test", RequestID(), CreateUser(&AuthTestService{}), ReverseProxy(u))
+		send(r, http.MethodGet, "admin-lookup", "")
+		send(r, http.MethodPost, "sign-up", `{"email": "abc@xyz.com", "password": "secret123", "username": "abc"}`)
+		assert_eq(t, <-forwarded, "GET admin-lookup")
+		assert_eq(t, <-forwarded, "POST sign-up")
+	})
+
+	t.Run("Problems and logs include the ID of the request", func(t *testing.T) {
+		buf := bytes.Buffer{}
+		log.SetOutput(&buf)
+		defer log.SetOutput(io.Discard)
+
+		_, r := gin.CreateTestContext(CreateTestResponseRecorder())
+		r.GET("/test", RequestID(), AuthorizeUser(&AuthTestService{}, nil))
+		w := CreateTestResponseRecorder()
+		req, _ := http.NewRequest(http.MethodGet, "/test", nil)
+		req.Header.Set("X-Request-ID", "failed-auth")
+		r.ServeHTTP(w, req)
+
+		assert_eq(t, assertProblem(t, w, http.StatusUnauthorized, problem.Unauthorized).RequestID, "failed-auth")
+		assert_eq(t, strings.Contains(buf.String(), "failed-auth"), true)
+	})
+}
+
+func TestProblem(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	t.Run("Errors originated in the gateway carry the ID of the request in the problem", func(t *testing.T) {
+		w := CreateTestResponseRecorder()
+		_, r := gin.CreateTestContext(w)
+		r.GET("/test", AuthorizeUser(&AuthTestService{}, nil))
+		req, _ := http.NewRequest(http.MethodGet, "/test", nil)
+		req.Header.Set(problem.RequestIDHeader, "request-1")
+		r.ServeHTTP(w, req)
+
+		got := assertProblem(t, w, http.StatusUnauthorized, problem.Unauthorized)
+		assert_eq(t, got.RequestID, "request-1")
+		assert_eq(t, got.Type, "urn:fiufit:problem:unauthorized")
+		assert_eq(t, got.Title, "Unauthorized")
+		assert_eq(t, got.Detail, "unauthorized")
+	})
+
+	t.Run("An unreachable upstream responds Bad Gateway with a problem body", func(t *testing.T) {
+		server := httptest.NewServer(http.NotFoundHandler())
+		server.Close()
+
+		w := CreateTestResponseRecorder()
+		_, r := gin.CreateTestContext(w)
+		r.GET("/test", ReverseProxy(testUpstream(server.URL)))
+		req, _ := http.NewRequest(http.MethodGet, "/test", nil)
+		r.ServeHTTP(w, req)
+
+		assertProblem(t, w, http.StatusBadGateway, problem.BadGateway)
+	})
+
+	t.Run("Invalid bodies, unknown users and failed sign ups respond with their own codes", func(t *testing.T) {
+		send := func(handler gin.HandlerFunc, body string) *TestResponseRecorder {
+			w := CreateTestResponseRecorder()
+			_, r := gin.CreateTestContext(w)
+			r.POST("/test", handler)
+			req, _ := http.NewRequest(http.MethodPost, "/test", bytes.NewBufferString(body))
+			r.ServeHTTP(w, req)
+			return w
+		}
+
+		s := &AuthTestService{}
+		assertProblem(t, send(ChangeBlockStatusFirebase(s), "{"), http.StatusBadRequest, problem.InvalidBody)
+		assertProblem(t, send(ChangeBlockStatusFirebase(s), `[{"uid": "z", "blocked": true}]`), http.StatusNotFound, problem.UserNotFound)
+		assertProblem(t, send(CreateAdmin(s), "{"), http.StatusBadRequest, problem.InvalidBody)
+	})
+
+	t.Run("A user that isn't an admin gets a not admin problem", func(t *testing.T) {
+		server := httptest.NewServer(http.NotFoundHandler())
+		defer server.Close()
+
+		w := CreateTestResponseRecorder()
+		_, r := gin.CreateTestContext(w)
+		r.GET("/test", AuthorizeUser(&AuthTestService{}, nil), AuthorizeAdmin(NewAdminLookup(testUpstream(server.URL))))
+		req, _ := http.NewRequest(http.MethodGet, "/test", nil)
+		req.Header.Set("Authorization", "abc")
+		r.ServeHTTP(w, req)
+
+		assertProblem(t, w, http.StatusUnauthorized, problem.NotAdmin)
+	})
+}
+
+// Checks the response is a problem with the given status and code
+func assertProblem(t testing.TB, w *TestResponseRecorder, status int, code string) problem.Problem {
+	t.Helper()
+	var got problem.Problem
+	if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+		t.Fatalf("Response %q isn't a problem: %s", w.Body.String(), err.Error())
+	}
+	assert_eq(t, w.Header().Get("Content-Type"), problem.ContentType)
+	assert_eq(t, w.Code, status)
+	assert_eq(t, got.Status, status)
+	assert_eq(t, got.Code, code)
+	return got
+}
+
+func TestRateLimit(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	limits := config.RateLimit{
+		Default: config.Quota{Requests: 2, Period: time.Minute},
+		Routes:  map[string]config.Quota{"GET /single": {Requests: 1, Period: time.Minute}},
+	}
+	newRouter := func(l *ratelimit.Limiter) *gin.Engine {
+		_, r := gin.CreateTestContext(CreateTestResponseRecorder())
+		r.GET("/test", RateLimit(l))
+		r.GET("/single", RateLimit(l))
+		r.GET("/users", AuthorizeUser(&AuthTestService{}, l), RateLimit(l))
+		return r
+	}
+	send := func(r *gin.Engine, path, ip, token string) *TestResponseRecorder {
+		w := CreateTestResponseRecorder()
+		req, _ := http.NewRequest(http.MethodGet, path, nil)
+		req.RemoteAddr = ip + ":1234"
+		req.Header.Set("Authorization", token)
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	t.Run("Anonymous clients are limited by IP, over the quota they get 429 with the time to wait", func(t *testing.T) {
+		r := newRouter(ratelimit.New(ratelimit.NewMemoryStore(), limits))
+		w := send(r, "/test", "10.0.0.1", "")
+		assert_eq(t, w.Code, http.StatusOK)
+		assert_eq(t, w.Header().Get("X-RateLimit-Limit"), "2")
+		assert_eq(t, w.Header().Get("X-RateLimit-Remaining"), "1")
+		assert_eq(t, send(r, "/test", "10.0.0.1", "").Code, http.StatusOK)
+
+		w = send(r, "/test", "10.0.0.1", "")
+		assertProblem(t, w, http.StatusTooManyRequests, problem.RateLimited)
+		assert_eq(t, w.Header().Get("X-RateLimit-Remaining"), "0")
+		assert_eq(t, w.Header().Get("Retry-After"), "30")
+		assert_eq(t, send(r, "/test", "10.0.0.2", "").Code, http.StatusOK)
+	})
+
+	t.Run("Authenticated users are limited by UID whatever IP they come from", func(t *testing.T) {
+		r := newRouter(ratelimit.New(ratelimit.NewMemoryStore(), limits))
+		assert_eq(t, send(r, "/users", "10.0.0.1", "abc").Code, http.StatusOK)
+		assert_eq(t, send(r, "/users", "10.0.0.2", "abc").Code, http.StatusOK)
+		assert_eq(t, send(r, "/users", "10.0.0.3", "abc").Code, http.StatusTooManyRequests)
+	})
+
+	t.Run("Requests with tokens that can't be verified are limited by IP", func(t *testing.T) {
+		r := newRouter(ratelimit.New(ratelimit.NewMemoryStore(), limits))
+		assertProblem(t, send(r, "/users", "10.0.0.1", "invalid"), http.StatusUnauthorized, problem.Unauthorized)
+		assertProblem(t, send(r, "/users", "10.0.0.1", "invalid"), http.StatusUnauthorized, problem.Unauthorized)
+
+		w := send(r, "/users", "10.0.0.1", "invalid")
+		assertProblem(t, w, http.StatusTooManyRequests, problem.RateLimited)
+		assert_eq(t, w.Header().Get("Retry-After"), "30")
+		assert_eq(t, send(r, "/users", "10.0.0.2", "invalid").Code, http.StatusUnauthorized)
+		assert_eq(t, send(r, "/users", "10.0.0.1", "abc").Code, http.StatusOK)
+	})
+
+	t.Run("Verified tokens don't take from the bucket of their IP", func(t *testing.T) {
+		_, r := gin.CreateTestContext(CreateTestResponseRecorder())
+		r.GET("/users", AuthorizeUser(&AuthTestService{}, ratelimit.New(ratelimit.NewMemoryStore(), limits)))
+		for i := 0; i < 3; i++ {
+			w := send(r, "/users", "10.0.0.1", "abc")
+			assert_eq(t, w.Code, http.StatusOK)
+			assert_eq(t, w.Header().Get("X-RateLimit-Limit"), "")
+		}
+	})
+
+	t.Run("Each route has its own bucket and routes can set their own quota", func(t *testing.T) {
+		r := newRouter(ratelimit.New(ratelimit.NewMemoryStore(), limits))
+		assert_eq(t, send(r, "/single", "10.0.0.1", "").Code, http.StatusOK)
+		assert_eq(t, send(r, "/single", "10.0.0.1", "").Code, http.StatusTooManyRequests)
+		assert_eq(t, send(r, "/test", "10.0.0.1", "").Code, http.StatusOK)
+
+		r = newRouter(ratelimit.New(ratelimit.NewMemoryStore(), limits).WithQuota(config.Quota{Requests: 3, Period: time.Minute}))
+		assert_eq(t, send(r, "/single", "10.0.0.1", "").Header().Get("X-RateLimit-Limit"), "3")
+	})
+
+	t.Run("Gateways sharing a redis store share the buckets of the clients", func(t *testing.T) {
+		addr, commands := testRedisServer(t, "secret")
+		first := newRouter(ratelimit.New(ratelimit.NewRedisStore(addr, "secret"), limits))
+		second := newRouter(ratelimit.New(ratelimit.NewRedisStore(addr, "secret"), limits))
+
+		w := send(first, "/test", "10.0.0.1", "")
+		assert_eq(t, w.Code, http.StatusOK)
+		assert_eq(t, w.Header().Get("X-RateLimit-Remaining"), "1")
+		assert_eq(t, send(second, "/test", "10.0.0.1", "").Code, http.StatusOK)
+		w = send(first, "/test", "10.0.0.1", "")
+		assert_eq(t, w.Code, http.StatusTooManyRequests)
+		assert_eq(t, w.Header().Get("Retry-After"), "30")
+		assert_eq(t, <-commands, "AUTH")
+		assert_eq(t, <-commands, "EVALSHA")
+		assert_eq(t, <-commands, "EVAL")
+	})
+
+	t.Run("If the store is unavailable requests are allowed without rate limit headers", func(t *testing.T) {
+		listener, _ := net.Listen("tcp", "127.0.0.1:0")
+		addr := listener.Addr().String()
+		listener.Close()
+
+		r := newRouter(ratelimit.New(ratelimit.NewRedisStore(addr, ""), limits))
+		w := send(r, "/test", "10.0.0.1", "")
+		assert_eq(t, w.Code, http.StatusOK)
+		assert_eq(t, w.Header().Get("X-RateLimit-Limit"), "")
+	})
+
+	t.Run("A nil limiter allows every request", func(t *testing.T) {
+		r := newRouter(nil)
+		for i := 0; i < 5; i++ {
+			assert_eq(t, send(r, "/test", "10.0.0.1", "").Code, http.StatusOK)
+		}
+	})
+}
+
+// Starts a server speaking the redis protocol that runs the token bucket
+// script of the rate limiter in Go. It only knows the script once it was
+// sent with EVAL, like redis after a restart. Returns its address and
+// the names of the commands it receives.
+func testRedisServer(t *testing.T, password string) (string, <-chan string) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	commands := make(chan string, 100)
+	var mu sync.Mutex
+	buckets := make(map[string]ratelimit.Bucket)
+	scriptLoaded := false
+	serve := func(conn net.Conn) {
+		defer conn.Close()
+		reader := bufio.NewReader(conn)
+		for {
+			reply, err := ratelimit.ReadReply(reader)
+			if err != nil {
+				return
+			}
+			values := reply.([]interface{})
+			args := make([]string, len(values))
+			for i, value := range values {
+				args[i] = string(value.([]byte))
+			}
+			commands <- args[0]
+
+			mu.Lock()
+			switch {
+			case args[0] == "AUTH" && args[1] == password:
+				fmt.Fprint(conn, "+OK\r\n")
+			case args[0] == "AUTH":
+				fmt.Fprint(conn, "-WRONGPASS invalid password\r\n")
+			case args[0] == "EVALSHA" && !scriptLoaded:
+				fmt.Fprint(conn, "-NOSCRIPT No matching script\r\n")
+			case args[0] == "EVAL" || args[0] == "EVALSHA":
+				scriptLoaded = true
+				requests, _ := strconv.Atoi(args[4])
+				period, _ := strconv.ParseInt(args[5], 10, 64)
+				now, _ := strconv.ParseInt(args[6], 10, 64)
+				quota := config.Quota{Requests: requests, Period: time.Duration(period) * time.Millisecond}
+				var result ratelimit.Result
+				buckets[args[3]], result = ratelimit.Take(buckets[args[3]], quota, time.Unix(0, now*int64(time.Millisecond)))
+				allowed := 0
+				if result.Allowed {
+					allowed = 1
+				}
+				fmt.Fprintf(conn, "*4\r\n:%d\r\n:%d\r\n:%d\r\n:%d\r\n",
+					allowed, result.Remaining, result.RetryAfter.Milliseconds(), result.Reset.Milliseconds())
+			default:
+				fmt.Fprintf(conn, "-ERR unknown command '%s'\r\n", args[0])
+			}
+			mu.Unlock()
+		}
+	}
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go serve(conn)
+		}
+	}()
+	return listener.Addr().String(), commands
+}
+
+// Both provisioning flows share the same pipeline, they run the same
+// tests
+var provisioningFlows = []struct {
+	name    string
+	path    string
+	handler func(auth.Service) gin.HandlerFunc
+}{
+	{"user", "/users", CreateUser},
+	{"admin", "/admins", CreateAdmin},
+}
+
+func provision(handler gin.HandlerFunc, body io.Reader) (*gin.Context, *TestResponseRecorder) {
+	w := CreateTestResponseRecorder()
+	c, _ := gin.CreateTestContext(w)
+	req, _ := http.NewRequest(http.MethodPost, "/test", body)
+	c.Request = req
+	handler(c)
+	c.Writer.WriteHeaderNow()
+	return c, w
+}
+
+func signUpBody(data auth.SignUpModel) io.Reader {
+	dataJSON, _ := json.Marshal(data)
+	return bytes.NewReader(dataJSON)
+}
+
+func TestProvision(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	valid := auth.SignUpModel{Email: "abc@xyz.com", Username: "abc", Password: "secret123"}
+
+	for _, flow := range provisioningFlows {
+		t.Run("Send valid sign up data, create the "+flow.name+" and put its data in the request body", func(t *testing.T) {
+			s := &AuthTestService{}
+			c, _ := provision(flow.handler(s), signUpBody(valid))
+
+			assert_eq(t, c.IsAborted(), false)
+			assert_eq(t, s.CreateUserCalls, 1)
+			assert_eq(t, c.Request.URL.Path, flow.path)
+			body, _ := io.ReadAll(c.Request.Body)
+			defer c.Request.Body.Close()
+			userData := auth.UserModel{UID: "123", Username: "abc", Email: "abc@xyz.com"}
+			userDataJSON, _ := json.Marshal(userData)
+			assert_eq(t, string(body), string(userDataJSON))
+		})
+
+		t.Run("If the body of the "+flow.name+" sign up contains invalid JSON the middleware aborts with Bad Request", func(t *testing.T) {
+			s := &AuthTestService{}
+			c, w := provision(flow.handler(s), nil)
+
+			assert_eq(t, c.IsAborted(), true)
+			assert_eq(t, w.Result().StatusCode, http.StatusBadRequest)
+			assert_eq(t, s.CreateUserCalls, 0)
+		})
+
+		t.Run("If the "+flow.name+" sign up data isn't valid the middleware aborts with Bad Request and the invalid fields", func(t *testing.T) {
+			invalid := map[string]auth.SignUpModel{
+				"email":    {Email: "abc", Username: "abc", Password: "secret123"},
+				"username": {Email: "abc@xyz.com", Username: "a b", Password: "secret123"},
+				"password": {Email: "abc@xyz.com", Username: "abc", Password: "1"},
+			}
+			for field, data := range invalid {
+				s := &AuthTestService{}
+				c, w := provision(flow.handler(s), signUpBody(data))
+
+				assert_eq(t, c.IsAborted(), true)
+				assert_eq(t, w.Result().StatusCode, http.StatusBadRequest)
+				assert_eq(t, s.CreateUserCalls, 0)
+				var got problem.Problem
+				json.Unmarshal(w.Body.Bytes(), &got)
+				assert_eq(t, got.Code, problem.InvalidBody)
+				assert_eq(t, len(got.Errors), 1)
+				if len(got.Errors) == 1 {
+					assert_eq(t, got.Errors[0].Field, field)
+				}
+			}
+		})
+
+		t.Run("Missing fields of the "+flow.name+" sign up are all reported", func(t *testing.T) {
+			s := &AuthTestService{}
+			_, w := provision(flow.handler(s), strings.NewReader("{}"))
+
+			var got problem.Problem
+			json.Unmarshal(w.Body.Bytes(), &got)
+			assert_eq(t, w.Result().StatusCode, http.StatusBadRequest)
+			assert_eq(t, len(got.Errors), 3)
+		})
+
+		t.Run("If firebase rejects the "+flow.name+" the middleware aborts with Conflict", func(t *testing.T) {
+			s := &AuthTestService{}
+			taken := auth.SignUpModel{Email: "taken@xyz.com", Username: "abc", Password: "secret123"}
+			c, w := provision(flow.handler(s), signUpBody(taken))
+
+			assert_eq(t, c.IsAborted(), true)
+			assert_eq(t, w.Result().StatusCode, http.StatusConflict)
+		})
+	}
+
+	t.Run("Creating user with federated identity, gets the user data from the auth service", func(t *testing.T) {
+		s := &AuthTestService{}
+		c, _ := provision(CreateUser(s), signUpBody(auth.SignUpModel{Federated: true, UID: "a"}))
+
+		assert_eq(t, s.GetUserCalls, 1)
+		body, _ := io.ReadAll(c.Request.Body)
+		defer c.Request.Body.Close()
+		userData := auth.UserModel{UID: "a", Username: "user", Email: "email@xyz.com"}
+		userDataJSON, _ := json.Marshal(userData)
+		assert_eq(t, string(body), string(userDataJSON))
+	})
+
+	t.Run("Federated sign ups of a UID not in the auth service are rejected before reaching the users service", func(t *testing.T) {
+		s := &AuthTestService{}
+		c, w := provision(CreateUser(s), signUpBody(auth.SignUpModel{Federated: true, UID: "z"}))
+
+		got := assertProblem(t, w, http.StatusBadRequest, problem.InvalidBody)
+		assert_eq(t, c.IsAborted(), true)
+		assert_eq(t, c.Request.URL.Path, "/test")
+		assert_eq(t, len(got.Errors), 1)
+		if len(got.Errors) == 1 {
+			assert_eq(t, got.Errors[0].Field, "uid")
+		}
+		assert_eq(t, s.DeleteUserCalls, 0)
+	})
+
+	t.Run("Federated sign ups fail with 500 when the auth service can't be reached", func(t *testing.T) {
+		s := &AuthTestService{}
+		c, w := provision(CreateUser(s), signUpBody(auth.SignUpModel{Federated: true, UID: "unreachable"}))
+
+		assertProblem(t, w, http.StatusInternalServerError, problem.Internal)
+		assert_eq(t, c.IsAborted(), true)
+		assert_eq(t, c.Request.URL.Path, "/test")
+	})
+
+	t.Run("Federated sign ups require the UID", func(t *testing.T) {
+		s := &AuthTestService{}
+		_, w := provision(CreateUser(s), signUpBody(auth.SignUpModel{Federated: true}))
+
+		var got problem.Problem
+		json.Unmarshal(w.Body.Bytes(), &got)
+		assert_eq(t, w.Result().StatusCode, http.StatusBadRequest)
+		assert_eq(t, len(got.Errors), 1)
+		assert_eq(t, s.GetUserCalls, 0)
+	})
+
+	t.Run("Admins can't be created from a federated identity", func(t *testing.T) {
+		s := &AuthTestService{}
+		_, w := provision(CreateAdmin(s), signUpBody(auth.SignUpModel{Federated: true, UID: "a"}))
+
+		assert_eq(t, w.Result().StatusCode, http.StatusBadRequest)
+		assert_eq(t, s.GetUserCalls, 0)
+	})
+
+	t.Run("Admins get the admin role, users no role", func(t *testing.T) {
+		s := &AuthTestService{}
+		provision(CreateAdmin(s), signUpBody(valid))
+		assert_eq(t, s.SetRolesCalls, 1)
+		assert_eq(t, s.Claims.HasRole(auth.RoleAdmin), true)
+
+		s = &AuthTestService{}
+		provision(CreateUser(s), signUpBody(valid))
+		assert_eq(t, s.SetRolesCalls, 0)
+	})
+
+	t.Run("An admin whose role can't be set is rolled back before reaching the users service", func(t *testing.T) {
+		s := &AuthTestService{SetRolesErr: errors.New("firebase unreachable")}
+		c, w := provision(CreateAdmin(s), signUpBody(valid))
+
+		assertProblem(t, w, http.StatusInternalServerError, problem.Internal)
+		assert_eq(t, c.IsAborted(), true)
+		assert_eq(t, c.Request.URL.Path, "/test")
+		assert_eq(t, s.DeleteUserCalls, 1)
+	})
+}
+
+func TestAuthorizeAdmin(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	t.Run("Authenticate a request from the admin", func(t *testing.T) {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			assert_eq(t, r.URL.String(), "/admins/xyz")
+			w.WriteHeader(http.StatusOK)
+		}))
+		defer server.Close()
+
+		u := testUpstream(server.URL)
+		w := CreateTestResponseRecorder()
+		c, r := gin.CreateTestContext(w)
+		c.Set(uidKey, "xyz")
+		req, _ := http.NewRequest(http.MethodPost, "/test", nil)
+		c.Request = req
+
+		AuthorizeAdmin(NewAdminLookup(u))(c)
+
+		r.ServeHTTP(w, req)
+
+		if c.IsAborted() {
+			t.Error("The middleware shouldn't abort")
+		}
+	})
+
+	t.Run("Authenticate a request from the admin, UID was not set, middleware aborts", func(t *testing.T) {
+		w := CreateTestResponseRecorder()
+		c, r := gin.CreateTestContext(w)
+		req, _ := http.NewRequest(http.MethodPost, "/test", nil)
+		c.Request = req
+
+		AuthorizeAdmin(NewAdminLookup(testUpstream("")))(c)
+
+		r.ServeHTTP(w, req)
+
+		if !c.IsAborted() {
+			t.Error("The middleware should abort")
+		}
+		c.Writer.WriteHeaderNow()
+		got := w.Result().StatusCode
+		assert_eq(t, got, http.StatusInternalServerError)
+	})
+
+	t.Run("Authenticate a request from the admin, UID was set, but wasn't valid", func(t *testing.T) {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			assert_eq(t, r.URL.String(), "/admins/xyz")
+			w.WriteHeader(http.StatusUnauthorized)
+		}))
+		defer server.Close()
+
+		u := testUpstream(server.URL)
+		w := CreateTestResponseRecorder()
+		c, r := gin.CreateTestContext(w)
+		c.Set(uidKey, "xyz")
+		req, _ := http.NewRequest(http.MethodPost, "/test", nil)
+		c.Request = req
+
+		AuthorizeAdmin(NewAdminLookup(u))(c)
+
+		r.ServeHTTP(w, req)
+
+		if !c.IsAborted() {
+			t.Error("The middleware should abort")
+		}
+
+		got := w.Code
+		assert_eq(t, got, http.StatusUnauthorized)
+	})
 }
 
-func TestCreateUser(t *testing.T) {
-	gin.SetMode(gin.TestMode)
-	t.Run("Send valid sign up data, create an user and put the user data in the request body", func(t *testing.T) {
-		w := CreateTestResponseRecorder()
-		c, _ := gin.CreateTestContext(w)
+func TestRoles(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	t.Run("Admins with the role in their token aren't looked up in the users service", func(t *testing.T) {
+		lookups := 0
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			lookups += 1
+			w.WriteHeader(http.StatusNotFound)
+		}))
+		defer server.Close()
+
+		w := CreateTestResponseRecorder()
+		c, _ := gin.CreateTestContext(w)
+		c.Set(claimsKey, auth.Claims{UID: "xyz", Custom: map[string]interface{}{"roles": []interface{}{auth.RoleAdmin}}})
+		c.Request, _ = http.NewRequest(http.MethodGet, "/test", nil)
+
+		AuthorizeAdmin(NewAdminLookup(testUpstream(server.URL)))(c)
+
+		assert_eq(t, c.IsAborted(), false)
+		assert_eq(t, lookups, 0)
+	})
+
+	t.Run("The answers of the users service are cached", func(t *testing.T) {
+		lookups := 0
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			lookups += 1
+			if r.URL.Path == "/admins/admin" {
+				w.WriteHeader(http.StatusOK)
+				return
+			}
+			w.WriteHeader(http.StatusNotFound)
+		}))
+		defer server.Close()
+
+		admins := NewAdminLookup(testUpstream(server.URL))
+		for _, uid := range []string{"admin", "admin", "user", "user"} {
+			w := CreateTestResponseRecorder()
+			c, _ := gin.CreateTestContext(w)
+			c.Set(claimsKey, auth.Claims{UID: uid})
+			c.Request, _ = http.NewRequest(http.MethodGet, "/test", nil)
 
-		s := &AuthTestService{}
+			AuthorizeAdmin(admins)(c)
 
-		signUpData := auth.SignUpModel{
-			Email: "abc@xyz.com", Username: "abc", Password: "123",
+			assert_eq(t, c.IsAborted(), uid != "admin")
 		}
-		signUpDataJSON, _ := json.Marshal(signUpData)
-		bodyBytes := bytes.NewReader(signUpDataJSON)
-		req, _ := http.NewRequest(http.MethodPost, "/test", bodyBytes)
-
-		c.Request = req
+		assert_eq(t, lookups, 2)
+	})
 
-		CreateUser(s)(c)
+	t.Run("Errors of the users service aren't cached", func(t *testing.T) {
+		lookups := 0
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			lookups += 1
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}))
+		defer server.Close()
 
-		assert_eq(t, s.CreateUserCalls, 1)
-		body, _ := io.ReadAll(c.Request.Body)
-		defer c.Request.Body.Close()
+		admins := NewAdminLookup(testUpstream(server.URL))
+		for i := 0; i < 2; i++ {
+			w := CreateTestResponseRecorder()
+			c, _ := gin.CreateTestContext(w)
+			c.Set(claimsKey, auth.Claims{UID: "xyz"})
+			c.Request, _ = http.NewRequest(http.MethodGet, "/test", nil)
 
-		userData := auth.UserModel{UID: "123", Username: "abc", Email: "abc@xyz.com"}
-		userDataJSON, _ := json.Marshal(userData)
+			AuthorizeAdmin(admins)(c)
 
-		assert_eq(t, string(body), string(userDataJSON))
+			assert_eq(t, c.IsAborted(), true)
+		}
+		assert_eq(t, lookups, 2)
 	})
 
-	// TODO: Missing testing that the body contains some context of the error
-	t.Run("If the body contains invalid JSON the middleware aborts and sets the response status to Bad Request", func(t *testing.T) {
+	t.Run("RequireRole lets in users with any of the roles of the route", func(t *testing.T) {
 		w := CreateTestResponseRecorder()
 		c, _ := gin.CreateTestContext(w)
+		c.Set(claimsKey, auth.Claims{UID: "xyz", Custom: map[string]interface{}{"role": auth.RoleTrainer}})
+		c.Request, _ = http.NewRequest(http.MethodGet, "/test", nil)
 
-		s := &AuthTestService{}
+		RequireRole(nil, auth.RoleAdmin, auth.RoleTrainer)(c)
+
+		assert_eq(t, c.IsAborted(), false)
+	})
+
+	t.Run("RequireRole rejects users without the roles of the route with 403", func(t *testing.T) {
+		w := CreateTestResponseRecorder()
+		r := gin.New()
+		r.GET("/test", AuthorizeUser(&AuthTestService{Claims: auth.Claims{UID: "xyz", Custom: map[string]interface{}{"role": auth.RoleAthlete}}}, nil), RequireRole(nil, auth.RoleTrainer))
 		req, _ := http.NewRequest(http.MethodGet, "/test", nil)
-		c.Request = req
-		CreateUser(s)(c)
+		req.Header.Set("Authorization", "abc")
 
-		if !c.IsAborted() {
-			t.Error("The middleware didn't abort")
-		}
+		r.ServeHTTP(w, req)
 
-		c.Writer.WriteHeaderNow()
-		got := w.Result().StatusCode
-		assert_eq(t, got, http.StatusBadRequest)
+		assert_eq(t, w.Code, http.StatusForbidden)
+		assert_eq(t, strings.Contains(w.Body.String(), problem.MissingRole), true)
 	})
-	// TODO: Missing testing that the body contains some context of the error
-	t.Run("If the sign up data in the body is invalid the middleware aborts and sets the response status to Conflict", func(t *testing.T) {
+
+	t.Run("SetRoles sets the roles of the user", func(t *testing.T) {
+		s := &AuthTestService{}
 		w := CreateTestResponseRecorder()
-		c, _ := gin.CreateTestContext(w)
+		r := gin.New()
+		r.PUT("/users/:user_id/roles", SetRoles(s))
+		req, _ := http.NewRequest(http.MethodPut, "/users/xyz/roles", strings.NewReader(`{"roles": ["trainer"]}`))
+
+		r.ServeHTTP(w, req)
+
+		assert_eq(t, w.Code, http.StatusOK)
+		assert_eq(t, s.SetRolesCalls, 1)
+		assert_eq(t, s.Claims.HasRole(auth.RoleTrainer), true)
+	})
 
+	t.Run("SetRoles rejects unknown roles", func(t *testing.T) {
 		s := &AuthTestService{}
-		signUpData := auth.SignUpModel{
-			Email: "abc@xyz.com", Username: "abc", Password: "1",
-		}
-		signUpDataJSON, _ := json.Marshal(signUpData)
-		bodyBytes := bytes.NewReader(signUpDataJSON)
-		req, _ := http.NewRequest(http.MethodGet, "/test", bodyBytes)
-		c.Request = req
-		CreateUser(s)(c)
+		w := CreateTestResponseRecorder()
+		r := gin.New()
+		r.PUT("/users/:user_id/roles", SetRoles(s))
+		req, _ := http.NewRequest(http.MethodPut, "/users/xyz/roles", strings.NewReader(`{"roles": ["owner"]}`))
 
-		if !c.IsAborted() {
-			t.Error("The middleware didn't abort")
-		}
+		r.ServeHTTP(w, req)
 
-		c.Writer.WriteHeaderNow()
-		got := w.Result().StatusCode
-		assert_eq(t, got, http.StatusConflict)
+		assert_eq(t, w.Code, http.StatusBadRequest)
+		assert_eq(t, s.SetRolesCalls, 0)
 	})
 
-	t.Run("Creating user with federated identity, gets the user data from the auth service", func(t *testing.T) {
+	t.Run("SetRoles responds 404 when the user doesn't exist", func(t *testing.T) {
+		s := &AuthTestService{}
 		w := CreateTestResponseRecorder()
-		c, _ := gin.CreateTestContext(w)
+		r := gin.New()
+		r.PUT("/users/:user_id/roles", SetRoles(s))
+		req, _ := http.NewRequest(http.MethodPut, "/users/z/roles", strings.NewReader(`{"roles": ["trainer"]}`))
+
+		r.ServeHTTP(w, req)
+
+		assert_eq(t, w.Code, http.StatusNotFound)
+		assert_eq(t, s.SetRolesCalls, 0)
+	})
 
+	t.Run("SetRoles responds 500 when the user can't be looked up", func(t *testing.T) {
 		s := &AuthTestService{}
-		signUpData := auth.SignUpModel{Federated: true, UID: "a"}
-		signUpDataJSON, _ := json.Marshal(signUpData)
-		bodyBytes := bytes.NewReader(signUpDataJSON)
-		req, _ := http.NewRequest(http.MethodGet, "/test", bodyBytes)
-		c.Request = req
-		CreateUser(s)(c)
-		
-		assert_eq(t, s.GetUserCalls, 1)
-		body, _ := io.ReadAll(c.Request.Body)
-		defer c.Request.Body.Close()
-		userData := auth.UserModel{UID: "a", Username: "user", Email: "email@xyz.com"}
-		userDataJSON, _ := json.Marshal(userData)
-		assert_eq(t, string(body), string(userDataJSON))
+		w := CreateTestResponseRecorder()
+		r := gin.New()
+		r.PUT("/users/:user_id/roles", SetRoles(s))
+		req, _ := http.NewRequest(http.MethodPut, "/users/unreachable/roles", strings.NewReader(`{"roles": ["trainer"]}`))
+
+		r.ServeHTTP(w, req)
+
+		assert_eq(t, w.Code, http.StatusInternalServerError)
+		assert_eq(t, s.SetRolesCalls, 0)
 	})
 }
 
-func TestAuthorizeAdmin(t *testing.T) {
+func TestRequireOwner(t *testing.T) {
 	gin.SetMode(gin.TestMode)
-	t.Run("Authenticate a request from the admin", func(t *testing.T) {
-		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			assert_eq(t, r.URL.String(), "/admins/xyz")
+	t.Run("The owner of the resource in the path is let in", func(t *testing.T) {
+		w := CreateTestResponseRecorder()
+		r := gin.New()
+		r.PUT("/users/:user_id", AuthorizeUser(&AuthTestService{}, nil), RequireOwner(nil, "user_id"))
+		req, _ := http.NewRequest(http.MethodPut, "/users/123", nil)
+		req.Header.Set("Authorization", "abc")
+
+		r.ServeHTTP(w, req)
+
+		assert_eq(t, w.Code, http.StatusOK)
+	})
+
+	t.Run("Other users are rejected with 403", func(t *testing.T) {
+		w := CreateTestResponseRecorder()
+		r := gin.New()
+		r.DELETE("/plans/:trainer_id/:plan_id", AuthorizeUser(&AuthTestService{}, nil), RequireOwner(nil, "trainer_id"))
+		req, _ := http.NewRequest(http.MethodDelete, "/plans/456/1", nil)
+		req.Header.Set("Authorization", "abc")
+
+		r.ServeHTTP(w, req)
+
+		assert_eq(t, w.Code, http.StatusForbidden)
+		assert_eq(t, strings.Contains(w.Body.String(), problem.NotOwner), true)
+	})
+
+	t.Run("Admins act on the resources of any user", func(t *testing.T) {
+		claims := auth.Claims{UID: "123", Custom: map[string]interface{}{"roles": []interface{}{auth.RoleAdmin}}}
+		w := CreateTestResponseRecorder()
+		r := gin.New()
+		r.PUT("/users/:user_id", AuthorizeUser(&AuthTestService{Claims: claims}, nil), RequireOwner(nil, "user_id"))
+		req, _ := http.NewRequest(http.MethodPut, "/users/456", nil)
+		req.Header.Set("Authorization", "abc")
+
+		r.ServeHTTP(w, req)
+
+		assert_eq(t, w.Code, http.StatusOK)
+	})
+
+	t.Run("Admins known by the users service act on the resources of any user", func(t *testing.T) {
+		users := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			assert_eq(t, r.URL.Path, "/admins/123")
 			w.WriteHeader(http.StatusOK)
 		}))
-		defer server.Close()
+		defer users.Close()
 
-		url, _ := url.Parse(server.URL)
 		w := CreateTestResponseRecorder()
-		c, r := gin.CreateTestContext(w)
-		c.Set(uidKey, "xyz")
-		req, _ := http.NewRequest(http.MethodPost, "/test", nil)
-		c.Request = req
+		r := gin.New()
+		r.PUT("/users/:user_id", AuthorizeUser(&AuthTestService{}, nil), RequireOwner(NewAdminLookup(testUpstream(users.URL)), "user_id"))
+		req, _ := http.NewRequest(http.MethodPut, "/users/456", nil)
+		req.Header.Set("Authorization", "abc")
+
+		r.ServeHTTP(w, req)
+
+		assert_eq(t, w.Code, http.StatusOK)
+	})
+}
 
-		AuthorizeAdmin(url)(c)
+func TestAuthorizeService(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	hash := func(key string) string {
+		sum := sha256.Sum256([]byte(key))
+		return hex.EncodeToString(sum[:])
+	}
+	keys := NewServiceKeys([]config.ServiceKey{
+		{ID: "producer-new", Service: "producer", SHA256: hash("new"), Scopes: []string{config.MetricsWriteScope}},
+		{ID: "producer-old", Service: "producer", SHA256: hash("old"), Scopes: []string{config.MetricsWriteScope}, Expires: time.Now().Add(-time.Minute)},
+		{ID: "reader", Service: "reader", SHA256: hash("reader"), Scopes: []string{"metrics:read"}},
+	})
+
+	t.Run("Services with a key with the scope of the route are let in and the key isn't forwarded", func(t *testing.T) {
+		metricsService := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			assert_eq(t, r.Header.Get(apiKeyHeader), "")
+			w.WriteHeader(http.StatusCreated)
+		}))
+		defer metricsService.Close()
+
+		w := CreateTestResponseRecorder()
+		r := gin.New()
+		r.POST("/metrics", AuthorizeService(keys, config.MetricsWriteScope), ReverseProxy(testUpstream(metricsService.URL)))
+		req, _ := http.NewRequest(http.MethodPost, "/metrics", strings.NewReader("{}"))
+		req.Header.Set(apiKeyHeader, "new")
 
 		r.ServeHTTP(w, req)
 
-		if c.IsAborted() {
-			t.Error("The middleware shouldn't abort")
+		assert_eq(t, w.Code, http.StatusCreated)
+	})
+
+	t.Run("Users, unknown and expired keys are rejected with 401 and keys without the scope with 403", func(t *testing.T) {
+		for key, want := range map[string]int{"": http.StatusUnauthorized, "abc": http.StatusUnauthorized, "old": http.StatusUnauthorized, "reader": http.StatusForbidden} {
+			w := CreateTestResponseRecorder()
+			r := gin.New()
+			r.POST("/metrics", AuthorizeService(keys, config.MetricsWriteScope))
+			req, _ := http.NewRequest(http.MethodPost, "/metrics", nil)
+			req.Header.Set("Authorization", "abc")
+			req.Header.Set(apiKeyHeader, key)
+
+			r.ServeHTTP(w, req)
+
+			assert_eq(t, w.Code, want)
 		}
 	})
+}
+
+func TestUserLifecycle(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	signUp := func(t *testing.T, s *AuthTestService, status int, data auth.SignUpModel) int {
+		usersService := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(status)
+		}))
+		defer usersService.Close()
 
-	t.Run("Authenticate a request from the admin, UID was not set, middleware aborts", func(t *testing.T) {
 		w := CreateTestResponseRecorder()
-		c, r := gin.CreateTestContext(w)
-		req, _ := http.NewRequest(http.MethodPost, "/test", nil)
-		c.Request = req
+		r := gin.New()
+		r.POST("/users", CreateUser(s), ReverseProxy(testUpstream(usersService.URL)))
+		body, _ := json.Marshal(data)
+		req, _ := http.NewRequest(http.MethodPost, "/users", bytes.NewReader(body))
+		r.ServeHTTP(w, req)
+		return w.Code
+	}
+	data := auth.SignUpModel{Email: "email@xyz.com", Username: "user", Password: "password1"}
 
-		AuthorizeAdmin(&url.URL{})(c)
+	t.Run("The firebase account is kept when the users service creates the user", func(t *testing.T) {
+		s := &AuthTestService{}
+		assert_eq(t, signUp(t, s, http.StatusCreated, data), http.StatusCreated)
+		assert_eq(t, s.DeleteUserCalls, 0)
+	})
+
+	t.Run("The firebase account is deleted when the users service rejects the user", func(t *testing.T) {
+		for _, status := range []int{http.StatusConflict, http.StatusInternalServerError} {
+			s := &AuthTestService{}
+			assert_eq(t, signUp(t, s, status, data), status)
+			assert_eq(t, s.DeleteUserCalls, 1)
+		}
+	})
+
+	t.Run("Federated accounts aren't deleted when the users service rejects the user", func(t *testing.T) {
+		s := &AuthTestService{}
+		federated := auth.SignUpModel{Email: "email@xyz.com", Username: "user", Federated: true, UID: "a"}
+		assert_eq(t, signUp(t, s, http.StatusConflict, federated), http.StatusConflict)
+		assert_eq(t, s.DeleteUserCalls, 0)
+	})
 
+	deleteUser := func(t *testing.T, s *AuthTestService, status int) int {
+		usersService := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			assert_eq(t, r.Method, http.MethodDelete)
+			assert_eq(t, r.URL.Path, "/users/123")
+			w.WriteHeader(status)
+		}))
+		defer usersService.Close()
+
+		w := CreateTestResponseRecorder()
+		r := gin.New()
+		r.DELETE("/users/:user_id", DeleteUser(s), ReverseProxy(testUpstream(usersService.URL)))
+		req, _ := http.NewRequest(http.MethodDelete, "/users/123", nil)
 		r.ServeHTTP(w, req)
+		return w.Code
+	}
 
-		if !c.IsAborted() {
-			t.Error("The middleware should abort")
+	t.Run("Users are deleted from firebase once deleted from the users service, or if it had already deleted them", func(t *testing.T) {
+		for status, want := range map[int]int{http.StatusNoContent: http.StatusNoContent, http.StatusNotFound: http.StatusNoContent} {
+			s := &AuthTestService{}
+			assert_eq(t, deleteUser(t, s, status), want)
+			assert_eq(t, s.DeleteUserCalls, 1)
 		}
-		c.Writer.WriteHeaderNow()
-		got := w.Result().StatusCode
-		assert_eq(t, got, http.StatusInternalServerError)
 	})
 
-	t.Run("Authenticate a request from the admin, UID was set, but wasn't valid", func(t *testing.T) {
-		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			assert_eq(t, r.URL.String(), "/admins/xyz")
-			w.WriteHeader(http.StatusUnauthorized)
+	t.Run("Users aren't deleted from firebase when the users service fails to delete them", func(t *testing.T) {
+		s := &AuthTestService{}
+		assert_eq(t, deleteUser(t, s, http.StatusInternalServerError), http.StatusInternalServerError)
+		assert_eq(t, s.DeleteUserCalls, 0)
+	})
+
+	t.Run("A deletion that fails in firebase is reported as partial", func(t *testing.T) {
+		usersService := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusOK)
+			w.Write([]byte(`{"deleted": true}`))
 		}))
-		defer server.Close()
+		defer usersService.Close()
 
-		url, _ := url.Parse(server.URL)
+		s := &AuthTestService{DeleteUserErr: errors.New("firebase unreachable")}
 		w := CreateTestResponseRecorder()
-		c, r := gin.CreateTestContext(w)
-		c.Set(uidKey, "xyz")
-		req, _ := http.NewRequest(http.MethodPost, "/test", nil)
-		c.Request = req
+		r := gin.New()
+		r.DELETE("/users/:user_id", DeleteUser(s), ReverseProxy(testUpstream(usersService.URL)))
+		req, _ := http.NewRequest(http.MethodDelete, "/users/123", nil)
+		r.ServeHTTP(w, req)
+
+		assertProblem(t, w, http.StatusBadGateway, problem.PartialDeletion)
+		assert_eq(t, s.DeleteUserCalls, 1)
+	})
+
+	t.Run("Retrying a partial deletion completes it and responds No Content", func(t *testing.T) {
+		deleted := false
+		usersService := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if deleted {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			deleted = true
+			w.WriteHeader(http.StatusNoContent)
+		}))
+		defer usersService.Close()
+
+		s := &AuthTestService{DeleteUserErr: errors.New("firebase unreachable")}
+		r := gin.New()
+		r.DELETE("/users/:user_id", DeleteUser(s), ReverseProxy(testUpstream(usersService.URL)))
+		send := func() *TestResponseRecorder {
+			w := CreateTestResponseRecorder()
+			req, _ := http.NewRequest(http.MethodDelete, "/users/123", nil)
+			r.ServeHTTP(w, req)
+			return w
+		}
 
-		AuthorizeAdmin(url)(c)
+		assertProblem(t, send(), http.StatusBadGateway, problem.PartialDeletion)
+		s.DeleteUserErr = nil
+		w := send()
+		assert_eq(t, w.Code, http.StatusNoContent)
+		assert_eq(t, w.Body.Len(), 0)
+		assert_eq(t, s.DeleteUserCalls, 2)
+	})
 
+	t.Run("Handlers after DeleteUser can't hijack the connection past the buffered response", func(t *testing.T) {
+		var hijackErr error
+		w := CreateTestResponseRecorder()
+		r := gin.New()
+		r.DELETE("/users/:user_id", DeleteUser(&AuthTestService{}), func(c *gin.Context) {
+			_, _, hijackErr = c.Writer.Hijack()
+			assert_eq(t, c.Writer.Pusher() == nil, true)
+			c.Status(http.StatusNoContent)
+		})
+		req, _ := http.NewRequest(http.MethodDelete, "/users/123", nil)
 		r.ServeHTTP(w, req)
 
-		if !c.IsAborted() {
-			t.Error("The middleware should abort")
-		}
+		assert_eq(t, hijackErr != nil, true)
+		assert_eq(t, w.Code, http.StatusNoContent)
+	})
 
-		got := w.Code
-		assert_eq(t, got, http.StatusUnauthorized)
+	t.Run("The response of the users service is forwarded once the user is deleted from firebase", func(t *testing.T) {
+		usersService := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("X-Deleted", "123")
+			w.WriteHeader(http.StatusOK)
+			w.Write([]byte("deleted"))
+		}))
+		defer usersService.Close()
+
+		w := CreateTestResponseRecorder()
+		r := gin.New()
+		r.DELETE("/users/:user_id", DeleteUser(&AuthTestService{}), ReverseProxy(testUpstream(usersService.URL)))
+		req, _ := http.NewRequest(http.MethodDelete, "/users/123", nil)
+		r.ServeHTTP(w, req)
+
+		assert_eq(t, w.Code, http.StatusOK)
+		assert_eq(t, w.Header().Get("X-Deleted"), "123")
+		assert_eq(t, w.Body.String(), "deleted")
+	})
+
+	t.Run("Sign ups are kept when the users service times out, it may have created the user", func(t *testing.T) {
+		release := make(chan struct{})
+		usersService := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			<-release
+		}))
+		defer usersService.Close()
+		defer close(release)
+
+		s := &AuthTestService{}
+		w := CreateTestResponseRecorder()
+		r := gin.New()
+		r.POST("/users", Timeout(config.Timeouts{Total: 20 * time.Millisecond}), CreateUser(s), ReverseProxy(testUpstream(usersService.URL)))
+		body, _ := json.Marshal(data)
+		req, _ := http.NewRequest(http.MethodPost, "/users", bytes.NewReader(body))
+		r.ServeHTTP(w, req)
+
+		assert_eq(t, w.Code, http.StatusGatewayTimeout)
+		assert_eq(t, s.DeleteUserCalls, 0)
 	})
 }
 
@@ -473,100 +2188,101 @@ func TestBlockUsersInAuthService(t *testing.T) {
 
 func TestLoggingMiddleware(t *testing.T) {
 	gin.SetMode(gin.TestMode)
-	t.Run("Log data", func(t *testing.T) {
+	type entry struct {
+		Msg       string   `json:"msg"`
+		Method    string   `json:"method"`
+		Route     string   `json:"route"`
+		URI       string   `json:"uri"`
+		Status    int      `json:"status"`
+		Duration  *float64 `json:"duration_ms"`
+		BytesIn   int64    `json:"bytes_in"`
+		BytesOut  int64    `json:"bytes_out"`
+		Upstream  string   `json:"upstream"`
+		Instance  string   `json:"instance"`
+		UID       string   `json:"uid"`
+		RequestID string   `json:"request_id"`
+	}
+	// Sends a request through the logger and returns the entries logged
+	send := func(settings config.AccessLog, uri string, handlers ...gin.HandlerFunc) []entry {
 		// This is nasty
 		buf := bytes.Buffer{}
 		log.SetOutput(&buf)
+		defer log.SetOutput(io.Discard)
 		formatter := &log.JSONFormatter{}
 		formatter.DisableTimestamp = true
 		log.SetFormatter(formatter)
 
-		w := CreateTestResponseRecorder()
-		c, _ := gin.CreateTestContext(w)
-		req, _ := http.NewRequest(http.MethodGet, "www.example.com/test", nil)
-		req.RequestURI = "uri"
-		c.Writer.WriteHeader(http.StatusOK)
-		c.Request = req
-
-		Logger()(c)
-
-		want := "{\"client_ip\":\"\",\"level\":\"info\",\"method\":\"GET\",\"msg\":\"HTTP Request\",\"status\":200,\"uri\":\"uri\"}\n"
-		assert_eq(t, buf.String(), want)
-	})
-}
-
-
-func TestCreateAdmin(t *testing.T) {
-	gin.SetMode(gin.TestMode)
-	t.Run("Send valid sign up data, create an admin and put the admin data in the request body", func(t *testing.T) {
-		w := CreateTestResponseRecorder()
-		c, _ := gin.CreateTestContext(w)
-
-		s := &AuthTestService{}
-
-		signUpData := auth.SignUpModel{
-			Email: "abc@xyz.com", Username: "abc", Password: "123",
+		_, r := gin.CreateTestContext(CreateTestResponseRecorder())
+		r.POST("/test/:id", append([]gin.HandlerFunc{RequestID(), Logger(settings)}, handlers...)...)
+		req, _ := http.NewRequest(http.MethodPost, uri, bytes.NewBufferString("data"))
+		req.RequestURI = uri
+		req.Header.Set("Authorization", "abc")
+		req.Header.Set("X-Request-ID", "request-1")
+		r.ServeHTTP(CreateTestResponseRecorder(), req)
+
+		var entries []entry
+		decoder := json.NewDecoder(&buf)
+		for decoder.More() {
+			var e entry
+			decoder.Decode(&e)
+			if e.Msg == "HTTP Request" {
+				entries = append(entries, e)
+			}
 		}
-		signUpDataJSON, _ := json.Marshal(signUpData)
-		bodyBytes := bytes.NewReader(signUpDataJSON)
-		req, _ := http.NewRequest(http.MethodPost, "/test", bodyBytes)
-
-		c.Request = req
-
-		CreateAdmin(s)(c)
-
-		assert_eq(t, s.CreateUserCalls, 1)
-		body, _ := io.ReadAll(c.Request.Body)
-		defer c.Request.Body.Close()
-
-		adminData := auth.UserModel{UID: "123", Username: "abc", Email: "abc@xyz.com"}
-		adminDataJSON, _ := json.Marshal(adminData)
-
-		assert_eq(t, string(body), string(adminDataJSON))
-	})
-
-	// TODO: Missing testing that the body contains some context of the error
-	t.Run("If the body contains invalid JSON the middleware aborts and sets the response status to Bad Request", func(t *testing.T) {
-		w := CreateTestResponseRecorder()
-		c, _ := gin.CreateTestContext(w)
+		return entries
+	}
 
-		s := &AuthTestService{}
-		req, _ := http.NewRequest(http.MethodGet, "/test", nil)
-		c.Request = req
-		CreateAdmin(s)(c)
+	t.Run("Log data once the request was handled, with its status, size, upstream and user", func(t *testing.T) {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusCreated)
+			w.Write([]byte("created"))
+		}))
+		defer server.Close()
+		serverURL, _ := url.Parse(server.URL)
 
-		if !c.IsAborted() {
-			t.Error("The middleware didn't abort")
+		entries := send(config.AccessLog{SampleRate: 1}, "/test/1?page=2",
+			AuthorizeUser(&AuthTestService{}, nil), ReverseProxy(testUpstream(server.URL)))
+		if len(entries) != 1 {
+			t.Fatalf("Got %d entries, want 1", len(entries))
 		}
-
-		c.Writer.WriteHeaderNow()
-		got := w.Result().StatusCode
-		assert_eq(t, got, http.StatusBadRequest)
+		e := entries[0]
+		assert_eq(t, e.Method, "POST")
+		assert_eq(t, e.Route, "/test/:id")
+		assert_eq(t, e.URI, "/test/1?page=2")
+		assert_eq(t, e.Status, http.StatusCreated)
+		assert_eq(t, e.BytesIn, 4)
+		assert_eq(t, e.BytesOut, 7)
+		assert_eq(t, e.Upstream, "test")
+		assert_eq(t, e.Instance, serverURL.Host)
+		assert_eq(t, e.UID, "123")
+		assert_eq(t, e.RequestID, "request-1")
+		assert_eq(t, e.Duration != nil, true)
 	})
-	// TODO: Missing testing that the body contains some context of the error
-	t.Run("If the sign up data in the body is invalid the middleware aborts and sets the response status to Conflict", func(t *testing.T) {
-		w := CreateTestResponseRecorder()
-		c, _ := gin.CreateTestContext(w)
 
-		s := &AuthTestService{}
-		signUpData := auth.SignUpModel{
-			Email: "abc@xyz.com", Username: "abc", Password: "1",
-		}
-		signUpDataJSON, _ := json.Marshal(signUpData)
-		bodyBytes := bytes.NewReader(signUpDataJSON)
-		req, _ := http.NewRequest(http.MethodGet, "/test", bodyBytes)
-		c.Request = req
-		CreateAdmin(s)(c)
+	t.Run("Requests are sampled, but server errors are always logged", func(t *testing.T) {
+		ok := func(c *gin.Context) { c.Status(http.StatusOK) }
+		failed := func(c *gin.Context) { c.Status(http.StatusBadGateway) }
+		assert_eq(t, len(send(config.AccessLog{SampleRate: 0}, "/test/1", ok)), 0)
+		assert_eq(t, len(send(config.AccessLog{SampleRate: 0}, "/test/1", failed)), 1)
+	})
 
-		if !c.IsAborted() {
-			t.Error("The middleware didn't abort")
+	t.Run("Redacted fields and query parameters are hidden", func(t *testing.T) {
+		entries := send(config.AccessLog{SampleRate: 1, Redact: []string{"uid", "token"}}, "/test/1?token=secret&page=2",
+			AuthorizeUser(&AuthTestService{}, nil))
+		if len(entries) != 1 {
+			t.Fatalf("Got %d entries, want 1", len(entries))
 		}
-
-		c.Writer.WriteHeaderNow()
-		got := w.Result().StatusCode
-		assert_eq(t, got, http.StatusConflict)
+		assert_eq(t, entries[0].UID, "[REDACTED]")
+		assert_eq(t, strings.Contains(entries[0].URI, "secret"), false)
+		assert_eq(t, strings.Contains(entries[0].URI, "page=2"), true)
 	})
 }
+
+func testUpstream(rawURL string) *upstream.Upstream {
+	u, _ := url.Parse(rawURL)
+	return upstream.New("test", []*url.URL{u}, upstream.Options{})
+}
+
 // The types below are necessary for tests to run Gin requires that
 // the recorder implements the CloseNotify interface. So we generated
 // a wrapper that implements it.
@@ -592,29 +2308,53 @@ func CreateTestResponseRecorder() *TestResponseRecorder {
 
 type AuthTestService struct {
 	CreateUserCalls     int
-	GetUserCalls int
+	GetUserCalls        int
 	SetBlockStatusCalls int
+	VerifyTokenCalls    int
+	SetRolesCalls       int
+	DeleteUserCalls     int
+	DeleteUserErr       error
+	SetRolesErr         error
+	// Set once a user is blocked, its tokens fail the revocation check
+	Revoked bool
+	// Claims of the valid tokens, UID 123 when not set
+	Claims auth.Claims
 }
 
 func (a *AuthTestService) CreateUser(s auth.SignUpModel) (auth.UserModel, error) {
 	a.CreateUserCalls += 1
-	if len(s.Password) < 3 {
-		return auth.UserModel{}, errors.New("too short")
+	if s.Email == "taken@xyz.com" {
+		return auth.UserModel{}, errors.New("email already in use")
 	}
 	return auth.UserModel{UID: "123", Username: "abc", Email: "abc@xyz.com"}, nil
 }
 
-func (a *AuthTestService) VerifyToken(token string) (string, error) {
-	if token != "abc" {
-		return "", errors.New("unauthorized")
+func (a *AuthTestService) VerifyToken(token string) (auth.Claims, error) {
+	a.VerifyTokenCalls += 1
+	if token != "abc" && !strings.HasSuffix(token, ".abc") {
+		return auth.Claims{}, errors.New("unauthorized")
+	}
+	if a.Claims.UID != "" {
+		return a.Claims, nil
+	}
+	return auth.Claims{UID: "123"}, nil
+}
+
+func (a *AuthTestService) VerifyTokenAndCheckRevoked(token string) (auth.Claims, error) {
+	claims, err := a.VerifyToken(token)
+	if err == nil && a.Revoked {
+		return auth.Claims{}, errors.New("token revoked")
 	}
-	return "123", nil
+	return claims, err
 }
 
 func (a *AuthTestService) GetUser(uid string) (auth.UserModel, error) {
 	a.GetUserCalls += 1
-	if uid == "z" {
-		return auth.UserModel{}, errors.New("user doesn't exist")
+	switch uid {
+	case "z":
+		return auth.UserModel{}, fmt.Errorf("%w: %s", auth.ErrUserNotFound, uid)
+	case "unreachable":
+		return auth.UserModel{}, errors.New("firebase unreachable")
 	}
 	return auth.UserModel{
 		Email:    "email@xyz.com",
@@ -625,5 +2365,24 @@ func (a *AuthTestService) GetUser(uid string) (auth.UserModel, error) {
 
 func (a *AuthTestService) SetBlockStatus(uid string, blocked bool) error {
 	a.SetBlockStatusCalls += 1
+	a.Revoked = a.Revoked || blocked
+	return nil
+}
+
+func (a *AuthTestService) SetRoles(uid string, roles []string) error {
+	a.SetRolesCalls += 1
+	if a.SetRolesErr != nil {
+		return a.SetRolesErr
+	}
+	a.Claims = auth.Claims{UID: uid, Custom: map[string]interface{}{"roles": roles}}
+	return nil
+}
+
+func (a *AuthTestService) DeleteUser(uid string) error {
+	a.DeleteUserCalls += 1
+	return a.DeleteUserErr
+}
+
+func (a *AuthTestService) Ready() error {
 	return nil
 }
@@ -1,5 +1,11 @@
 package auth
 
+import (
+	"errors"
+	"strings"
+	"time"
+)
+
 type SignUpModel struct {
 	Email     string `json:"email"`
 	Username  string `json:"username"`
@@ -8,13 +14,32 @@ type SignUpModel struct {
 	UID       string `json:"uid"`
 }
 
+// Returned by GetUser when there's no user with the UID
+var ErrUserNotFound = errors.New("user not found")
+
+// Returns true if the error is caused by the user not existing
+func IsUserNotFound(err error) bool {
+	return errors.Is(err, ErrUserNotFound)
+}
+
 type Service interface {
 	CreateUser(data SignUpModel) (UserModel, error)
-	// May change it's return type in the future depending in the
-	// info needed when validatin users
-	VerifyToken(token string) (string, error)
+	// Returns the claims of the token if it's valid
+	VerifyToken(token string) (Claims, error)
+	// Like VerifyToken but also rejects tokens revoked, or of disabled
+	// users, at the cost of a request to the auth provider
+	VerifyTokenAndCheckRevoked(token string) (Claims, error)
+	// Returns ErrUserNotFound if there's no user with the UID, other
+	// errors mean the auth provider couldn't be reached
 	GetUser(uid string) (UserModel, error)
 	SetBlockStatus(uid string, blocked bool) error
+	// Sets the roles custom claim of the user, tokens issued from then
+	// on carry them
+	SetRoles(uid string, roles []string) error
+	// Deletes the user, deleting one that doesn't exist isn't an error
+	DeleteUser(uid string) error
+	// Returns nil if the service is ready to be used
+	Ready() error
 }
 
 type UserModel struct {
@@ -22,3 +47,69 @@ type UserModel struct {
 	Username string `json:"username"`
 	UID      string `json:"uid"`
 }
+
+// Roles a user may have, carried in the roles custom claim
+const (
+	RoleAdmin   = "admin"
+	RoleTrainer = "trainer"
+	RoleAthlete = "athlete"
+	RoleSupport = "support"
+)
+
+var roles = map[string]bool{RoleAdmin: true, RoleTrainer: true, RoleAthlete: true, RoleSupport: true}
+
+// Returns true if role is one of the known roles
+func ValidRole(role string) bool {
+	return roles[role]
+}
+
+// Returns true if the user has any of the roles
+func (c Claims) HasRole(roles ...string) bool {
+	for _, have := range c.Roles() {
+		for _, want := range roles {
+			if have == want {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Claims of a verified token
+type Claims struct {
+	UID           string
+	Email         string
+	EmailVerified bool
+	// How the user signed in, e.g. password or google.com
+	Provider string
+	AuthTime time.Time
+	Expires  time.Time
+	// Claims set by the gateway or the services on the user, e.g. roles
+	Custom map[string]interface{}
+}
+
+// Returns the roles of the user, from the roles custom claim, a list,
+// or the role one, a single role
+func (c Claims) Roles() []string {
+	var roles []string
+	switch value := c.Custom["roles"].(type) {
+	case []interface{}:
+		for _, role := range value {
+			if role, ok := role.(string); ok && role != "" {
+				roles = append(roles, role)
+			}
+		}
+	case []string:
+		roles = append(roles, value...)
+	case string:
+		for _, role := range strings.Split(value, ",") {
+			if role = strings.TrimSpace(role); role != "" {
+				roles = append(roles, role)
+			}
+		}
+	}
+	if role, ok := c.Custom["role"].(string); ok && role != "" {
+		roles = append(roles, role)
+	}
+	return roles
+}
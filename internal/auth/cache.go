@@ -0,0 +1,172 @@
+package auth
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"sync"
+	"time"
+
+	"fiufit.api.gateway/internal/metrics"
+)
+
+// TokenCache decorates a Service, remembering the users of the tokens
+// it verified so they aren't verified again until the token expires or
+// ttl elapses. Tokens are kept hashed and the least recently used ones
+// are evicted once the cache is full.
+type TokenCache struct {
+	Service
+	mu      sync.Mutex
+	entries map[[sha256.Size]byte]*list.Element
+	order   *list.List // Most recently used first
+	size    int
+	ttl     time.Duration
+}
+
+type cachedToken struct {
+	key     [sha256.Size]byte
+	claims  Claims
+	expires time.Time
+}
+
+// Returns s with a cache of size tokens in front of it, or s itself if
+// size isn't positive
+func NewTokenCache(s Service, size int, ttl time.Duration) Service {
+	if size <= 0 {
+		return s
+	}
+	return &TokenCache{
+		Service: s,
+		entries: make(map[[sha256.Size]byte]*list.Element),
+		order:   list.New(),
+		size:    size,
+		ttl:     ttl,
+	}
+}
+
+func (c *TokenCache) VerifyToken(token string) (Claims, error) {
+	key := sha256.Sum256([]byte(token))
+	if claims, found := c.get(key); found {
+		metrics.TokenCacheLookups.Inc("hit")
+		return claims, nil
+	}
+	metrics.TokenCacheLookups.Inc("miss")
+
+	claims, err := c.Service.VerifyToken(token)
+	if err != nil {
+		return Claims{}, err
+	}
+	expires := time.Now().Add(c.ttl)
+	if !claims.Expires.IsZero() && claims.Expires.Before(expires) {
+		expires = claims.Expires
+	}
+	c.put(cachedToken{key: key, claims: claims, expires: expires})
+	return claims, nil
+}
+
+// Revocation can't be cached, the token is always verified by the
+// decorated service
+func (c *TokenCache) VerifyTokenAndCheckRevoked(token string) (Claims, error) {
+	metrics.TokenCacheLookups.Inc("bypass")
+	return c.Service.VerifyTokenAndCheckRevoked(token)
+}
+
+// Forgets the tokens of the user once it's blocked, so they stop being
+// accepted right away
+func (c *TokenCache) SetBlockStatus(uid string, blocked bool) error {
+	err := c.Service.SetBlockStatus(uid, blocked)
+	if err == nil && blocked {
+		c.forget(uid)
+	}
+	return err
+}
+
+// Forgets the tokens of the user once it's deleted
+func (c *TokenCache) DeleteUser(uid string) error {
+	err := c.Service.DeleteUser(uid)
+	if err == nil {
+		c.forget(uid)
+	}
+	return err
+}
+
+func (c *TokenCache) get(key [sha256.Size]byte) (Claims, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	element, found := c.entries[key]
+	if !found {
+		return Claims{}, false
+	}
+	entry := element.Value.(cachedToken)
+	if !time.Now().Before(entry.expires) {
+		c.remove(element)
+		return Claims{}, false
+	}
+	c.order.MoveToFront(element)
+	return entry.claims, true
+}
+
+func (c *TokenCache) put(entry cachedToken) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if element, found := c.entries[entry.key]; found {
+		element.Value = entry
+		c.order.MoveToFront(element)
+		return
+	}
+	c.entries[entry.key] = c.order.PushFront(entry)
+	if c.order.Len() > c.size {
+		c.remove(c.order.Back())
+	}
+	metrics.TokenCacheEntries.Set(float64(c.order.Len()))
+}
+
+func (c *TokenCache) forget(uid string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for element := c.order.Front(); element != nil; {
+		next := element.Next()
+		if element.Value.(cachedToken).claims.UID == uid {
+			c.remove(element)
+		}
+		element = next
+	}
+}
+
+func (c *TokenCache) remove(element *list.Element) {
+	c.order.Remove(element)
+	delete(c.entries, element.Value.(cachedToken).key)
+	metrics.TokenCacheEntries.Set(float64(c.order.Len()))
+}
+
+// Returns the service verifying every token with s, skipping its cache.
+// Sensitive routes use it so a revoked token is rejected right away.
+func Uncached(s Service) Service {
+	if cache, ok := s.(*TokenCache); ok {
+		return uncached{cache.Service}
+	}
+	return s
+}
+
+type uncached struct {
+	Service
+}
+
+func (u uncached) VerifyToken(token string) (Claims, error) {
+	metrics.TokenCacheLookups.Inc("bypass")
+	return u.Service.VerifyToken(token)
+}
+
+// Returns the service verifying every token with s and rejecting the
+// revoked ones. Admin and write routes use it so blocking a user takes
+// effect right away.
+func CheckRevoked(s Service) Service {
+	return revocationChecked{s}
+}
+
+type revocationChecked struct {
+	Service
+}
+
+func (r revocationChecked) VerifyToken(token string) (Claims, error) {
+	return r.Service.VerifyTokenAndCheckRevoked(token)
+}
@@ -2,9 +2,13 @@ package auth
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"time"
 
 	firebase "firebase.google.com/go/v4"
 	"firebase.google.com/go/v4/auth"
+	"fiufit.api.gateway/internal/config"
 	"google.golang.org/api/option"
 )
 
@@ -15,10 +19,33 @@ type Firebase struct {
 
 //type FirebaseAuth
 
-func GetFirebase(ctx context.Context) (*Firebase, error) {
-	// TODO change to env
-	opt := option.WithCredentialsFile("firebase.json")
-	app, err := firebase.NewApp(ctx, nil, opt)
+// Returns nil if the Firebase client was initialised
+func (f *Firebase) Ready() error {
+	if f == nil || f.authClient == nil {
+		return errors.New("firebase client not initialised")
+	}
+	return nil
+}
+
+// Returns the Firebase client authenticated with the configured
+// credentials, or application default credentials if there are none.
+// In emulator mode the SDK talks to FIREBASE_AUTH_EMULATOR_HOST and no
+// credentials are needed.
+func GetFirebase(ctx context.Context, settings config.Firebase) (*Firebase, error) {
+	var opts []option.ClientOption
+	switch {
+	case settings.EmulatorHost != "":
+		opts = append(opts, option.WithoutAuthentication())
+	case settings.CredentialsJSON != "":
+		opts = append(opts, option.WithCredentialsJSON([]byte(settings.CredentialsJSON)))
+	case settings.CredentialsFile != "":
+		opts = append(opts, option.WithCredentialsFile(settings.CredentialsFile))
+	}
+	var firebaseConfig *firebase.Config
+	if settings.ProjectID != "" {
+		firebaseConfig = &firebase.Config{ProjectID: settings.ProjectID}
+	}
+	app, err := firebase.NewApp(ctx, firebaseConfig, opts...)
 	if err != nil {
 		return nil, err
 	}
@@ -49,23 +76,59 @@ func (f *Firebase) CreateUser(userData SignUpModel) (UserModel, error) {
 	return user, err
 }
 
-func (f *Firebase) VerifyToken(token string) (string, error) {
+func (f *Firebase) VerifyToken(token string) (Claims, error) {
 	ctx := context.Background()
-	// TODO: Decide whether or not to use CheckRevoked
 	tokenData, err := f.authClient.VerifyIDToken(ctx, token)
 	if err != nil {
-		return "", err
+		return Claims{}, err
+	}
+	return claimsOf(tokenData), nil
+}
+
+func (f *Firebase) VerifyTokenAndCheckRevoked(token string) (Claims, error) {
+	ctx := context.Background()
+	tokenData, err := f.authClient.VerifyIDTokenAndCheckRevoked(ctx, token)
+	if err != nil {
+		return Claims{}, err
+	}
+	return claimsOf(tokenData), nil
+}
+
+// Claims set by Firebase on every token, the rest are custom claims
+var firebaseClaims = map[string]bool{
+	"iss": true, "aud": true, "sub": true, "iat": true, "exp": true,
+	"auth_time": true, "user_id": true, "email": true,
+	"email_verified": true, "firebase": true, "name": true,
+	"picture": true, "phone_number": true,
+}
+
+func claimsOf(token *auth.Token) Claims {
+	claims := Claims{
+		UID:      token.UID,
+		Provider: token.Firebase.SignInProvider,
+		AuthTime: time.Unix(token.AuthTime, 0),
+		Expires:  time.Unix(token.Expires, 0),
+		Custom:   make(map[string]interface{}),
 	}
-	return tokenData.UID, nil
+	claims.Email, _ = token.Claims["email"].(string)
+	claims.EmailVerified, _ = token.Claims["email_verified"].(bool)
+	for name, value := range token.Claims {
+		if !firebaseClaims[name] {
+			claims.Custom[name] = value
+		}
+	}
+	return claims
 }
 
 func (f *Firebase) GetUser(uid string) (UserModel, error) {
 	ctx := context.Background()
 	user, err := f.authClient.GetUser(ctx, uid)
+	if auth.IsUserNotFound(err) {
+		return UserModel{}, fmt.Errorf("%w: %s", ErrUserNotFound, uid)
+	}
 	if err != nil {
-		return UserModel{}, nil
+		return UserModel{}, err
 	}
-	
 	return UserModel{
 		Email:    user.Email,
 		Username: user.DisplayName,
@@ -80,5 +143,38 @@ func (f *Firebase) SetBlockStatus(uid string, blocked bool) error {
 	if err != nil {
 		return err
 	}
+	if blocked {
+		// Tokens already issued are rejected from now on by the routes
+		// checking revocation, and can't be refreshed
+		return f.authClient.RevokeRefreshTokens(ctx, uid)
+	}
 	return nil
 }
+
+func (f *Firebase) DeleteUser(uid string) error {
+	err := f.authClient.DeleteUser(context.Background(), uid)
+	if auth.IsUserNotFound(err) {
+		return nil
+	}
+	return err
+}
+
+// Sets the roles keeping the rest of the custom claims of the user
+func (f *Firebase) SetRoles(uid string, roles []string) error {
+	for _, role := range roles {
+		if !ValidRole(role) {
+			return fmt.Errorf("unknown role %q", role)
+		}
+	}
+	ctx := context.Background()
+	user, err := f.authClient.GetUser(ctx, uid)
+	if err != nil {
+		return err
+	}
+	claims := make(map[string]interface{}, len(user.CustomClaims)+1)
+	for name, value := range user.CustomClaims {
+		claims[name] = value
+	}
+	claims["roles"] = roles
+	return f.authClient.SetCustomUserClaims(ctx, uid, claims)
+}
@@ -0,0 +1,92 @@
+package auth
+
+import (
+	"fmt"
+	"net/mail"
+	"unicode"
+
+	"fiufit.api.gateway/internal/problem"
+)
+
+const (
+	minUsernameLength = 3
+	maxUsernameLength = 30
+	minPasswordLength = 8
+	maxPasswordLength = 128
+)
+
+// Rule a field of the sign up data must follow
+type signUpRule struct {
+	field string
+	// Returns why the field isn't valid, empty if it is
+	check func(data SignUpModel) string
+}
+
+// Federated sign ins are already in firebase, only their UID is needed.
+// The rest of the fields are checked for the sign ups with a password.
+var signUpRules = []signUpRule{
+	{"uid", func(data SignUpModel) string {
+		if data.Federated && data.UID == "" {
+			return "required for federated sign ups"
+		}
+		return ""
+	}},
+	{"email", withPassword(func(data SignUpModel) string {
+		if data.Email == "" {
+			return "required"
+		}
+		address, err := mail.ParseAddress(data.Email)
+		if err != nil || address.Address != data.Email {
+			return "not a valid email address"
+		}
+		return ""
+	})},
+	{"username", withPassword(func(data SignUpModel) string {
+		length := len([]rune(data.Username))
+		if length < minUsernameLength || length > maxUsernameLength {
+			return fmt.Sprintf("must have between %d and %d characters", minUsernameLength, maxUsernameLength)
+		}
+		for _, r := range data.Username {
+			if !unicode.IsLetter(r) && !unicode.IsDigit(r) && r != '_' && r != '.' && r != '-' {
+				return "may only have letters, digits, '_', '.' and '-'"
+			}
+		}
+		return ""
+	})},
+	{"password", withPassword(func(data SignUpModel) string {
+		length := len([]rune(data.Password))
+		if length < minPasswordLength || length > maxPasswordLength {
+			return fmt.Sprintf("must have between %d and %d characters", minPasswordLength, maxPasswordLength)
+		}
+		var letter, digit bool
+		for _, r := range data.Password {
+			letter = letter || unicode.IsLetter(r)
+			digit = digit || unicode.IsDigit(r)
+		}
+		if !letter || !digit {
+			return "must have letters and digits"
+		}
+		return ""
+	})},
+}
+
+func withPassword(check func(data SignUpModel) string) func(data SignUpModel) string {
+	return func(data SignUpModel) string {
+		if data.Federated {
+			return ""
+		}
+		return check(data)
+	}
+}
+
+// Returns the fields of the sign up data that aren't valid, none if
+// it's valid
+func (data SignUpModel) Validate() []problem.FieldError {
+	var errs []problem.FieldError
+	for _, rule := range signUpRules {
+		if reason := rule.check(data); reason != "" {
+			errs = append(errs, problem.FieldError{Field: rule.field, Reason: reason})
+		}
+	}
+	return errs
+}
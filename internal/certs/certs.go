@@ -0,0 +1,136 @@
+package certs
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Time between checks for a new certificate
+const pollInterval = 10 * time.Second
+
+// Reloader serves the certificate in a pair of files, loading it again
+// when they change so it can be renewed without restarting the gateway
+type Reloader struct {
+	certFile string
+	keyFile  string
+	mu       sync.RWMutex
+	cert     *tls.Certificate
+	modified time.Time
+}
+
+func NewReloader(certFile, keyFile string) (*Reloader, error) {
+	r := &Reloader{certFile: certFile, keyFile: keyFile}
+	if err := r.load(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *Reloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.cert, nil
+}
+
+// Checks the files for changes until the context is done. A certificate
+// that can't be loaded is logged and the current one is kept.
+func (r *Reloader) Watch(ctx context.Context) {
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if r.lastModified().Equal(r.current()) {
+				continue
+			}
+			if err := r.load(); err != nil {
+				log.WithFields(log.Fields{"error": err.Error()}).Error("Couldn't reload TLS certificate, keeping current one")
+				continue
+			}
+			log.WithFields(log.Fields{"cert_file": r.certFile}).Info("TLS certificate reloaded")
+		}
+	}
+}
+
+func (r *Reloader) load() error {
+	modified := r.lastModified()
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.cert = &cert
+	r.modified = modified
+	return nil
+}
+
+func (r *Reloader) current() time.Time {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.modified
+}
+
+// Returns the latest modification time of the pair of files
+func (r *Reloader) lastModified() time.Time {
+	var latest time.Time
+	for _, path := range []string{r.certFile, r.keyFile} {
+		if info, err := os.Stat(path); err == nil && info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest
+}
+
+// Returns the TLS configuration of the gateway listener, nil when TLS is
+// disabled. Clients must present a certificate signed by the client CA
+// when one is configured.
+func ServerConfig(ctx context.Context, certFile, keyFile, clientCAFile string) (*tls.Config, error) {
+	if certFile == "" {
+		return nil, nil
+	}
+	reloader, err := NewReloader(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	go reloader.Watch(ctx)
+
+	tlsConfig := &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: reloader.GetCertificate,
+		NextProtos:     []string{"h2", "http/1.1"},
+	}
+	if clientCAFile != "" {
+		pool, err := LoadPool(clientCAFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.ClientCAs = pool
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return tlsConfig, nil
+}
+
+// Returns a pool with the PEM certificates in the file
+func LoadPool(path string) (*x509.CertPool, error) {
+	pem, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		errorMsg := fmt.Sprintf("No certificates found in %s", path)
+		return nil, errors.New(errorMsg)
+	}
+	return pool, nil
+}
@@ -4,9 +4,10 @@ import (
 	"errors"
 	"fmt"
 	log "github.com/sirupsen/logrus"
-	"net/url"
 	"os"
 	"strconv"
+	"strings"
+	"time"
 )
 
 const (
@@ -25,31 +26,38 @@ var urlEnvVariables = map[int]string{
 
 const ServiceName = "service-external-gateway"
 
-type Services map[int]*url.URL
-
 type Config struct {
 	URLS            Services
 	LogLevel        log.Level
 	IsDevEnviroment bool
+	// Routes loaded from the route manifest, or the default ones when
+	// it doesn't define any
+	Routes     []Route
+	RateLimit  RateLimit
+	AccessLog  AccessLog
+	Tracing    Tracing
+	Server     Server
+	Firebase   Firebase
+	TokenCache TokenCache
+	// Time the result of a readiness check is reused
+	ReadyCacheTTL time.Duration
+	// Time the readiness checks may take
+	ReadyTimeout time.Duration
+	// Key the user headers forwarded to the services are signed with,
+	// they aren't signed when empty
+	UserHeadersSecret string
+	// Token required to read /internal/metrics outside the ops listener,
+	// the endpoint is only served on the ops listener when empty
+	MetricsToken string
+	// API keys internal services authenticate with
+	ServiceKeys []ServiceKey
 }
 
-func getServices() (Services, error) {
-	URLS := make(map[int]*url.URL)
-	for key, envVar := range urlEnvVariables {
-		rawURL, found := os.LookupEnv(envVar)
-		if !found || rawURL == "" {
-			errorMsg := fmt.Sprintf("Enviroment variable %s not found", envVar)
-			return nil, errors.New(errorMsg)
-		}
-
-		URL, err := url.Parse(rawURL)
-		if err != nil {
-			errorMsg := fmt.Sprintf("Invalid url %s", rawURL)
-			return nil, errors.New(errorMsg)
-		}
-		URLS[key] = URL
-	}
-	return URLS, nil
+type AccessLog struct {
+	// Fraction of the requests logged, server errors are always logged
+	SampleRate float64
+	// Fields, and query parameters of the URI, whose value is hidden
+	Redact []string
 }
 
 func getLogLevel() log.Level {
@@ -79,16 +87,113 @@ func isDevEnviroment() bool {
 	return parsedValue
 }
 
+func getAccessLog() (AccessLog, error) {
+	accessLog := AccessLog{SampleRate: 1}
+	if value, found := os.LookupEnv("ACCESS_LOG_SAMPLE_RATE"); found {
+		rate, err := strconv.ParseFloat(value, 64)
+		if err != nil || rate < 0 || rate > 1 {
+			errorMsg := fmt.Sprintf("Invalid ACCESS_LOG_SAMPLE_RATE %s, must be between 0 and 1", value)
+			return AccessLog{}, errors.New(errorMsg)
+		}
+		accessLog.SampleRate = rate
+	}
+	if value := os.Getenv("ACCESS_LOG_REDACT"); value != "" {
+		for _, field := range strings.Split(value, ",") {
+			accessLog.Redact = append(accessLog.Redact, strings.TrimSpace(field))
+		}
+	}
+	return accessLog, nil
+}
+
+func getDuration(name string, fallback time.Duration) (time.Duration, error) {
+	value, found := os.LookupEnv(name)
+	if !found {
+		return fallback, nil
+	}
+	duration, err := time.ParseDuration(value)
+	if err != nil || duration <= 0 {
+		errorMsg := fmt.Sprintf("Invalid %s %s", name, value)
+		return 0, errors.New(errorMsg)
+	}
+	return duration, nil
+}
+
 func New() (*Config, error) {
-	services, err := getServices()
+	manifest, err := getManifest()
+	if err != nil {
+		return nil, err
+	}
+
+	services, err := getServices(manifest)
+	if err != nil {
+		return nil, err
+	}
+
+	routes, err := getRoutes(manifest)
+	if err != nil {
+		return nil, err
+	}
+
+	rateLimit, err := getRateLimit()
+	if err != nil {
+		return nil, err
+	}
+
+	accessLog, err := getAccessLog()
+	if err != nil {
+		return nil, err
+	}
+
+	tracing, err := getTracing()
+	if err != nil {
+		return nil, err
+	}
+
+	server, err := getServer()
+	if err != nil {
+		return nil, err
+	}
+
+	firebase, err := getFirebase()
+	if err != nil {
+		return nil, err
+	}
+
+	tokenCache, err := getTokenCache()
+	if err != nil {
+		return nil, err
+	}
+
+	readyCacheTTL, err := getDuration("READY_CACHE_TTL", 5*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	readyTimeout, err := getDuration("READY_TIMEOUT", 2*time.Second)
+	if err != nil {
+		return nil, err
+	}
+
+	serviceKeys, err := getServiceKeys()
 	if err != nil {
 		return nil, err
 	}
 
 	return &Config{
-		URLS:            services,
-		LogLevel:        getLogLevel(),
-		IsDevEnviroment: isDevEnviroment(),
+		URLS:              services,
+		LogLevel:          getLogLevel(),
+		IsDevEnviroment:   isDevEnviroment(),
+		Routes:            routes,
+		RateLimit:         rateLimit,
+		AccessLog:         accessLog,
+		Tracing:           tracing,
+		Server:            server,
+		Firebase:          firebase,
+		TokenCache:        tokenCache,
+		ReadyCacheTTL:     readyCacheTTL,
+		ReadyTimeout:      readyTimeout,
+		UserHeadersSecret: os.Getenv("USER_HEADERS_SECRET"),
+		MetricsToken:      os.Getenv("METRICS_TOKEN"),
+		ServiceKeys:       serviceKeys,
 	}, nil
 }
 
@@ -0,0 +1,85 @@
+package config
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+)
+
+// File the credentials are read from when none are configured, if it
+// exists
+const defaultCredentialsFile = "firebase.json"
+
+type Firebase struct {
+	// Service account key, the JSON itself or the path of a file with
+	// it. Application default credentials are used when both are empty.
+	CredentialsJSON string
+	CredentialsFile string
+	ProjectID       string
+	// host:port of the Auth emulator, tokens are verified against it
+	// instead of the Firebase project when set
+	EmulatorHost string
+}
+
+type TokenCache struct {
+	// Most tokens kept, the cache is disabled when 0
+	Size int
+	// Time a verified token is trusted, bounded by its expiration
+	TTL time.Duration
+}
+
+func getTokenCache() (TokenCache, error) {
+	cache := TokenCache{Size: 10000}
+	if value, found := os.LookupEnv("TOKEN_CACHE_SIZE"); found {
+		size, err := strconv.Atoi(value)
+		if err != nil || size < 0 {
+			errorMsg := fmt.Sprintf("Invalid TOKEN_CACHE_SIZE %s", value)
+			return TokenCache{}, errors.New(errorMsg)
+		}
+		cache.Size = size
+	}
+	ttl, err := getDuration("TOKEN_CACHE_TTL", 5*time.Minute)
+	if err != nil {
+		return TokenCache{}, err
+	}
+	cache.TTL = ttl
+	return cache, nil
+}
+
+func getFirebase() (Firebase, error) {
+	firebase := Firebase{
+		CredentialsJSON: os.Getenv("FIREBASE_CREDENTIALS"),
+		CredentialsFile: os.Getenv("FIREBASE_CREDENTIALS_FILE"),
+		ProjectID:       os.Getenv("FIREBASE_PROJECT_ID"),
+		EmulatorHost:    os.Getenv("FIREBASE_AUTH_EMULATOR_HOST"),
+	}
+
+	if firebase.EmulatorHost != "" {
+		if firebase.ProjectID == "" {
+			return Firebase{}, errors.New("FIREBASE_PROJECT_ID is required with FIREBASE_AUTH_EMULATOR_HOST")
+		}
+		return firebase, nil
+	}
+
+	if firebase.CredentialsJSON != "" && firebase.CredentialsFile != "" {
+		return Firebase{}, errors.New("FIREBASE_CREDENTIALS and FIREBASE_CREDENTIALS_FILE can't be set together")
+	}
+	if firebase.CredentialsJSON != "" && !json.Valid([]byte(firebase.CredentialsJSON)) {
+		return Firebase{}, errors.New("FIREBASE_CREDENTIALS isn't valid JSON")
+	}
+	if firebase.CredentialsFile != "" {
+		if _, err := os.Stat(firebase.CredentialsFile); err != nil {
+			errorMsg := fmt.Sprintf("Invalid FIREBASE_CREDENTIALS_FILE %s", firebase.CredentialsFile)
+			return Firebase{}, errors.New(errorMsg)
+		}
+	}
+	if firebase.CredentialsJSON == "" && firebase.CredentialsFile == "" {
+		if _, err := os.Stat(defaultCredentialsFile); err == nil {
+			firebase.CredentialsFile = defaultCredentialsFile
+		}
+	}
+	return firebase, nil
+}
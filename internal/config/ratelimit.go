@@ -0,0 +1,98 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	MemoryStore = "memory"
+	RedisStore  = "redis"
+)
+
+// Requests a client may send to a route per period. The requests may
+// come in bursts as long as they don't exceed the quota.
+type Quota struct {
+	Requests int
+	Period   time.Duration
+}
+
+type RateLimit struct {
+	// Quota of the routes that don't set their own, zero disables rate
+	// limiting on them
+	Default Quota
+	// Quotas by route, keyed by method and path template, e.g.
+	// "POST /users"
+	Routes map[string]Quota
+	// Where the buckets are kept, memory or redis
+	Store         string
+	RedisAddr     string
+	RedisPassword string
+}
+
+// Parses a quota in the form <requests>/<period>, e.g. 10/1m
+func ParseQuota(value string) (Quota, error) {
+	parts := strings.SplitN(value, "/", 2)
+	if len(parts) != 2 {
+		return Quota{}, fmt.Errorf("invalid quota %q", value)
+	}
+	requests, err := strconv.Atoi(strings.TrimSpace(parts[0]))
+	if err != nil || requests <= 0 {
+		return Quota{}, fmt.Errorf("invalid quota %q", value)
+	}
+	period, err := time.ParseDuration(strings.TrimSpace(parts[1]))
+	if err != nil || period <= 0 {
+		return Quota{}, fmt.Errorf("invalid quota %q", value)
+	}
+	return Quota{Requests: requests, Period: period}, nil
+}
+
+func getRateLimit() (RateLimit, error) {
+	rateLimit := RateLimit{Routes: make(map[string]Quota), Store: MemoryStore}
+
+	if value := os.Getenv("RATE_LIMIT"); value != "" {
+		quota, err := ParseQuota(value)
+		if err != nil {
+			return RateLimit{}, fmt.Errorf("Invalid RATE_LIMIT: %s", err.Error())
+		}
+		rateLimit.Default = quota
+	}
+
+	// Comma separated list of <method> <path>=<quota>
+	if value := os.Getenv("RATE_LIMIT_ROUTES"); value != "" {
+		for _, entry := range strings.Split(value, ",") {
+			parts := strings.SplitN(entry, "=", 2)
+			route := strings.Join(strings.Fields(parts[0]), " ")
+			if len(parts) != 2 || len(strings.Fields(route)) != 2 {
+				errorMsg := fmt.Sprintf("Invalid RATE_LIMIT_ROUTES entry %q", entry)
+				return RateLimit{}, errors.New(errorMsg)
+			}
+			quota, err := ParseQuota(parts[1])
+			if err != nil {
+				return RateLimit{}, fmt.Errorf("Invalid RATE_LIMIT_ROUTES: %s", err.Error())
+			}
+			rateLimit.Routes[route] = quota
+		}
+	}
+
+	if store := os.Getenv("RATE_LIMIT_STORE"); store != "" {
+		rateLimit.Store = store
+	}
+	switch rateLimit.Store {
+	case MemoryStore:
+	case RedisStore:
+		rateLimit.RedisAddr = os.Getenv("REDIS_ADDR")
+		rateLimit.RedisPassword = os.Getenv("REDIS_PASSWORD")
+		if rateLimit.RedisAddr == "" {
+			return RateLimit{}, errors.New("Enviroment variable REDIS_ADDR not found")
+		}
+	default:
+		errorMsg := fmt.Sprintf("Unknown rate limit store %s", rateLimit.Store)
+		return RateLimit{}, errors.New(errorMsg)
+	}
+	return rateLimit, nil
+}
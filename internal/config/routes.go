@@ -0,0 +1,380 @@
+package config
+
+import (
+	"bytes"
+	"context"
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Name of the enviroment variable holding the path of the route
+// manifest. When it isn't set the gateway uses the routes of the
+// default manifest.
+const routesFileEnvVariable = "ROUTES_FILE"
+
+// Route manifest shipped with the gateway, the only place the default
+// routes are defined
+//
+//go:embed routes.json
+var defaultManifest []byte
+
+// How often the route manifest is checked for changes
+const manifestPollInterval = 5 * time.Second
+
+// Keys used in the route manifest to reference an entry of Services
+var serviceNames = map[string]int{
+	"users":     Users,
+	"trainings": Trainings,
+	"metrics":   Metrics,
+	"goals":     Goals,
+}
+
+// Arguments of AuthorizeUser, skipping the token cache or also
+// rejecting revoked tokens, which skips the cache too
+const (
+	Uncached     = "uncached"
+	CheckRevoked = "check_revoked"
+)
+
+// Path parameter holding the owner of the resource when RequireOwner
+// isn't given one
+const DefaultOwnerParam = "user_id"
+
+// Number of arguments taken by each middleware that can be used in
+// the route manifest
+var middlewareArgs = map[string]int{
+	"AuthorizeUser":             1,
+	"AuthorizeAdmin":            0,
+	"AuthorizeService":          1,
+	"CreateUser":                0,
+	"CreateAdmin":               0,
+	"ChangeBlockStatusFirebase": 0,
+	"DeleteUser":                0,
+	"AddUIDToRequestURL":        0,
+	"SetQuery":                  2,
+	"RemovePathFromRequestURL":  1,
+	"Timeout":                   1,
+	"Retry":                     4,
+	"RateLimit":                 1,
+	"RequireRole":               1,
+	"RequireOwner":              1,
+}
+
+// Middlewares taking any number of arguments from the one above,
+// RequireRole lets in the users with any of the roles given and Timeout
+// may also set the connect and response header timeouts
+var middlewareVariadicArgs = map[string]bool{
+	"RequireRole": true,
+	"Timeout":     true,
+}
+
+// Middlewares whose arguments may be left out, RateLimit uses the
+// configured quota of the route when it isn't given one, AuthorizeUser
+// uses the token cache unless given a policy and RequireOwner checks
+// DefaultOwnerParam
+var middlewareOptionalArgs = map[string]bool{
+	"RateLimit":     true,
+	"AuthorizeUser": true,
+	"RequireOwner":  true,
+}
+
+// Checks the arguments of the middlewares that take values other than
+// strings
+var middlewareArgValidators = map[string]func(args []string) error{
+	"Timeout": func(args []string) error {
+		_, err := ParseTimeouts(args)
+		return err
+	},
+	"Retry": func(args []string) error {
+		_, err := ParseRetry(args)
+		return err
+	},
+	"AuthorizeUser": func(args []string) error {
+		if len(args) == 1 && args[0] != Uncached && args[0] != CheckRevoked {
+			return fmt.Errorf("invalid AuthorizeUser argument %q, must be %q or %q", args[0], Uncached, CheckRevoked)
+		}
+		return nil
+	},
+	"RequireRole": func(args []string) error {
+		for _, role := range args {
+			if role == "" {
+				return errors.New("empty role")
+			}
+		}
+		return nil
+	},
+	"RateLimit": func(args []string) error {
+		if len(args) == 0 {
+			return nil
+		}
+		_, err := ParseQuota(args[0])
+		return err
+	},
+}
+
+// Parses the arguments of the Retry middleware: attempts, comma
+// separated retryable statuses, backoff and maximum backoff
+func ParseRetry(args []string) (Retry, error) {
+	attempts, err := strconv.Atoi(args[0])
+	if err != nil || attempts < 1 {
+		return Retry{}, fmt.Errorf("invalid attempts %q", args[0])
+	}
+	statuses, err := ParseStatuses(args[1])
+	if err != nil {
+		return Retry{}, err
+	}
+	backoff, err := time.ParseDuration(args[2])
+	if err != nil || backoff < 0 {
+		return Retry{}, fmt.Errorf("invalid backoff %q", args[2])
+	}
+	maxBackoff, err := time.ParseDuration(args[3])
+	if err != nil || maxBackoff < backoff {
+		return Retry{}, fmt.Errorf("invalid maximum backoff %q", args[3])
+	}
+	return Retry{Attempts: attempts, Statuses: statuses, Backoff: backoff, MaxBackoff: maxBackoff}, nil
+}
+
+// Timeouts a route sets with the Timeout middleware. Zero connect or
+// response header timeouts keep those of the service.
+type Timeouts struct {
+	// Time the whole request may take, including retries
+	Total time.Duration
+	// Time to establish a connection with an instance
+	Connect time.Duration
+	// Time each attempt waits for the response headers once sent
+	ResponseHeader time.Duration
+}
+
+// Parses the arguments of the Timeout middleware: the total timeout
+// and, optionally, the connect and response header timeouts
+func ParseTimeouts(args []string) (Timeouts, error) {
+	if len(args) > 3 {
+		return Timeouts{}, fmt.Errorf("takes at most 3 arguments, got %d", len(args))
+	}
+	total, err := time.ParseDuration(args[0])
+	if err != nil || total <= 0 {
+		return Timeouts{}, fmt.Errorf("invalid timeout %q", args[0])
+	}
+	timeouts := Timeouts{Total: total}
+	for i, timeout := range []*time.Duration{&timeouts.Connect, &timeouts.ResponseHeader} {
+		if len(args) <= i+1 {
+			break
+		}
+		*timeout, err = time.ParseDuration(args[i+1])
+		if err != nil || *timeout < 0 || *timeout > total {
+			return Timeouts{}, fmt.Errorf("invalid timeout %q, must be between 0 and %s", args[i+1], args[0])
+		}
+	}
+	return timeouts, nil
+}
+
+var allowedRouteMethods = map[string]bool{
+	http.MethodGet:    true,
+	http.MethodPost:   true,
+	http.MethodPut:    true,
+	http.MethodPatch:  true,
+	http.MethodDelete: true,
+}
+
+// A middleware applied to a route, in the order it appears in the
+// manifest
+type MiddlewareSpec struct {
+	Name string   `json:"name"`
+	Args []string `json:"args"`
+}
+
+// Route describes an endpoint exposed by the gateway and the service
+// the request is forwarded to after running its middleware.
+type Route struct {
+	Method     string           `json:"method"`
+	Path       string           `json:"path"`
+	Service    string           `json:"service"`
+	Middleware []MiddlewareSpec `json:"middleware"`
+}
+
+// The route manifest may also override the URL of the services, so
+// backends can be moved by editing the manifest while the gateway runs.
+type Manifest struct {
+	Services map[string]string `json:"services"`
+	Routes   []Route           `json:"routes"`
+}
+
+// Returns the key of the service in Services the route forwards to
+func (r Route) ServiceKey() int {
+	return serviceNames[r.Service]
+}
+
+// Returns the names of the middlewares the manifest knows about
+func MiddlewareNames() []string {
+	names := make([]string, 0, len(middlewareArgs))
+	for name := range middlewareArgs {
+		names = append(names, name)
+	}
+	return names
+}
+
+// Reads the route manifest from the file referenced by ROUTES_FILE,
+// returns nil if the variable isn't set.
+func getManifest() (*Manifest, error) {
+	path, found := os.LookupEnv(routesFileEnvVariable)
+	if !found || path == "" {
+		return nil, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		errorMsg := fmt.Sprintf("Couldn't read route manifest %s: %s", path, err.Error())
+		return nil, errors.New(errorMsg)
+	}
+
+	return ParseManifest(data)
+}
+
+// Returns the routes of the manifest shipped with the gateway
+func DefaultRoutes() ([]Route, error) {
+	manifest, err := ParseManifest(defaultManifest)
+	if err != nil {
+		return nil, err
+	}
+	return manifest.Routes, nil
+}
+
+// Returns the routes of the manifest, or the default ones if it doesn't
+// define any
+func getRoutes(manifest *Manifest) ([]Route, error) {
+	if manifest != nil && len(manifest.Routes) > 0 {
+		return manifest.Routes, nil
+	}
+	return DefaultRoutes()
+}
+
+// Parses and validates a JSON route manifest
+func ParseManifest(data []byte) (*Manifest, error) {
+	var manifest Manifest
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&manifest); err != nil {
+		errorMsg := fmt.Sprintf("Invalid route manifest: %s", err.Error())
+		return nil, errors.New(errorMsg)
+	}
+
+	if len(manifest.Routes) == 0 && len(manifest.Services) == 0 {
+		return nil, errors.New("Invalid route manifest: no routes or services defined")
+	}
+
+	for name := range manifest.Services {
+		if _, found := serviceNames[name]; !found {
+			return nil, fmt.Errorf("Invalid route manifest: unknown service %q", name)
+		}
+	}
+
+	if err := validateRoutes(manifest.Routes); err != nil {
+		return nil, err
+	}
+	return &manifest, nil
+}
+
+// Returns a channel that receives a value each time the route manifest
+// is modified. It stops watching when the context is done.
+func WatchManifest(ctx context.Context) <-chan struct{} {
+	changes := make(chan struct{})
+	path, found := os.LookupEnv(routesFileEnvVariable)
+	if !found || path == "" {
+		return changes
+	}
+
+	go func() {
+		lastModified := modTime(path)
+		ticker := time.NewTicker(manifestPollInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				modified := modTime(path)
+				if modified.Equal(lastModified) {
+					continue
+				}
+				lastModified = modified
+				select {
+				case changes <- struct{}{}:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+	}()
+	return changes
+}
+
+func modTime(path string) time.Time {
+	info, err := os.Stat(path)
+	if err != nil {
+		return time.Time{}
+	}
+	return info.ModTime()
+}
+
+func validateRoutes(routes []Route) error {
+	seen := make(map[string]bool)
+	for i, route := range routes {
+		if err := validateRoute(route); err != nil {
+			return fmt.Errorf("Invalid route %d (%s %s): %s", i, route.Method, route.Path, err.Error())
+		}
+
+		id := route.Method + " " + route.Path
+		if seen[id] {
+			return fmt.Errorf("Invalid route %d: %s is defined more than once", i, id)
+		}
+		seen[id] = true
+	}
+	return nil
+}
+
+func validateRoute(route Route) error {
+	if !allowedRouteMethods[route.Method] {
+		return fmt.Errorf("unsupported method %q", route.Method)
+	}
+
+	if !strings.HasPrefix(route.Path, "/") {
+		return fmt.Errorf("path %q must start with /", route.Path)
+	}
+
+	if _, found := serviceNames[route.Service]; !found {
+		return fmt.Errorf("unknown service %q", route.Service)
+	}
+
+	for _, m := range route.Middleware {
+		args, found := middlewareArgs[m.Name]
+		if !found {
+			return fmt.Errorf("unknown middleware %q", m.Name)
+		}
+		if len(m.Args) != args && !(middlewareOptionalArgs[m.Name] && len(m.Args) == 0) &&
+			!(middlewareVariadicArgs[m.Name] && len(m.Args) > args) {
+			return fmt.Errorf("middleware %s takes %d arguments, got %d", m.Name, args, len(m.Args))
+		}
+		if validate, found := middlewareArgValidators[m.Name]; found {
+			if err := validate(m.Args); err != nil {
+				return fmt.Errorf("middleware %s: %s", m.Name, err.Error())
+			}
+		}
+		if m.Name == "RequireOwner" {
+			param := DefaultOwnerParam
+			if len(m.Args) > 0 {
+				param = m.Args[0]
+			}
+			if !strings.Contains(route.Path+"/", "/:"+param+"/") {
+				return fmt.Errorf("middleware RequireOwner: path has no parameter %q", param)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,127 @@
+package config
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"time"
+
+	"fiufit.api.gateway/internal/certs"
+)
+
+const defaultListenAddr = "0.0.0.0:8080"
+
+type Server struct {
+	// Address the gateway listens on, host:port
+	Addr string
+	// Certificate and key served by the gateway, TLS is disabled when
+	// empty. The files are reloaded when they change.
+	TLSCertFile string
+	TLSKeyFile  string
+	// CA the clients certificates must be signed by, mutual TLS is
+	// disabled when empty
+	ClientCAFile string
+	// Address the health and metrics endpoints are served on instead of
+	// Addr, served along the routes when empty
+	OpsAddr string
+	// Time to read a whole request, body included
+	ReadTimeout time.Duration
+	// Time to write a response, must exceed the timeouts of the upstreams
+	WriteTimeout time.Duration
+	// Time an idle keep-alive connection is kept open
+	IdleTimeout time.Duration
+	// Time readiness fails before the gateway stops accepting
+	// connections, so load balancers stop sending it requests
+	ShutdownDelay time.Duration
+	// Time in-flight requests have to finish once shutting down
+	ShutdownGracePeriod time.Duration
+}
+
+func getServer() (Server, error) {
+	server := Server{}
+	durations := []struct {
+		name     string
+		value    *time.Duration
+		fallback time.Duration
+	}{
+		{"SERVER_READ_TIMEOUT", &server.ReadTimeout, 15 * time.Second},
+		{"SERVER_WRITE_TIMEOUT", &server.WriteTimeout, 60 * time.Second},
+		{"SERVER_IDLE_TIMEOUT", &server.IdleTimeout, 120 * time.Second},
+		{"SHUTDOWN_GRACE_PERIOD", &server.ShutdownGracePeriod, 30 * time.Second},
+	}
+	for _, d := range durations {
+		value, err := getDuration(d.name, d.fallback)
+		if err != nil {
+			return Server{}, err
+		}
+		*d.value = value
+	}
+
+	if value, found := os.LookupEnv("SHUTDOWN_DELAY"); found {
+		delay, err := time.ParseDuration(value)
+		if err != nil || delay < 0 {
+			errorMsg := fmt.Sprintf("Invalid SHUTDOWN_DELAY %s", value)
+			return Server{}, errors.New(errorMsg)
+		}
+		server.ShutdownDelay = delay
+	}
+
+	server.Addr = os.Getenv("LISTEN_ADDR")
+	if server.Addr == "" {
+		server.Addr = defaultListenAddr
+		if port := os.Getenv("PORT"); port != "" {
+			server.Addr = net.JoinHostPort("0.0.0.0", port)
+		}
+	}
+	if err := validateAddr("LISTEN_ADDR", server.Addr); err != nil {
+		return Server{}, err
+	}
+	server.OpsAddr = os.Getenv("OPS_LISTEN_ADDR")
+	if server.OpsAddr != "" {
+		if err := validateAddr("OPS_LISTEN_ADDR", server.OpsAddr); err != nil {
+			return Server{}, err
+		}
+		if server.OpsAddr == server.Addr {
+			return Server{}, errors.New("OPS_LISTEN_ADDR must differ from LISTEN_ADDR")
+		}
+	}
+
+	server.TLSCertFile = os.Getenv("TLS_CERT_FILE")
+	server.TLSKeyFile = os.Getenv("TLS_KEY_FILE")
+	server.ClientCAFile = os.Getenv("TLS_CLIENT_CA_FILE")
+	if (server.TLSCertFile == "") != (server.TLSKeyFile == "") {
+		return Server{}, errors.New("TLS_CERT_FILE and TLS_KEY_FILE must be set together")
+	}
+	if server.TLSCertFile != "" {
+		if _, err := tls.LoadX509KeyPair(server.TLSCertFile, server.TLSKeyFile); err != nil {
+			errorMsg := fmt.Sprintf("Invalid TLS certificate: %s", err.Error())
+			return Server{}, errors.New(errorMsg)
+		}
+	}
+	if server.ClientCAFile != "" {
+		if server.TLSCertFile == "" {
+			return Server{}, errors.New("TLS_CLIENT_CA_FILE requires TLS_CERT_FILE and TLS_KEY_FILE")
+		}
+		if _, err := certs.LoadPool(server.ClientCAFile); err != nil {
+			errorMsg := fmt.Sprintf("Invalid TLS_CLIENT_CA_FILE: %s", err.Error())
+			return Server{}, errors.New(errorMsg)
+		}
+	}
+	return server, nil
+}
+
+func validateAddr(name, addr string) error {
+	_, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		errorMsg := fmt.Sprintf("Invalid %s %s", name, addr)
+		return errors.New(errorMsg)
+	}
+	if number, err := strconv.Atoi(port); err != nil || number < 0 || number > 65535 {
+		errorMsg := fmt.Sprintf("Invalid port in %s %s", name, addr)
+		return errors.New(errorMsg)
+	}
+	return nil
+}
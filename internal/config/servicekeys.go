@@ -0,0 +1,90 @@
+package config
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+)
+
+// Scope of the keys allowed to push metrics through POST /admins/metrics
+const MetricsWriteScope = "metrics:write"
+
+// ServiceKey is an API key internal services authenticate with instead
+// of a user token. Only the SHA-256 of the key is configured, so the
+// gateway never holds the key itself.
+type ServiceKey struct {
+	// Identifies the key in the logs, e.g. metrics-producer-2026-10
+	ID string `json:"id"`
+	// Service the key was issued to
+	Service string `json:"service"`
+	// Hex encoded SHA-256 of the key
+	SHA256 string `json:"sha256"`
+	// Routes the key is accepted in, e.g. metrics:write
+	Scopes []string `json:"scopes"`
+	// The key is rejected from then on, it never expires when zero.
+	// Rotating a key means adding the new one, moving the service to it
+	// and then expiring or removing the old one.
+	Expires time.Time `json:"expires"`
+}
+
+type serviceKeys struct {
+	Keys []ServiceKey `json:"keys"`
+}
+
+// Reads the service keys from SERVICE_KEYS, or from the file in
+// SERVICE_KEYS_FILE, e.g. a mounted secret. No keys are accepted when
+// neither is set.
+func getServiceKeys() ([]ServiceKey, error) {
+	data := []byte(os.Getenv("SERVICE_KEYS"))
+	if path := os.Getenv("SERVICE_KEYS_FILE"); path != "" {
+		if len(data) > 0 {
+			return nil, errors.New("SERVICE_KEYS and SERVICE_KEYS_FILE can't be set together")
+		}
+		file, err := os.ReadFile(path)
+		if err != nil {
+			errorMsg := fmt.Sprintf("Couldn't read SERVICE_KEYS_FILE: %s", err.Error())
+			return nil, errors.New(errorMsg)
+		}
+		data = file
+	}
+	if len(data) == 0 {
+		return nil, nil
+	}
+
+	var parsed serviceKeys
+	if err := json.Unmarshal(data, &parsed); err != nil {
+		errorMsg := fmt.Sprintf("Invalid service keys: %s", err.Error())
+		return nil, errors.New(errorMsg)
+	}
+	seen := make(map[string]bool)
+	for i, key := range parsed.Keys {
+		if err := validateServiceKey(key); err != nil {
+			errorMsg := fmt.Sprintf("Invalid service key %d (%s): %s", i, key.ID, err.Error())
+			return nil, errors.New(errorMsg)
+		}
+		if seen[key.ID] || seen[key.SHA256] {
+			errorMsg := fmt.Sprintf("Invalid service key %d (%s): duplicated id or key", i, key.ID)
+			return nil, errors.New(errorMsg)
+		}
+		seen[key.ID] = true
+		seen[key.SHA256] = true
+	}
+	return parsed.Keys, nil
+}
+
+func validateServiceKey(key ServiceKey) error {
+	if key.ID == "" || key.Service == "" {
+		return errors.New("id and service are required")
+	}
+	hash, err := hex.DecodeString(key.SHA256)
+	if err != nil || len(hash) != 32 {
+		return errors.New("sha256 must be a hex encoded SHA-256")
+	}
+	if len(key.Scopes) == 0 {
+		return errors.New("at least one scope is required")
+	}
+	return nil
+}
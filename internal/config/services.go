@@ -0,0 +1,406 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Enviroment variables read when a service doesn't set its own value
+const upstreamEnvPrefix = "UPSTREAM"
+
+const (
+	defaultHealthInterval      = 10 * time.Second
+	defaultMaxFailures         = 5
+	defaultEjectionTime        = 30 * time.Second
+	defaultMaxIdleConns        = 100
+	defaultMaxIdleConnsPerHost = 32
+	defaultIdleConnTimeout     = 90 * time.Second
+	defaultKeepAlive           = 30 * time.Second
+	defaultConnectTimeout      = 5 * time.Second
+	defaultTimeout             = 30 * time.Second
+	defaultRetryBackoff        = 100 * time.Millisecond
+	defaultRetryMaxBackoff     = 2 * time.Second
+	defaultRetryBudget         = 0.2
+	defaultBreakerFailureRate  = 0.5
+	defaultBreakerMinRequests  = 20
+	defaultBreakerWindow       = 10 * time.Second
+	defaultBreakerOpenTime     = 30 * time.Second
+	defaultBreakerProbes       = 3
+)
+
+var defaultRetryStatuses = []int{502, 503, 504}
+
+var balancers = map[string]bool{
+	"round-robin":       true,
+	"least-outstanding": true,
+	"consistent-hash":   true,
+}
+
+// Service describes a backend the gateway forwards requests to and how
+// the load is spread among its instances.
+type Service struct {
+	Name string
+	URLs []*url.URL
+	// Balancing strategy, one of round-robin, least-outstanding or
+	// consistent-hash
+	Balancer       string
+	HealthPath     string
+	HealthInterval time.Duration
+	// Consecutive failures after which an instance is ejected
+	MaxFailures  int
+	EjectionTime time.Duration
+	// Time a request to the service may take, including retries, when
+	// the route doesn't set its own. Zero means no limit.
+	Timeout   time.Duration
+	Retry     Retry
+	Transport Transport
+	// Fraction of the requests to the service that may be retried,
+	// bounds the extra load retries cause while the service is failing
+	RetryBudget float64
+	Breaker     Breaker
+}
+
+// Circuit breaker settings of a service
+type Breaker struct {
+	// Failure rate over the window that opens the breaker, zero
+	// disables it
+	FailureRate float64
+	// Requests in the window needed before the breaker can open
+	MinRequests int
+	Window      time.Duration
+	// Time the breaker stays open before letting probe requests in
+	OpenTime time.Duration
+	// Successful probe requests needed to close the breaker again
+	HalfOpenRequests int
+}
+
+// Retry policy of the requests to a service. Only idempotent requests,
+// or those carrying an Idempotency-Key, are retried.
+type Retry struct {
+	// Attempts including the first one, 1 disables retries
+	Attempts int
+	// Response statuses that are retried, connection errors always are
+	Statuses []int
+	// Base and maximum time to wait between attempts, the wait doubles
+	// with each attempt and is randomized
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+}
+
+// Connection pooling settings of the transport shared by the requests
+// sent to a service
+type Transport struct {
+	MaxIdleConns        int
+	MaxIdleConnsPerHost int
+	IdleConnTimeout     time.Duration
+	// Interval between keep-alive probes of idle connections
+	KeepAlive         time.Duration
+	DisableKeepAlives bool
+	// Whether to attempt HTTP/2 with instances served over TLS
+	HTTP2 bool
+	// Time to establish a connection and for each attempt to receive
+	// the response headers. Zero means no limit. Routes may override
+	// both with the Timeout middleware.
+	ConnectTimeout        time.Duration
+	ResponseHeaderTimeout time.Duration
+}
+
+type Services map[int]Service
+
+// Returns the name of the service in the route manifest
+func serviceName(key int) string {
+	for name, k := range serviceNames {
+		if k == key {
+			return name
+		}
+	}
+	return ""
+}
+
+// Reads the configuration of each service from the enviroment. The
+// URL variable may hold a comma separated list of instances, URLs set
+// in the route manifest take precedence.
+func getServices(manifest *Manifest) (Services, error) {
+	overrides := make(map[int]string)
+	if manifest != nil {
+		for name, rawURLs := range manifest.Services {
+			overrides[serviceNames[name]] = rawURLs
+		}
+	}
+
+	services := make(Services)
+	for key, envVar := range urlEnvVariables {
+		rawURLs, found := os.LookupEnv(envVar)
+		if override, ok := overrides[key]; ok {
+			rawURLs, found = override, true
+		}
+		if !found || rawURLs == "" {
+			errorMsg := fmt.Sprintf("Enviroment variable %s not found", envVar)
+			return nil, errors.New(errorMsg)
+		}
+
+		URLs, err := parseURLs(rawURLs)
+		if err != nil {
+			return nil, err
+		}
+
+		service, err := getService(strings.TrimSuffix(envVar, "_URL"))
+		if err != nil {
+			return nil, err
+		}
+		service.Name = serviceName(key)
+		service.URLs = URLs
+		services[key] = service
+	}
+	return services, nil
+}
+
+func parseURLs(rawURLs string) ([]*url.URL, error) {
+	var URLs []*url.URL
+	for _, rawURL := range strings.Split(rawURLs, ",") {
+		rawURL = strings.TrimSpace(rawURL)
+		URL, err := url.Parse(rawURL)
+		if err != nil || URL.Host == "" {
+			errorMsg := fmt.Sprintf("Invalid url %s", rawURL)
+			return nil, errors.New(errorMsg)
+		}
+		URLs = append(URLs, URL)
+	}
+	return URLs, nil
+}
+
+// Reads the settings of the service whose variables start with prefix
+func getService(prefix string) (Service, error) {
+	service := Service{
+		Balancer:   lookupServiceEnv(prefix, "BALANCER"),
+		HealthPath: lookupServiceEnv(prefix, "HEALTH_PATH"),
+	}
+
+	if service.Balancer == "" {
+		service.Balancer = "round-robin"
+	}
+	if !balancers[service.Balancer] {
+		errorMsg := fmt.Sprintf("Unknown balancer %s for %s", service.Balancer, prefix)
+		return Service{}, errors.New(errorMsg)
+	}
+
+	var err error
+	service.HealthInterval, err = getServiceDuration(prefix, "HEALTH_INTERVAL", defaultHealthInterval)
+	if err != nil {
+		return Service{}, err
+	}
+	service.EjectionTime, err = getServiceDuration(prefix, "EJECTION_TIME", defaultEjectionTime)
+	if err != nil {
+		return Service{}, err
+	}
+	service.MaxFailures, err = getServiceInt(prefix, "MAX_FAILURES", defaultMaxFailures)
+	if err != nil {
+		return Service{}, err
+	}
+	service.Timeout, err = getServiceDuration(prefix, "TIMEOUT", defaultTimeout)
+	if err != nil {
+		return Service{}, err
+	}
+	service.Transport, err = getTransport(prefix)
+	if err != nil {
+		return Service{}, err
+	}
+	service.Retry, err = getRetry(prefix)
+	if err != nil {
+		return Service{}, err
+	}
+	service.RetryBudget, err = getServiceFloat(prefix, "RETRY_BUDGET", defaultRetryBudget)
+	if err != nil {
+		return Service{}, err
+	}
+	service.Breaker, err = getBreaker(prefix)
+	if err != nil {
+		return Service{}, err
+	}
+	return service, nil
+}
+
+func getBreaker(prefix string) (Breaker, error) {
+	var breaker Breaker
+	var err error
+	breaker.FailureRate, err = getServiceFloat(prefix, "BREAKER_FAILURE_RATE", defaultBreakerFailureRate)
+	if err != nil {
+		return Breaker{}, err
+	}
+	if breaker.FailureRate > 1 {
+		errorMsg := fmt.Sprintf("Invalid failure rate %f for %s_BREAKER_FAILURE_RATE", breaker.FailureRate, prefix)
+		return Breaker{}, errors.New(errorMsg)
+	}
+	breaker.MinRequests, err = getServiceInt(prefix, "BREAKER_MIN_REQUESTS", defaultBreakerMinRequests)
+	if err != nil {
+		return Breaker{}, err
+	}
+	breaker.Window, err = getServiceDuration(prefix, "BREAKER_WINDOW", defaultBreakerWindow)
+	if err != nil {
+		return Breaker{}, err
+	}
+	if breaker.Window == 0 {
+		errorMsg := fmt.Sprintf("Invalid window for %s_BREAKER_WINDOW", prefix)
+		return Breaker{}, errors.New(errorMsg)
+	}
+	breaker.OpenTime, err = getServiceDuration(prefix, "BREAKER_OPEN_TIME", defaultBreakerOpenTime)
+	if err != nil {
+		return Breaker{}, err
+	}
+	breaker.HalfOpenRequests, err = getServiceInt(prefix, "BREAKER_HALF_OPEN_REQUESTS", defaultBreakerProbes)
+	if err != nil {
+		return Breaker{}, err
+	}
+	if breaker.HalfOpenRequests == 0 {
+		breaker.HalfOpenRequests = 1
+	}
+	return breaker, nil
+}
+
+func getRetry(prefix string) (Retry, error) {
+	var retry Retry
+	var err error
+	retry.Attempts, err = getServiceInt(prefix, "RETRY_ATTEMPTS", 1)
+	if err != nil {
+		return Retry{}, err
+	}
+	if retry.Attempts < 1 {
+		errorMsg := fmt.Sprintf("Invalid number of attempts %d for %s_RETRY_ATTEMPTS", retry.Attempts, prefix)
+		return Retry{}, errors.New(errorMsg)
+	}
+	retry.Statuses = defaultRetryStatuses
+	if value := lookupServiceEnv(prefix, "RETRY_STATUSES"); value != "" {
+		retry.Statuses, err = ParseStatuses(value)
+		if err != nil {
+			return Retry{}, err
+		}
+	}
+	retry.Backoff, err = getServiceDuration(prefix, "RETRY_BACKOFF", defaultRetryBackoff)
+	if err != nil {
+		return Retry{}, err
+	}
+	retry.MaxBackoff, err = getServiceDuration(prefix, "RETRY_MAX_BACKOFF", defaultRetryMaxBackoff)
+	if err != nil {
+		return Retry{}, err
+	}
+	return retry, nil
+}
+
+// Parses a comma separated list of HTTP statuses
+func ParseStatuses(value string) ([]int, error) {
+	var statuses []int
+	for _, rawStatus := range strings.Split(value, ",") {
+		status, err := strconv.Atoi(strings.TrimSpace(rawStatus))
+		if err != nil || status < 100 || status > 599 {
+			errorMsg := fmt.Sprintf("Invalid status %s", rawStatus)
+			return nil, errors.New(errorMsg)
+		}
+		statuses = append(statuses, status)
+	}
+	return statuses, nil
+}
+
+func getTransport(prefix string) (Transport, error) {
+	var transport Transport
+	var err error
+	transport.MaxIdleConns, err = getServiceInt(prefix, "MAX_IDLE_CONNS", defaultMaxIdleConns)
+	if err != nil {
+		return Transport{}, err
+	}
+	transport.MaxIdleConnsPerHost, err = getServiceInt(prefix, "MAX_IDLE_CONNS_PER_HOST", defaultMaxIdleConnsPerHost)
+	if err != nil {
+		return Transport{}, err
+	}
+	transport.IdleConnTimeout, err = getServiceDuration(prefix, "IDLE_CONN_TIMEOUT", defaultIdleConnTimeout)
+	if err != nil {
+		return Transport{}, err
+	}
+	transport.KeepAlive, err = getServiceDuration(prefix, "KEEP_ALIVE", defaultKeepAlive)
+	if err != nil {
+		return Transport{}, err
+	}
+	transport.DisableKeepAlives, err = getServiceBool(prefix, "DISABLE_KEEP_ALIVES", false)
+	if err != nil {
+		return Transport{}, err
+	}
+	transport.HTTP2, err = getServiceBool(prefix, "HTTP2", true)
+	if err != nil {
+		return Transport{}, err
+	}
+	transport.ConnectTimeout, err = getServiceDuration(prefix, "CONNECT_TIMEOUT", defaultConnectTimeout)
+	if err != nil {
+		return Transport{}, err
+	}
+	transport.ResponseHeaderTimeout, err = getServiceDuration(prefix, "RESPONSE_HEADER_TIMEOUT", 0)
+	if err != nil {
+		return Transport{}, err
+	}
+	return transport, nil
+}
+
+// Returns the value of <prefix>_<name>, or of UPSTREAM_<name> if the
+// service doesn't set it
+func lookupServiceEnv(prefix, name string) string {
+	value, found := os.LookupEnv(prefix + "_" + name)
+	if found && value != "" {
+		return value
+	}
+	return os.Getenv(upstreamEnvPrefix + "_" + name)
+}
+
+func getServiceDuration(prefix, name string, defaultValue time.Duration) (time.Duration, error) {
+	value := lookupServiceEnv(prefix, name)
+	if value == "" {
+		return defaultValue, nil
+	}
+	duration, err := time.ParseDuration(value)
+	if err != nil || duration < 0 {
+		errorMsg := fmt.Sprintf("Invalid duration %s for %s_%s", value, prefix, name)
+		return 0, errors.New(errorMsg)
+	}
+	return duration, nil
+}
+
+func getServiceInt(prefix, name string, defaultValue int) (int, error) {
+	value := lookupServiceEnv(prefix, name)
+	if value == "" {
+		return defaultValue, nil
+	}
+	number, err := strconv.Atoi(value)
+	if err != nil || number < 0 {
+		errorMsg := fmt.Sprintf("Invalid number %s for %s_%s", value, prefix, name)
+		return 0, errors.New(errorMsg)
+	}
+	return number, nil
+}
+
+func getServiceBool(prefix, name string, defaultValue bool) (bool, error) {
+	value := lookupServiceEnv(prefix, name)
+	if value == "" {
+		return defaultValue, nil
+	}
+	parsedValue, err := strconv.ParseBool(value)
+	if err != nil {
+		errorMsg := fmt.Sprintf("Invalid boolean %s for %s_%s", value, prefix, name)
+		return false, errors.New(errorMsg)
+	}
+	return parsedValue, nil
+}
+
+func getServiceFloat(prefix, name string, defaultValue float64) (float64, error) {
+	value := lookupServiceEnv(prefix, name)
+	if value == "" {
+		return defaultValue, nil
+	}
+	number, err := strconv.ParseFloat(value, 64)
+	if err != nil || number < 0 {
+		errorMsg := fmt.Sprintf("Invalid number %s for %s_%s", value, prefix, name)
+		return 0, errors.New(errorMsg)
+	}
+	return number, nil
+}
@@ -0,0 +1,44 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"os"
+)
+
+const (
+	DatadogTracing = "datadog"
+	OTLPTracing    = "otlp"
+	NoTracing      = "none"
+)
+
+type Tracing struct {
+	// Where the spans are sent, datadog, otlp or none
+	Provider    string
+	ServiceName string
+	// Base URL of the OpenTelemetry collector, e.g. http://collector:4318
+	OTLPEndpoint string
+}
+
+func getTracing() (Tracing, error) {
+	tracing := Tracing{Provider: DatadogTracing, ServiceName: ServiceName}
+	if provider := os.Getenv("TRACING_PROVIDER"); provider != "" {
+		tracing.Provider = provider
+	}
+	if name := os.Getenv("OTEL_SERVICE_NAME"); name != "" {
+		tracing.ServiceName = name
+	}
+
+	switch tracing.Provider {
+	case DatadogTracing, NoTracing:
+	case OTLPTracing:
+		tracing.OTLPEndpoint = os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT")
+		if tracing.OTLPEndpoint == "" {
+			return Tracing{}, errors.New("Enviroment variable OTEL_EXPORTER_OTLP_ENDPOINT not found")
+		}
+	default:
+		errorMsg := fmt.Sprintf("Unknown tracing provider %s", tracing.Provider)
+		return Tracing{}, errors.New(errorMsg)
+	}
+	return tracing, nil
+}
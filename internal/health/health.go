@@ -0,0 +1,121 @@
+package health
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+const (
+	Up   = "up"
+	Down = "down"
+)
+
+// Check returns nil if the dependency is usable
+type Check func(ctx context.Context) error
+
+// Result of the last run of a check
+type Result struct {
+	Status    string    `json:"status"`
+	Error     string    `json:"error,omitempty"`
+	CheckedAt time.Time `json:"checked_at"`
+}
+
+type Report struct {
+	Status string            `json:"status"`
+	Checks map[string]Result `json:"checks"`
+}
+
+// Checker runs the checks of the dependencies of the gateway. Results
+// are cached for ttl so frequent readiness probes don't hammer them,
+// and each check is run by one report at a time.
+type Checker struct {
+	mu      sync.Mutex
+	checks  map[string]Check
+	results map[string]Result
+	// Closed once the running refresh of each check ends
+	running map[string]chan struct{}
+	ttl     time.Duration
+	timeout time.Duration
+}
+
+func NewChecker(ttl, timeout time.Duration) *Checker {
+	return &Checker{
+		checks:  make(map[string]Check),
+		results: make(map[string]Result),
+		running: make(map[string]chan struct{}),
+		ttl:     ttl,
+		timeout: timeout,
+	}
+}
+
+func (c *Checker) Add(name string, check Check) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.checks[name] = check
+}
+
+// Runs the checks whose results expired, concurrently, and returns the
+// status of every dependency. The report is up only if all of them are.
+// A check already being run by another report isn't run again, its
+// stale result is reported or, if it has none, the report waits for it.
+func (c *Checker) Report(ctx context.Context) Report {
+	c.mu.Lock()
+	now := time.Now()
+	var pending []chan struct{}
+	for name, check := range c.checks {
+		result, found := c.results[name]
+		if found && now.Sub(result.CheckedAt) < c.ttl {
+			continue
+		}
+		done, running := c.running[name]
+		if !running {
+			done = make(chan struct{})
+			c.running[name] = done
+			go c.refresh(name, check, done)
+		}
+		if !running || !found {
+			pending = append(pending, done)
+		}
+	}
+	c.mu.Unlock()
+
+	for _, done := range pending {
+		select {
+		case <-done:
+		case <-ctx.Done():
+		}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	report := Report{Status: Up, Checks: make(map[string]Result, len(c.checks))}
+	for name := range c.checks {
+		result, found := c.results[name]
+		if !found {
+			result = Result{Status: Down, Error: "not checked yet", CheckedAt: now}
+		}
+		report.Checks[name] = result
+		if result.Status != Up {
+			report.Status = Down
+		}
+	}
+	return report
+}
+
+// Runs the check and stores its result. The check isn't bound to the
+// report that started it, as other reports use its result too.
+func (c *Checker) refresh(name string, check Check, done chan struct{}) {
+	ctx, cancel := context.WithTimeout(context.Background(), c.timeout)
+	defer cancel()
+	result := Result{Status: Up, CheckedAt: time.Now()}
+	if err := check(ctx); err != nil {
+		result = Result{Status: Down, Error: err.Error(), CheckedAt: result.CheckedAt}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.results[name] = result
+	delete(c.running, name)
+	close(done)
+}
@@ -0,0 +1,39 @@
+package metrics
+
+// Registry of the metrics exported by the gateway
+var Default = NewRegistry()
+
+var (
+	Requests = Default.Counter("gateway_requests_total",
+		"Requests handled by the gateway.",
+		"route", "method", "status", "upstream")
+	RequestDuration = Default.Histogram("gateway_request_duration_seconds",
+		"Time taken to handle the requests.", DefaultBuckets,
+		"route", "method", "status", "upstream")
+	InFlight = Default.Gauge("gateway_requests_in_flight",
+		"Requests being handled.",
+		"route", "method")
+	AuthFailures = Default.Counter("gateway_auth_failures_total",
+		"Requests whose Firebase token couldn't be verified.")
+	TokenCacheLookups = Default.Counter("gateway_token_cache_lookups_total",
+		"Firebase tokens looked up in the token cache, by result: hit, miss or bypass.",
+		"result")
+	TokenCacheEntries = Default.Gauge("gateway_token_cache_entries",
+		"Verified Firebase tokens kept in the token cache.")
+	AdminCheckFailures = Default.Counter("gateway_admin_check_failures_total",
+		"Requests to admin routes from users that aren't admins.")
+	ServiceKeyRequests = Default.Counter("gateway_service_key_requests_total",
+		"Requests authenticated with a service key, by key and result: accepted, unknown, expired or missing_scope.",
+		"key", "result")
+	ProxyErrors = Default.Counter("gateway_proxy_errors_total",
+		"Requests that couldn't be forwarded to an upstream, by kind of error.",
+		"upstream", "kind")
+)
+
+// Returns the class of an HTTP status, e.g. 2xx
+func StatusClass(status int) string {
+	if status < 100 || status > 599 {
+		return "unknown"
+	}
+	return string(rune('0'+status/100)) + "xx"
+}
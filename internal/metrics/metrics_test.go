@@ -0,0 +1,106 @@
+package metrics
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func render(t *testing.T, r *Registry) string {
+	var out strings.Builder
+	if err := r.Write(&out); err != nil {
+		t.Fatal(err)
+	}
+	return out.String()
+}
+
+func TestExposition(t *testing.T) {
+	t.Run("Label values escape backslashes, quotes and line breaks", func(t *testing.T) {
+		r := NewRegistry()
+		r.Counter("requests_total", "Requests.", "path").Inc("a\\b\"c\nd")
+
+		want := `requests_total{path="a\\b\"c\nd"} 1` + "\n"
+		if got := render(t, r); !strings.Contains(got, want) {
+			t.Errorf("Got %q, want it to contain %q", got, want)
+		}
+	})
+
+	t.Run("Help escapes backslashes and line breaks but not quotes", func(t *testing.T) {
+		r := NewRegistry()
+		r.Gauge("entries", "Entries in C:\\cache,\nthe \"hot\" ones.")
+
+		want := `# HELP entries Entries in C:\\cache,\nthe "hot" ones.` + "\n# TYPE entries gauge\n"
+		if got := render(t, r); got != want {
+			t.Errorf("Got %q, want %q", got, want)
+		}
+	})
+
+	t.Run("Series are sorted by their labels", func(t *testing.T) {
+		r := NewRegistry()
+		c := r.Counter("hits_total", "Hits.", "route", "status")
+		c.Add(2, "/users", "500")
+		c.Inc("/goals", "200")
+		c.Inc("/users", "200")
+
+		want := "# HELP hits_total Hits.\n" +
+			"# TYPE hits_total counter\n" +
+			`hits_total{route="/goals",status="200"} 1` + "\n" +
+			`hits_total{route="/users",status="200"} 1` + "\n" +
+			`hits_total{route="/users",status="500"} 2` + "\n"
+		if got := render(t, r); got != want {
+			t.Errorf("Got %q, want %q", got, want)
+		}
+	})
+
+	t.Run("Histograms have cumulative buckets, a sum and a count", func(t *testing.T) {
+		r := NewRegistry()
+		h := r.Histogram("duration_seconds", "Durations.", []float64{.1, 1}, "route")
+		h.Observe(.05, `/a"b`)
+		h.Observe(.5, `/a"b`)
+		h.Observe(3, `/a"b`)
+
+		want := "# HELP duration_seconds Durations.\n" +
+			"# TYPE duration_seconds histogram\n" +
+			`duration_seconds_bucket{route="/a\"b",le="0.1"} 1` + "\n" +
+			`duration_seconds_bucket{route="/a\"b",le="1"} 2` + "\n" +
+			`duration_seconds_bucket{route="/a\"b",le="+Inf"} 3` + "\n" +
+			`duration_seconds_sum{route="/a\"b"} 3.55` + "\n" +
+			`duration_seconds_count{route="/a\"b"} 3` + "\n"
+		if got := render(t, r); got != want {
+			t.Errorf("Got %q, want %q", got, want)
+		}
+	})
+
+	t.Run("Metrics without labels have no braces", func(t *testing.T) {
+		r := NewRegistry()
+		r.Gauge("in_flight", "In flight.").Set(-1)
+
+		if got := render(t, r); !strings.Contains(got, "\nin_flight -1\n") {
+			t.Errorf("Got %q, want the series without labels", got)
+		}
+	})
+
+	t.Run("The handler serves the text format", func(t *testing.T) {
+		r := NewRegistry()
+		r.Counter("requests_total", "Requests.").Inc()
+		w := httptest.NewRecorder()
+
+		r.Handler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+
+		if got := w.Header().Get("Content-Type"); got != ContentType {
+			t.Errorf("Got content type %s, want %s", got, ContentType)
+		}
+		if got := w.Body.String(); got != render(t, r) {
+			t.Errorf("Got %q, want the rendered registry", got)
+		}
+	})
+}
+
+func TestStatusClass(t *testing.T) {
+	for status, want := range map[int]string{200: "2xx", 404: "4xx", 599: "5xx", 99: "unknown", 600: "unknown"} {
+		if got := StatusClass(status); got != want {
+			t.Errorf("Got %s for %d, want %s", got, status, want)
+		}
+	}
+}
@@ -0,0 +1,70 @@
+package problem
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+const ContentType = "application/problem+json"
+
+// Header carrying the ID of the request, sent back in the problems
+const RequestIDHeader = "X-Request-ID"
+
+// Codes identifying each kind of error the gateway responds with
+const (
+	Unauthorized        = "unauthorized"
+	NotAdmin            = "not_admin"
+	MissingRole         = "missing_role"
+	NotOwner            = "not_owner"
+	MissingScope        = "missing_scope"
+	InvalidBody         = "invalid_body"
+	UserNotFound        = "user_not_found"
+	UserConflict        = "user_conflict"
+	PartialDeletion     = "partial_deletion"
+	RateLimited         = "rate_limited"
+	UpstreamUnavailable = "upstream_unavailable"
+	UpstreamTimeout     = "upstream_timeout"
+	BadGateway          = "bad_gateway"
+	NotFound            = "not_found"
+	Internal            = "internal_error"
+)
+
+// Problem is the body of every error response originated in the
+// gateway, following RFC 7807. Errors responded by the services are
+// forwarded untouched.
+type Problem struct {
+	Type      string `json:"type"`
+	Title     string `json:"title"`
+	Status    int    `json:"status"`
+	Detail    string `json:"detail,omitempty"`
+	RequestID string `json:"request_id,omitempty"`
+	Code      string `json:"code"`
+	// Fields of the request that aren't valid, if any
+	Errors []FieldError `json:"errors,omitempty"`
+}
+
+// FieldError tells why a field of the request isn't valid
+type FieldError struct {
+	Field  string `json:"field"`
+	Reason string `json:"reason"`
+}
+
+func New(status int, code, detail string) Problem {
+	return Problem{
+		Type:   "urn:fiufit:problem:" + code,
+		Title:  http.StatusText(status),
+		Status: status,
+		Detail: detail,
+		Code:   code,
+	}
+}
+
+// Responds with the problem, including the ID of the request if it has
+// one
+func Write(w http.ResponseWriter, r *http.Request, p Problem) {
+	p.RequestID = r.Header.Get(RequestIDHeader)
+	body, _ := json.Marshal(p)
+	w.Header().Set("Content-Type", ContentType)
+	w.WriteHeader(p.Status)
+	w.Write(body)
+}
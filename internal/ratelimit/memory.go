@@ -0,0 +1,60 @@
+package ratelimit
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"fiufit.api.gateway/internal/config"
+)
+
+// Time between sweeps of the buckets that refilled completely
+const sweepInterval = time.Minute
+
+type memoryBucket struct {
+	Bucket
+	period time.Duration
+}
+
+// MemoryStore keeps the buckets in the gateway process, so each gateway
+// instance enforces the quotas on its own.
+type MemoryStore struct {
+	mu        sync.Mutex
+	buckets   map[string]*memoryBucket
+	lastSweep time.Time
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{buckets: make(map[string]*memoryBucket), lastSweep: time.Now()}
+}
+
+func (s *MemoryStore) Take(_ context.Context, key string, quota config.Quota) (Result, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	s.sweep(now)
+
+	bucket, found := s.buckets[key]
+	if !found {
+		bucket = &memoryBucket{}
+		s.buckets[key] = bucket
+	}
+	var result Result
+	bucket.Bucket, result = Take(bucket.Bucket, quota, now)
+	bucket.period = quota.Period
+	return result, nil
+}
+
+// Drops the buckets unused for longer than their period, they are full
+// again and a new one behaves the same
+func (s *MemoryStore) sweep(now time.Time) {
+	if now.Sub(s.lastSweep) < sweepInterval {
+		return
+	}
+	s.lastSweep = now
+	for key, bucket := range s.buckets {
+		if now.Sub(bucket.Last) >= bucket.period {
+			delete(s.buckets, key)
+		}
+	}
+}
@@ -0,0 +1,113 @@
+package ratelimit
+
+import (
+	"context"
+	"math"
+	"time"
+
+	"fiufit.api.gateway/internal/config"
+	log "github.com/sirupsen/logrus"
+)
+
+// Outcome of taking a token from a bucket
+type Result struct {
+	Allowed bool
+	// Requests allowed per period
+	Limit int
+	// Tokens left in the bucket
+	Remaining int
+	// Time until the bucket is full again
+	Reset time.Duration
+	// Time until a token is available, zero when the request is allowed
+	RetryAfter time.Duration
+}
+
+// Store keeps the token buckets. Take must be safe for concurrent use
+// and atomic, since several gateways may share the same store.
+type Store interface {
+	Take(ctx context.Context, key string, quota config.Quota) (Result, error)
+}
+
+// State of a token bucket
+type Bucket struct {
+	Tokens float64
+	Last   time.Time
+}
+
+// Refills the bucket for the time elapsed since it was last used and
+// takes a token from it if there is one. A new bucket starts full.
+func Take(bucket Bucket, quota config.Quota, now time.Time) (Bucket, Result) {
+	capacity := float64(quota.Requests)
+	rate := capacity / float64(quota.Period)
+	if bucket.Last.IsZero() {
+		bucket = Bucket{Tokens: capacity, Last: now}
+	}
+	if elapsed := now.Sub(bucket.Last); elapsed > 0 {
+		bucket.Tokens = math.Min(capacity, bucket.Tokens+float64(elapsed)*rate)
+		bucket.Last = now
+	}
+
+	result := Result{Limit: quota.Requests}
+	if bucket.Tokens >= 1 {
+		bucket.Tokens--
+		result.Allowed = true
+	} else {
+		result.RetryAfter = time.Duration(math.Ceil((1 - bucket.Tokens) / rate))
+	}
+	result.Remaining = int(bucket.Tokens)
+	result.Reset = time.Duration(math.Ceil((capacity - bucket.Tokens) / rate))
+	return bucket, result
+}
+
+// Limiter resolves the quota of each route and takes the tokens from
+// the store
+type Limiter struct {
+	store  Store
+	limits config.RateLimit
+	// Quota of every route, set for the routes of the manifest
+	override *config.Quota
+}
+
+func New(store Store, limits config.RateLimit) *Limiter {
+	return &Limiter{store: store, limits: limits}
+}
+
+// Builds the store set in the configuration
+func NewStore(limits config.RateLimit) Store {
+	if limits.Store == config.RedisStore {
+		return NewRedisStore(limits.RedisAddr, limits.RedisPassword)
+	}
+	return NewMemoryStore()
+}
+
+// Returns a limiter sharing the store that applies quota to every route
+func (l *Limiter) WithQuota(quota config.Quota) *Limiter {
+	return &Limiter{store: l.store, limits: l.limits, override: &quota}
+}
+
+// Returns the quota of a route and whether it is limited at all
+func (l *Limiter) Quota(method, path string) (config.Quota, bool) {
+	if l.override != nil {
+		return *l.override, true
+	}
+	if quota, found := l.limits.Routes[method+" "+path]; found {
+		return quota, true
+	}
+	return l.limits.Default, l.limits.Default.Requests > 0
+}
+
+// Takes a token from the bucket of the client identified by key for the
+// route. If the store fails the request is allowed, an unavailable
+// store mustn't take the gateway down with it.
+func (l *Limiter) Allow(ctx context.Context, key, method, path string) (Result, bool) {
+	quota, limited := l.Quota(method, path)
+	if !limited {
+		return Result{}, false
+	}
+	result, err := l.store.Take(ctx, key+":"+method+" "+path, quota)
+	if err != nil {
+		log.WithFields(log.Fields{"error": err.Error()}).Error("Rate limit store failed, allowing request")
+		return Result{}, false
+	}
+	return result, true
+}
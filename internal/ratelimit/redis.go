@@ -0,0 +1,232 @@
+package ratelimit
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"fiufit.api.gateway/internal/config"
+)
+
+const (
+	// Connections kept open to redis
+	redisPoolSize = 16
+	// Time a command may take when the request has no deadline
+	redisTimeout = time.Second
+)
+
+// Token bucket taken atomically in redis. It mirrors Take, with times in
+// milliseconds and the tokens kept as a float string. The bucket expires
+// once it would be full again.
+const takeScript = `
+local capacity = tonumber(ARGV[1])
+local period = tonumber(ARGV[2])
+local now = tonumber(ARGV[3])
+local rate = capacity / period
+local state = redis.call('HMGET', KEYS[1], 'tokens', 'last')
+local tokens = tonumber(state[1])
+local last = tonumber(state[2])
+if tokens == nil or last == nil then
+  tokens = capacity
+  last = now
+end
+if now > last then
+  tokens = math.min(capacity, tokens + (now - last) * rate)
+  last = now
+end
+local allowed = 0
+local retry = 0
+if tokens >= 1 then
+  tokens = tokens - 1
+  allowed = 1
+else
+  retry = math.ceil((1 - tokens) / rate)
+end
+redis.call('HSET', KEYS[1], 'tokens', tostring(tokens), 'last', last)
+redis.call('PEXPIRE', KEYS[1], period)
+return {allowed, math.floor(tokens), retry, math.ceil((capacity - tokens) / rate)}
+`
+
+var takeScriptSHA = func() string {
+	sum := sha1.Sum([]byte(takeScript))
+	return hex.EncodeToString(sum[:])
+}()
+
+// Error replied by redis
+type redisError string
+
+func (e redisError) Error() string {
+	return string(e)
+}
+
+type redisConn struct {
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+// RedisStore keeps the buckets in redis, or any server speaking its
+// protocol, so every gateway instance shares the same quotas.
+type RedisStore struct {
+	addr     string
+	password string
+	pool     chan *redisConn
+}
+
+func NewRedisStore(addr, password string) *RedisStore {
+	return &RedisStore{addr: addr, password: password, pool: make(chan *redisConn, redisPoolSize)}
+}
+
+func (s *RedisStore) Take(ctx context.Context, key string, quota config.Quota) (Result, error) {
+	args := []string{
+		"1",
+		"ratelimit:" + key,
+		strconv.Itoa(quota.Requests),
+		strconv.FormatInt(quota.Period.Milliseconds(), 10),
+		strconv.FormatInt(time.Now().UnixNano()/int64(time.Millisecond), 10),
+	}
+	reply, err := s.do(ctx, append([]string{"EVALSHA", takeScriptSHA}, args...)...)
+	var replyErr redisError
+	if errors.As(err, &replyErr) && strings.HasPrefix(string(replyErr), "NOSCRIPT") {
+		reply, err = s.do(ctx, append([]string{"EVAL", takeScript}, args...)...)
+	}
+	if err != nil {
+		return Result{}, err
+	}
+
+	values, ok := reply.([]interface{})
+	if !ok || len(values) != 4 {
+		return Result{}, fmt.Errorf("unexpected reply from redis: %v", reply)
+	}
+	numbers := make([]int64, len(values))
+	for i, value := range values {
+		if numbers[i], ok = value.(int64); !ok {
+			return Result{}, fmt.Errorf("unexpected reply from redis: %v", reply)
+		}
+	}
+	return Result{
+		Allowed:    numbers[0] == 1,
+		Limit:      quota.Requests,
+		Remaining:  int(numbers[1]),
+		RetryAfter: time.Duration(numbers[2]) * time.Millisecond,
+		Reset:      time.Duration(numbers[3]) * time.Millisecond,
+	}, nil
+}
+
+// Sends a command and returns its reply. Errors replied by redis leave
+// the connection usable, any other error closes it.
+func (s *RedisStore) do(ctx context.Context, args ...string) (interface{}, error) {
+	conn, err := s.get()
+	if err != nil {
+		return nil, err
+	}
+	deadline, found := ctx.Deadline()
+	if !found {
+		deadline = time.Now().Add(redisTimeout)
+	}
+	conn.conn.SetDeadline(deadline)
+
+	reply, err := conn.command(args...)
+	var replyErr redisError
+	if err != nil && !errors.As(err, &replyErr) {
+		conn.conn.Close()
+		return nil, err
+	}
+	s.put(conn)
+	return reply, err
+}
+
+func (s *RedisStore) get() (*redisConn, error) {
+	select {
+	case conn := <-s.pool:
+		return conn, nil
+	default:
+	}
+
+	netConn, err := net.DialTimeout("tcp", s.addr, redisTimeout)
+	if err != nil {
+		return nil, err
+	}
+	conn := &redisConn{conn: netConn, reader: bufio.NewReader(netConn)}
+	if s.password != "" {
+		netConn.SetDeadline(time.Now().Add(redisTimeout))
+		if _, err := conn.command("AUTH", s.password); err != nil {
+			netConn.Close()
+			return nil, err
+		}
+	}
+	return conn, nil
+}
+
+func (s *RedisStore) put(conn *redisConn) {
+	select {
+	case s.pool <- conn:
+	default:
+		conn.conn.Close()
+	}
+}
+
+func (c *redisConn) command(args ...string) (interface{}, error) {
+	var b strings.Builder
+	fmt.Fprintf(&b, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(&b, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	if _, err := c.conn.Write([]byte(b.String())); err != nil {
+		return nil, err
+	}
+	return ReadReply(c.reader)
+}
+
+// Reads a reply in the redis protocol. Simple strings are returned as
+// string, integers as int64, bulk strings as []byte, arrays as
+// []interface{} and errors as the error.
+func ReadReply(r *bufio.Reader) (interface{}, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	if len(line) == 0 {
+		return nil, errors.New("empty reply from redis")
+	}
+
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, redisError(line[1:])
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		size, err := strconv.Atoi(line[1:])
+		if err != nil || size < 0 {
+			return nil, err
+		}
+		data := make([]byte, size+2)
+		if _, err := io.ReadFull(r, data); err != nil {
+			return nil, err
+		}
+		return data[:size], nil
+	case '*':
+		size, err := strconv.Atoi(line[1:])
+		if err != nil || size < 0 {
+			return nil, err
+		}
+		values := make([]interface{}, size)
+		for i := range values {
+			if values[i], err = ReadReply(r); err != nil {
+				return nil, err
+			}
+		}
+		return values, nil
+	}
+	return nil, fmt.Errorf("unexpected reply from redis: %q", line)
+}
@@ -0,0 +1,217 @@
+package ratelimit
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"fiufit.api.gateway/internal/config"
+)
+
+func TestReadReply(t *testing.T) {
+	for _, test := range []struct {
+		name  string
+		reply string
+		want  interface{}
+	}{
+		{"Simple string", "+OK\r\n", "OK"},
+		{"Integer", ":-42\r\n", int64(-42)},
+		{"Bulk string", "$5\r\nhello\r\n", []byte("hello")},
+		{"Bulk string with line breaks", "$7\r\nab\r\ncd\n\r\n", []byte("ab\r\ncd\n")},
+		{"Empty bulk string", "$0\r\n\r\n", []byte{}},
+		{"Nil bulk string", "$-1\r\n", nil},
+		{"Nil array", "*-1\r\n", nil},
+		{"Empty array", "*0\r\n", []interface{}{}},
+		{
+			"Nested arrays",
+			"*3\r\n:1\r\n*2\r\n$1\r\na\r\n$-1\r\n*1\r\n*1\r\n+deep\r\n",
+			[]interface{}{int64(1), []interface{}{[]byte("a"), nil}, []interface{}{[]interface{}{"deep"}}},
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := ReadReply(bufio.NewReader(strings.NewReader(test.reply)))
+			if err != nil {
+				t.Fatalf("Got %s, want no error", err.Error())
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("Got %#v, want %#v", got, test.want)
+			}
+		})
+	}
+
+	t.Run("Error replies are returned as errors", func(t *testing.T) {
+		_, err := ReadReply(bufio.NewReader(strings.NewReader("-NOSCRIPT No matching script\r\n")))
+		var replyErr redisError
+		if !errors.As(err, &replyErr) || string(replyErr) != "NOSCRIPT No matching script" {
+			t.Errorf("Got %v, want the NOSCRIPT error reply", err)
+		}
+	})
+
+	t.Run("Error replies inside arrays fail the whole reply", func(t *testing.T) {
+		_, err := ReadReply(bufio.NewReader(strings.NewReader("*2\r\n:1\r\n-ERR broken\r\n")))
+		var replyErr redisError
+		if !errors.As(err, &replyErr) {
+			t.Errorf("Got %v, want an error reply", err)
+		}
+	})
+
+	for name, reply := range map[string]string{
+		"Unknown type":         "!oops\r\n",
+		"Empty line":           "\r\n",
+		"Invalid integer":      ":abc\r\n",
+		"Invalid bulk length":  "$abc\r\n",
+		"Truncated bulk":       "$10\r\nabc\r\n",
+		"Truncated array":      "*2\r\n:1\r\n",
+		"Missing line end":     "+OK",
+		"Invalid array length": "*x\r\n",
+	} {
+		t.Run(name+" is rejected", func(t *testing.T) {
+			_, err := ReadReply(bufio.NewReader(strings.NewReader(reply)))
+			if err == nil {
+				t.Errorf("Got no error for %q", reply)
+			}
+			var replyErr redisError
+			if errors.As(err, &replyErr) {
+				t.Errorf("Got the error reply %q, want a protocol error", replyErr)
+			}
+		})
+	}
+}
+
+func TestRedisCommand(t *testing.T) {
+	t.Run("Commands are sent as arrays of bulk strings", func(t *testing.T) {
+		client, server := net.Pipe()
+		defer client.Close()
+		defer server.Close()
+		want := "*2\r\n$3\r\nGET\r\n$6\r\na\r\nb c\r\n"
+		sent := make(chan string, 1)
+		go func() {
+			buf := make([]byte, len(want))
+			n, _ := io.ReadFull(server, buf)
+			sent <- string(buf[:n])
+			fmt.Fprint(server, "$-1\r\n")
+		}()
+
+		conn := &redisConn{conn: client, reader: bufio.NewReader(client)}
+		reply, err := conn.command("GET", "a\r\nb c")
+
+		if got := <-sent; got != want {
+			t.Errorf("Got %q, want %q", got, want)
+		}
+		if reply != nil || err != nil {
+			t.Errorf("Got %v, %v, want a nil reply", reply, err)
+		}
+	})
+}
+
+// Serves each connection with reply, returning the number of
+// connections accepted
+func testRedisConns(t *testing.T, reply func(args []string) string) (string, *int32) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	var conns int32
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			atomic.AddInt32(&conns, 1)
+			go func(conn net.Conn) {
+				defer conn.Close()
+				reader := bufio.NewReader(conn)
+				for {
+					command, err := ReadReply(reader)
+					if err != nil {
+						return
+					}
+					var args []string
+					for _, arg := range command.([]interface{}) {
+						args = append(args, string(arg.([]byte)))
+					}
+					fmt.Fprint(conn, reply(args))
+				}
+			}(conn)
+		}
+	}()
+	return listener.Addr().String(), &conns
+}
+
+func TestRedisStore(t *testing.T) {
+	quota := config.Quota{Requests: 5, Period: time.Second}
+
+	t.Run("The script is sent again when redis doesn't have it, reusing the connection", func(t *testing.T) {
+		var commands []string
+		addr, conns := testRedisConns(t, func(args []string) string {
+			commands = append(commands, args[0])
+			switch args[0] {
+			case "AUTH":
+				return "+OK\r\n"
+			case "EVALSHA":
+				return "-NOSCRIPT No matching script\r\n"
+			}
+			return "*4\r\n:1\r\n:4\r\n:0\r\n:200\r\n"
+		})
+		store := NewRedisStore(addr, "secret")
+
+		result, err := store.Take(context.Background(), "ip:1", quota)
+
+		if err != nil {
+			t.Fatalf("Got %s, want no error", err.Error())
+		}
+		want := Result{Allowed: true, Limit: 5, Remaining: 4, Reset: 200 * time.Millisecond}
+		if result != want {
+			t.Errorf("Got %+v, want %+v", result, want)
+		}
+		if got := strings.Join(commands, ","); got != "AUTH,EVALSHA,EVAL" {
+			t.Errorf("Got commands %s, want AUTH,EVALSHA,EVAL", got)
+		}
+		if got := atomic.LoadInt32(conns); got != 1 {
+			t.Errorf("Got %d connections, want 1", got)
+		}
+	})
+
+	t.Run("Replies of an unexpected shape are rejected", func(t *testing.T) {
+		for _, reply := range []string{"*3\r\n:1\r\n:4\r\n:0\r\n", "*4\r\n:1\r\n$1\r\n4\r\n:0\r\n:200\r\n", "+OK\r\n"} {
+			addr, _ := testRedisConns(t, func([]string) string { return reply })
+
+			_, err := NewRedisStore(addr, "").Take(context.Background(), "ip:1", quota)
+
+			if err == nil {
+				t.Errorf("Got no error for reply %q", reply)
+			}
+		}
+	})
+
+	t.Run("A connection that broke the protocol isn't reused", func(t *testing.T) {
+		replies := []string{"!oops\r\n", "*4\r\n:1\r\n:4\r\n:0\r\n:200\r\n"}
+		addr, conns := testRedisConns(t, func([]string) string {
+			reply := replies[0]
+			replies = replies[1:]
+			return reply
+		})
+		store := NewRedisStore(addr, "")
+
+		if _, err := store.Take(context.Background(), "ip:1", quota); err == nil {
+			t.Fatal("Expected an error")
+		}
+		if _, err := store.Take(context.Background(), "ip:1", quota); err != nil {
+			t.Fatalf("Got %s, want no error", err.Error())
+		}
+		if got := atomic.LoadInt32(conns); got != 2 {
+			t.Errorf("Got %d connections, want 2", got)
+		}
+	})
+}
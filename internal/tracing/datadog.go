@@ -0,0 +1,60 @@
+package tracing
+
+import (
+	"context"
+	"net/http"
+
+	"gopkg.in/DataDog/dd-trace-go.v1/ddtrace"
+	"gopkg.in/DataDog/dd-trace-go.v1/ddtrace/ext"
+	ddtracer "gopkg.in/DataDog/dd-trace-go.v1/ddtrace/tracer"
+)
+
+// Datadog sends the spans to the Datadog agent. The agent and the
+// propagation styles are configured with the DD_* enviroment variables.
+type Datadog struct{}
+
+type datadogSpan struct {
+	span ddtrace.Span
+}
+
+func NewDatadog(service string) Datadog {
+	ddtracer.Start(ddtracer.WithService(service))
+	return Datadog{}
+}
+
+func (Datadog) Start(ctx context.Context, name string, r *http.Request) (context.Context, Span) {
+	var options []ddtracer.StartSpanOption
+	if _, found := ddtracer.SpanFromContext(ctx); !found && r != nil {
+		if parent, err := ddtracer.Extract(ddtracer.HTTPHeadersCarrier(r.Header)); err == nil {
+			options = append(options, ddtracer.ChildOf(parent))
+		}
+	}
+	span, ctx := ddtracer.StartSpanFromContext(ctx, name, options...)
+	return ctx, datadogSpan{span}
+}
+
+func (Datadog) Inject(ctx context.Context, header http.Header) {
+	if span, found := ddtracer.SpanFromContext(ctx); found {
+		ddtracer.Inject(span.Context(), ddtracer.HTTPHeadersCarrier(header))
+	}
+}
+
+func (Datadog) Shutdown(context.Context) error {
+	ddtracer.Stop()
+	return nil
+}
+
+func (s datadogSpan) SetAttribute(key string, value interface{}) {
+	if key == KindAttribute {
+		key = ext.SpanKind
+	}
+	s.span.SetTag(key, value)
+}
+
+func (s datadogSpan) SetError(err error) {
+	s.span.SetTag(ext.Error, err)
+}
+
+func (s datadogSpan) End() {
+	s.span.Finish()
+}
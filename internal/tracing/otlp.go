@@ -0,0 +1,182 @@
+package tracing
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// Spans waiting to be exported, new ones are dropped when full
+	otlpQueueSize = 2048
+	// Most spans sent in a single request
+	otlpBatchSize = 512
+	otlpInterval  = 5 * time.Second
+	otlpTimeout   = 10 * time.Second
+)
+
+// Attribute setting the kind of a span, server, client or internal
+const KindAttribute = "span.kind"
+
+var otlpKinds = map[interface{}]int{"internal": 1, "server": 2, "client": 3}
+
+// OTLPExporter sends the spans in batches to an OpenTelemetry collector
+// with the OTLP/HTTP JSON protocol
+type OTLPExporter struct {
+	url     string
+	service string
+	client  *http.Client
+	queue   chan SpanData
+	stop    chan struct{}
+	done    chan struct{}
+	once    sync.Once
+}
+
+// Starts exporting to the collector at endpoint, e.g.
+// http://collector:4318
+func NewOTLPExporter(endpoint, service string) *OTLPExporter {
+	e := &OTLPExporter{
+		url:     strings.TrimSuffix(endpoint, "/") + "/v1/traces",
+		service: service,
+		client:  &http.Client{Timeout: otlpTimeout},
+		queue:   make(chan SpanData, otlpQueueSize),
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	go e.run()
+	return e
+}
+
+func (e *OTLPExporter) Export(span SpanData) {
+	select {
+	case e.queue <- span:
+	default:
+		log.WithFields(log.Fields{"span": span.Name}).Warn("Tracing queue full, dropping span")
+	}
+}
+
+// Sends the spans still queued and stops the exporter
+func (e *OTLPExporter) Shutdown(ctx context.Context) error {
+	e.once.Do(func() { close(e.stop) })
+	select {
+	case <-e.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (e *OTLPExporter) run() {
+	defer close(e.done)
+	ticker := time.NewTicker(otlpInterval)
+	defer ticker.Stop()
+	batch := make([]SpanData, 0, otlpBatchSize)
+	for {
+		select {
+		case span := <-e.queue:
+			batch = append(batch, span)
+			if len(batch) < otlpBatchSize {
+				continue
+			}
+		case <-ticker.C:
+		case <-e.stop:
+			for len(e.queue) > 0 {
+				batch = append(batch, <-e.queue)
+			}
+			e.send(batch)
+			return
+		}
+		e.send(batch)
+		batch = batch[:0]
+	}
+}
+
+func (e *OTLPExporter) send(batch []SpanData) {
+	if len(batch) == 0 {
+		return
+	}
+	body, err := json.Marshal(e.request(batch))
+	if err != nil {
+		return
+	}
+	response, err := e.client.Post(e.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		log.WithFields(log.Fields{"error": err.Error(), "spans": len(batch)}).Warn("Couldn't export spans")
+		return
+	}
+	response.Body.Close()
+	if response.StatusCode >= http.StatusBadRequest {
+		log.WithFields(log.Fields{"status": response.StatusCode, "spans": len(batch)}).Warn("Collector rejected spans")
+	}
+}
+
+// Builds an ExportTraceServiceRequest in its JSON encoding
+func (e *OTLPExporter) request(batch []SpanData) map[string]interface{} {
+	spans := make([]map[string]interface{}, 0, len(batch))
+	for _, span := range batch {
+		kind, found := otlpKinds[span.Attributes[KindAttribute]]
+		if !found {
+			kind = otlpKinds["internal"]
+		}
+		otlpSpan := map[string]interface{}{
+			"traceId":           span.TraceID,
+			"spanId":            span.SpanID,
+			"name":              span.Name,
+			"kind":              kind,
+			"startTimeUnixNano": strconv.FormatInt(span.Start.UnixNano(), 10),
+			"endTimeUnixNano":   strconv.FormatInt(span.End.UnixNano(), 10),
+			"attributes":        attributes(span.Attributes),
+		}
+		if span.ParentID != "" {
+			otlpSpan["parentSpanId"] = span.ParentID
+		}
+		if span.Error != "" {
+			otlpSpan["status"] = map[string]interface{}{"code": 2, "message": span.Error}
+		}
+		spans = append(spans, otlpSpan)
+	}
+
+	return map[string]interface{}{
+		"resourceSpans": []interface{}{map[string]interface{}{
+			"resource": map[string]interface{}{
+				"attributes": attributes(map[string]interface{}{"service.name": e.service}),
+			},
+			"scopeSpans": []interface{}{map[string]interface{}{
+				"scope": map[string]interface{}{"name": "fiufit.api.gateway"},
+				"spans": spans,
+			}},
+		}},
+	}
+}
+
+func attributes(values map[string]interface{}) []map[string]interface{} {
+	attrs := make([]map[string]interface{}, 0, len(values))
+	for key, value := range values {
+		if key == KindAttribute {
+			continue
+		}
+		var encoded map[string]interface{}
+		switch v := value.(type) {
+		case bool:
+			encoded = map[string]interface{}{"boolValue": v}
+		case int:
+			encoded = map[string]interface{}{"intValue": strconv.Itoa(v)}
+		case int64:
+			encoded = map[string]interface{}{"intValue": strconv.FormatInt(v, 10)}
+		case float64:
+			encoded = map[string]interface{}{"doubleValue": v}
+		default:
+			encoded = map[string]interface{}{"stringValue": fmt.Sprint(v)}
+		}
+		attrs = append(attrs, map[string]interface{}{"key": key, "value": encoded})
+	}
+	return attrs
+}
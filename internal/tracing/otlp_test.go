@@ -0,0 +1,171 @@
+package tracing
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// Starts a collector that hands over the body of each export request
+func testCollector(t *testing.T) (string, <-chan map[string]interface{}) {
+	bodies := make(chan map[string]interface{}, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.URL.Path != "/v1/traces" || r.Header.Get("Content-Type") != "application/json" {
+			t.Errorf("Got %s %s with content type %s", r.Method, r.URL.Path, r.Header.Get("Content-Type"))
+		}
+		raw, _ := io.ReadAll(r.Body)
+		var body map[string]interface{}
+		if err := json.Unmarshal(raw, &body); err != nil {
+			t.Errorf("Got invalid JSON %s", raw)
+		}
+		bodies <- body
+	}))
+	t.Cleanup(server.Close)
+	return server.URL + "/", bodies
+}
+
+// Follows a path of object keys and array indexes through the JSON
+func lookup(t *testing.T, value interface{}, path ...interface{}) interface{} {
+	t.Helper()
+	for _, step := range path {
+		switch key := step.(type) {
+		case string:
+			object, ok := value.(map[string]interface{})
+			if !ok {
+				t.Fatalf("Got %v, want an object with %s", value, key)
+			}
+			value = object[key]
+		case int:
+			array, ok := value.([]interface{})
+			if !ok || len(array) <= key {
+				t.Fatalf("Got %v, want an array with %d elements", value, key+1)
+			}
+			value = array[key]
+		}
+	}
+	return value
+}
+
+// Decodes OTLP attributes as a map of key to typed value
+func decodeAttributes(t *testing.T, value interface{}) map[string]interface{} {
+	t.Helper()
+	attrs := make(map[string]interface{})
+	for i := range value.([]interface{}) {
+		attrs[lookup(t, value, i, "key").(string)] = lookup(t, value, i, "value")
+	}
+	return attrs
+}
+
+func TestOTLPExporter(t *testing.T) {
+	t.Run("Spans are sent as an ExportTraceServiceRequest", func(t *testing.T) {
+		url, bodies := testCollector(t)
+		exporter := NewOTLPExporter(url, "gateway")
+		start := time.Unix(1700000000, 123)
+		exporter.Export(SpanData{
+			TraceID:  "4bf92f3577b34da6a3ce929d0e0e4736",
+			SpanID:   "00f067aa0ba902b7",
+			ParentID: "b7ad6b7169203331",
+			Name:     "GET /users",
+			Start:    start,
+			End:      start.Add(time.Millisecond),
+			Attributes: map[string]interface{}{
+				KindAttribute:      "client",
+				"http.status_code": 502,
+				"retry":            true,
+				"ratio":            0.5,
+				"bytes":            int64(1) << 40,
+				"http.route":       "/users",
+			},
+			Error: "connection refused",
+		})
+		exporter.Export(SpanData{TraceID: "4bf92f3577b34da6a3ce929d0e0e4736", SpanID: "b7ad6b7169203331", Name: "root", Start: start, End: start})
+
+		if err := exporter.Shutdown(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		body := <-bodies
+
+		resource := decodeAttributes(t, lookup(t, body, "resourceSpans", 0, "resource", "attributes"))
+		if want := map[string]interface{}{"service.name": map[string]interface{}{"stringValue": "gateway"}}; !reflect.DeepEqual(resource, want) {
+			t.Errorf("Got resource attributes %v, want %v", resource, want)
+		}
+		if got := lookup(t, body, "resourceSpans", 0, "scopeSpans", 0, "scope", "name"); got != "fiufit.api.gateway" {
+			t.Errorf("Got scope %v, want fiufit.api.gateway", got)
+		}
+
+		spans := lookup(t, body, "resourceSpans", 0, "scopeSpans", 0, "spans").([]interface{})
+		if len(spans) != 2 {
+			t.Fatalf("Got %d spans, want 2", len(spans))
+		}
+		span := spans[0].(map[string]interface{})
+		for key, want := range map[string]interface{}{
+			"traceId":           "4bf92f3577b34da6a3ce929d0e0e4736",
+			"spanId":            "00f067aa0ba902b7",
+			"parentSpanId":      "b7ad6b7169203331",
+			"name":              "GET /users",
+			"kind":              3.0,
+			"startTimeUnixNano": "1700000000000000123",
+			"endTimeUnixNano":   "1700000000001000123",
+			"status":            map[string]interface{}{"code": 2.0, "message": "connection refused"},
+		} {
+			if !reflect.DeepEqual(span[key], want) {
+				t.Errorf("Got %s %#v, want %#v", key, span[key], want)
+			}
+		}
+		wantAttributes := map[string]interface{}{
+			"http.status_code": map[string]interface{}{"intValue": "502"},
+			"retry":            map[string]interface{}{"boolValue": true},
+			"ratio":            map[string]interface{}{"doubleValue": 0.5},
+			"bytes":            map[string]interface{}{"intValue": "1099511627776"},
+			"http.route":       map[string]interface{}{"stringValue": "/users"},
+		}
+		if got := decodeAttributes(t, span["attributes"]); !reflect.DeepEqual(got, wantAttributes) {
+			t.Errorf("Got attributes %v, want %v", got, wantAttributes)
+		}
+
+		root := spans[1].(map[string]interface{})
+		if root["kind"] != 1.0 {
+			t.Errorf("Got kind %v, want internal spans by default", root["kind"])
+		}
+		for _, key := range []string{"parentSpanId", "status"} {
+			if _, found := root[key]; found {
+				t.Errorf("Got %s in a root span without error", key)
+			}
+		}
+	})
+
+	t.Run("Nothing is sent without spans", func(t *testing.T) {
+		url, bodies := testCollector(t)
+		exporter := NewOTLPExporter(url, "gateway")
+
+		if err := exporter.Shutdown(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case body := <-bodies:
+			t.Errorf("Got %v, want no request", body)
+		default:
+		}
+	})
+
+	t.Run("Shutdown gives up when the context ends", func(t *testing.T) {
+		blocked := make(chan struct{})
+		server := httptest.NewServer(http.HandlerFunc(func(http.ResponseWriter, *http.Request) { <-blocked }))
+		defer server.Close()
+		defer close(blocked)
+		exporter := NewOTLPExporter(server.URL, "gateway")
+		exporter.Export(SpanData{Name: "slow"})
+		ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+		defer cancel()
+
+		if err := exporter.Shutdown(ctx); !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("Got %v, want %v", err, context.DeadlineExceeded)
+		}
+	})
+}
@@ -0,0 +1,159 @@
+package tracing
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const traceparentHeader = "traceparent"
+
+// Finished span as handed to the exporters
+type SpanData struct {
+	TraceID    string
+	SpanID     string
+	ParentID   string
+	Name       string
+	Start      time.Time
+	End        time.Time
+	Attributes map[string]interface{}
+	Error      string
+}
+
+// Exporter sends the finished spans to a tracing backend
+type Exporter interface {
+	Export(span SpanData)
+	Shutdown(ctx context.Context) error
+}
+
+// Tracer records spans identified as in W3C trace context and hands
+// them to an exporter once they end
+type tracer struct {
+	service  string
+	exporter Exporter
+}
+
+func NewTracer(service string, exporter Exporter) Tracer {
+	return &tracer{service: service, exporter: exporter}
+}
+
+type span struct {
+	mu       sync.Mutex
+	tracer   *tracer
+	data     SpanData
+	sampled  bool
+	finished bool
+}
+
+type spanKey struct{}
+
+func (t *tracer) Start(ctx context.Context, name string, r *http.Request) (context.Context, Span) {
+	s := &span{tracer: t, sampled: true, data: SpanData{
+		SpanID:     randomHex(8),
+		Name:       name,
+		Start:      time.Now(),
+		Attributes: map[string]interface{}{"service.name": t.service},
+	}}
+	if parent, ok := ctx.Value(spanKey{}).(*span); ok {
+		s.data.TraceID = parent.data.TraceID
+		s.data.ParentID = parent.data.SpanID
+		s.sampled = parent.sampled
+	} else if traceID, parentID, sampled, ok := parseTraceparent(headerOf(r)); ok {
+		s.data.TraceID = traceID
+		s.data.ParentID = parentID
+		s.sampled = sampled
+	} else {
+		s.data.TraceID = randomHex(16)
+	}
+	return context.WithValue(ctx, spanKey{}, s), s
+}
+
+func (t *tracer) Inject(ctx context.Context, header http.Header) {
+	s, ok := ctx.Value(spanKey{}).(*span)
+	if !ok {
+		return
+	}
+	flags := "00"
+	if s.sampled {
+		flags = "01"
+	}
+	header.Set(traceparentHeader, fmt.Sprintf("00-%s-%s-%s", s.data.TraceID, s.data.SpanID, flags))
+}
+
+func (t *tracer) Shutdown(ctx context.Context) error {
+	return t.exporter.Shutdown(ctx)
+}
+
+func (s *span) SetAttribute(key string, value interface{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.data.Attributes[key] = value
+}
+
+func (s *span) SetError(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.data.Error = err.Error()
+}
+
+func (s *span) End() {
+	s.mu.Lock()
+	if s.finished {
+		s.mu.Unlock()
+		return
+	}
+	s.finished = true
+	s.data.End = time.Now()
+	data := s.data
+	s.mu.Unlock()
+
+	if s.sampled {
+		s.tracer.exporter.Export(data)
+	}
+}
+
+func headerOf(r *http.Request) string {
+	if r == nil {
+		return ""
+	}
+	return r.Header.Get(traceparentHeader)
+}
+
+// Parses a traceparent header, version-trace id-parent id-flags
+func parseTraceparent(value string) (traceID, parentID string, sampled, ok bool) {
+	parts := strings.Split(strings.TrimSpace(value), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" {
+		return "", "", false, false
+	}
+	if !isHex(parts[1], 32) || !isHex(parts[2], 16) || !isHex(parts[3], 2) {
+		return "", "", false, false
+	}
+	if strings.Trim(parts[1], "0") == "" || strings.Trim(parts[2], "0") == "" {
+		return "", "", false, false
+	}
+	flags, _ := hex.DecodeString(parts[3])
+	return parts[1], parts[2], flags[0]&1 == 1, true
+}
+
+func isHex(s string, length int) bool {
+	if len(s) != length {
+		return false
+	}
+	for _, r := range s {
+		if !(r >= '0' && r <= '9' || r >= 'a' && r <= 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+func randomHex(size int) string {
+	id := make([]byte, size)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
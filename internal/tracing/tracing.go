@@ -0,0 +1,89 @@
+package tracing
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"fiufit.api.gateway/internal/config"
+)
+
+// Span is an operation being traced
+type Span interface {
+	SetAttribute(key string, value interface{})
+	// Marks the operation as failed
+	SetError(err error)
+	End()
+}
+
+// Tracer starts spans and propagates them to other services
+type Tracer interface {
+	// Starts a span child of the one in the context, or of the one in
+	// the propagation headers of the request if given
+	Start(ctx context.Context, name string, r *http.Request) (context.Context, Span)
+	// Adds the propagation headers of the span in the context
+	Inject(ctx context.Context, header http.Header)
+	// Flushes the pending spans and stops the tracer
+	Shutdown(ctx context.Context) error
+}
+
+type tracerKey struct{}
+
+// Returns a copy of the context carrying the tracer, used to start the
+// spans of the request
+func WithTracer(ctx context.Context, t Tracer) context.Context {
+	return context.WithValue(ctx, tracerKey{}, t)
+}
+
+// Returns the tracer of the context, or one that traces nothing
+func FromContext(ctx context.Context) Tracer {
+	if t, ok := ctx.Value(tracerKey{}).(Tracer); ok {
+		return t
+	}
+	return Noop{}
+}
+
+// Starts a span child of the one in the context with its tracer
+func StartSpan(ctx context.Context, name string) (context.Context, Span) {
+	return FromContext(ctx).Start(ctx, name, nil)
+}
+
+// Adds the propagation headers of the span in the context
+func Inject(ctx context.Context, header http.Header) {
+	FromContext(ctx).Inject(ctx, header)
+}
+
+// Builds the tracer selected in the configuration
+func New(settings config.Tracing) (Tracer, error) {
+	switch settings.Provider {
+	case config.DatadogTracing:
+		return NewDatadog(settings.ServiceName), nil
+	case config.OTLPTracing:
+		return NewTracer(settings.ServiceName, NewOTLPExporter(settings.OTLPEndpoint, settings.ServiceName)), nil
+	case config.NoTracing:
+		return Noop{}, nil
+	}
+	return nil, errors.New(fmt.Sprintf("unknown tracing provider %s", settings.Provider))
+}
+
+// Noop traces nothing
+type Noop struct{}
+
+type noopSpan struct{}
+
+func (Noop) Start(ctx context.Context, _ string, _ *http.Request) (context.Context, Span) {
+	return ctx, noopSpan{}
+}
+
+func (Noop) Inject(context.Context, http.Header) {}
+
+func (Noop) Shutdown(context.Context) error {
+	return nil
+}
+
+func (noopSpan) SetAttribute(string, interface{}) {}
+
+func (noopSpan) SetError(error) {}
+
+func (noopSpan) End() {}
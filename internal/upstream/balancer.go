@@ -0,0 +1,101 @@
+package upstream
+
+import (
+	"hash/crc32"
+	"sort"
+	"strconv"
+	"sync/atomic"
+)
+
+const (
+	RoundRobin       = "round-robin"
+	LeastOutstanding = "least-outstanding"
+	ConsistentHash   = "consistent-hash"
+)
+
+// Number of points each instance takes in the consistent hash ring
+const virtualNodes = 100
+
+// Balancer chooses the instance that handles a request among the
+// available ones. The key identifies the client making the request and
+// is only used by balancers that need affinity.
+type Balancer interface {
+	Pick(available []*Instance, key string) *Instance
+}
+
+// Returns the balancer registered under name for the given instances,
+// round robin is used when the name is empty.
+func NewBalancer(name string, instances []*Instance) Balancer {
+	switch name {
+	case LeastOutstanding:
+		return &leastOutstanding{}
+	case ConsistentHash:
+		return newHashRing(instances)
+	default:
+		return &roundRobin{}
+	}
+}
+
+// Returns whether name references a known balancing strategy
+func IsBalancer(name string) bool {
+	return name == RoundRobin || name == LeastOutstanding || name == ConsistentHash
+}
+
+type roundRobin struct {
+	next uint64
+}
+
+func (b *roundRobin) Pick(available []*Instance, _ string) *Instance {
+	n := atomic.AddUint64(&b.next, 1)
+	return available[(n-1)%uint64(len(available))]
+}
+
+type leastOutstanding struct{}
+
+func (b *leastOutstanding) Pick(available []*Instance, _ string) *Instance {
+	chosen := available[0]
+	for _, instance := range available[1:] {
+		if instance.Outstanding() < chosen.Outstanding() {
+			chosen = instance
+		}
+	}
+	return chosen
+}
+
+// Maps keys to instances so the same client keeps hitting the same
+// instance while it's available. When it isn't, the key moves to the
+// next available instance in the ring.
+type hashRing struct {
+	points    []uint32
+	instances map[uint32]*Instance
+}
+
+func newHashRing(instances []*Instance) *hashRing {
+	ring := &hashRing{instances: make(map[uint32]*Instance)}
+	for _, instance := range instances {
+		for i := 0; i < virtualNodes; i++ {
+			point := crc32.ChecksumIEEE([]byte(instance.URL.String() + "#" + strconv.Itoa(i)))
+			ring.points = append(ring.points, point)
+			ring.instances[point] = instance
+		}
+	}
+	sort.Slice(ring.points, func(i, j int) bool { return ring.points[i] < ring.points[j] })
+	return ring
+}
+
+func (b *hashRing) Pick(available []*Instance, key string) *Instance {
+	isAvailable := make(map[*Instance]bool, len(available))
+	for _, instance := range available {
+		isAvailable[instance] = true
+	}
+
+	hash := crc32.ChecksumIEEE([]byte(key))
+	start := sort.Search(len(b.points), func(i int) bool { return b.points[i] >= hash })
+	for i := 0; i < len(b.points); i++ {
+		instance := b.instances[b.points[(start+i)%len(b.points)]]
+		if isAvailable[instance] {
+			return instance
+		}
+	}
+	return available[0]
+}
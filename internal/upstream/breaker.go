@@ -0,0 +1,205 @@
+package upstream
+
+import (
+	"sync"
+	"time"
+
+	"fiufit.api.gateway/internal/config"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	Closed   = "closed"
+	Open     = "open"
+	HalfOpen = "half-open"
+)
+
+// Number of buckets the rolling window is split in
+const breakerBuckets = 10
+
+type bucket struct {
+	start     time.Time
+	successes int
+	failures  int
+}
+
+// Breaker stops sending requests to an upstream whose failure rate over
+// the rolling window reaches the threshold. After OpenTime it lets a
+// few requests through and closes again if all of them succeed.
+type Breaker struct {
+	mu       sync.Mutex
+	service  string
+	settings config.Breaker
+	state    string
+	// When the breaker last changed its state
+	changed  time.Time
+	buckets  [breakerBuckets]bucket
+	probes   int
+	probesOK int
+}
+
+// Snapshot of a breaker, as exposed in the admin endpoint
+type BreakerState struct {
+	Service     string  `json:"service"`
+	State       string  `json:"state"`
+	Requests    int     `json:"requests"`
+	FailureRate float64 `json:"failure_rate"`
+	// Seconds until the breaker lets requests through again
+	RetryAfter int `json:"retry_after,omitempty"`
+}
+
+func newBreaker(service string, settings config.Breaker) *Breaker {
+	return &Breaker{service: service, settings: settings, state: Closed, changed: time.Now()}
+}
+
+func (b *Breaker) enabled() bool {
+	return b.settings.FailureRate > 0
+}
+
+// Returns whether a request may be sent to the upstream, and if not,
+// the time until the breaker lets requests through again.
+func (b *Breaker) Allow() (bool, time.Duration) {
+	if !b.enabled() {
+		return true, 0
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := time.Now()
+	switch b.state {
+	case Open:
+		reopen := b.changed.Add(b.settings.OpenTime)
+		if now.Before(reopen) {
+			return false, reopen.Sub(now)
+		}
+		b.setState(HalfOpen, now)
+	case HalfOpen:
+		// Probes that never reported back, e.g. cancelled by the
+		// client, mustn't keep the breaker half-open forever
+		if b.probes >= b.settings.HalfOpenRequests && now.Sub(b.changed) > b.settings.OpenTime {
+			b.setState(HalfOpen, now)
+		}
+	}
+
+	if b.state == HalfOpen {
+		if b.probes >= b.settings.HalfOpenRequests {
+			return false, b.settings.OpenTime
+		}
+		b.probes++
+	}
+	return true, 0
+}
+
+// Gives back the probe taken by a call to Allow whose request wasn't
+// sent after all, so it doesn't hold the breaker half-open
+func (b *Breaker) release() {
+	if !b.enabled() {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state == HalfOpen && b.probes > 0 {
+		b.probes--
+	}
+}
+
+// Records the outcome of a request sent to the upstream
+func (b *Breaker) Record(success bool) {
+	if !b.enabled() {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := time.Now()
+	switch b.state {
+	case HalfOpen:
+		if !success {
+			b.setState(Open, now)
+			return
+		}
+		b.probesOK++
+		if b.probesOK >= b.settings.HalfOpenRequests {
+			b.setState(Closed, now)
+		}
+	case Closed:
+		current := b.bucket(now)
+		if success {
+			current.successes++
+		} else {
+			current.failures++
+		}
+		requests, rate := b.failureRate(now)
+		if requests >= b.settings.MinRequests && rate >= b.settings.FailureRate {
+			b.setState(Open, now)
+		}
+	}
+}
+
+// Returns a snapshot of the breaker
+func (b *Breaker) State() BreakerState {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := time.Now()
+	requests, rate := b.failureRate(now)
+	state := BreakerState{Service: b.service, State: b.state, Requests: requests, FailureRate: rate}
+	if b.state == Open {
+		state.RetryAfter = RetryAfter(b.changed.Add(b.settings.OpenTime).Sub(now))
+	}
+	return state
+}
+
+func (b *Breaker) setState(state string, now time.Time) {
+	if b.state != state {
+		log.WithFields(log.Fields{"upstream": b.service, "from": b.state, "to": state}).Warn("Circuit breaker changed state")
+	}
+	b.state = state
+	b.changed = now
+	b.probes = 0
+	b.probesOK = 0
+	if state == Closed {
+		b.buckets = [breakerBuckets]bucket{}
+	}
+}
+
+// Returns the bucket of the rolling window for the current time,
+// resetting it if it belongs to a previous window
+func (b *Breaker) bucket(now time.Time) *bucket {
+	width := b.settings.Window / breakerBuckets
+	if width <= 0 {
+		width = 1
+	}
+	start := now.Truncate(width)
+	current := &b.buckets[(start.UnixNano()/int64(width))%breakerBuckets]
+	if !current.start.Equal(start) {
+		*current = bucket{start: start}
+	}
+	return current
+}
+
+// Returns the requests and the failure rate over the rolling window
+func (b *Breaker) failureRate(now time.Time) (int, float64) {
+	var successes, failures int
+	for _, bucket := range b.buckets {
+		if now.Sub(bucket.start) >= b.settings.Window {
+			continue
+		}
+		successes += bucket.successes
+		failures += bucket.failures
+	}
+	requests := successes + failures
+	if requests == 0 {
+		return 0, 0
+	}
+	return requests, float64(failures) / float64(requests)
+}
+
+// Rounds up the wait to whole seconds, as used in Retry-After
+func RetryAfter(d time.Duration) int {
+	seconds := int((d + time.Second - 1) / time.Second)
+	if seconds < 1 {
+		return 1
+	}
+	return seconds
+}
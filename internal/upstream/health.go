@@ -0,0 +1,91 @@
+package upstream
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"path"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Probes every instance of the upstream periodically until the context
+// is done. Instances that fail the probe aren't picked until they pass
+// it again. It returns immediately if health checks are disabled.
+func (u *Upstream) Start(ctx context.Context) {
+	if u.options.HealthPath == "" || u.options.HealthInterval <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(u.options.HealthInterval)
+	defer ticker.Stop()
+	for {
+		u.probeAll(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (u *Upstream) probeAll(ctx context.Context) {
+	for _, instance := range u.instances {
+		healthy := u.probe(ctx, instance) == nil
+		var unhealthy int32
+		if !healthy {
+			unhealthy = 1
+		}
+
+		previous := atomic.SwapInt32(&instance.unhealthy, unhealthy)
+		if previous != unhealthy {
+			log.WithFields(log.Fields{
+				"upstream": u.Name,
+				"instance": instance.URL.String(),
+				"healthy":  healthy,
+			}).Warn("Instance health changed")
+		}
+	}
+}
+
+// Returns nil if any instance of the upstream can be reached, an error
+// describing the failure of the last one otherwise
+func (u *Upstream) Check(ctx context.Context) error {
+	var err error
+	for _, instance := range u.instances {
+		if err = u.probe(ctx, instance); err == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+// Returns nil if the health path of the instance answers with a 2xx
+// before the next probe is due. Without health path any response to
+// the root of the instance counts.
+func (u *Upstream) probe(ctx context.Context, instance *Instance) error {
+	if u.options.HealthInterval > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, u.options.HealthInterval)
+		defer cancel()
+	}
+
+	probeURL := *instance.URL
+	probeURL.Path = path.Join("/", probeURL.Path, u.options.HealthPath)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, probeURL.String(), nil)
+	if err != nil {
+		return err
+	}
+
+	response, err := u.client.Do(req)
+	if err != nil {
+		return err
+	}
+	response.Body.Close()
+	if u.options.HealthPath != "" && (response.StatusCode < 200 || response.StatusCode >= 300) {
+		return fmt.Errorf("%s answered %s", probeURL.String(), response.Status)
+	}
+	return nil
+}
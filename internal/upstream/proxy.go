@@ -0,0 +1,312 @@
+package upstream
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+	"time"
+
+	"fiufit.api.gateway/internal/config"
+	"fiufit.api.gateway/internal/metrics"
+	"fiufit.api.gateway/internal/problem"
+	"fiufit.api.gateway/internal/tracing"
+	log "github.com/sirupsen/logrus"
+)
+
+type targetKey struct{}
+
+// Instance chosen for a request and the key the balancer used to
+// choose it, retries use the key to choose another one
+type target struct {
+	instance *Instance
+	key      string
+}
+
+// Returns a copy of the context of a request that will be sent to
+// instance when served by the upstream
+func WithInstance(ctx context.Context, instance *Instance, key string) context.Context {
+	return context.WithValue(ctx, targetKey{}, target{instance: instance, key: key})
+}
+
+func instanceFromContext(ctx context.Context) *Instance {
+	t, _ := ctx.Value(targetKey{}).(target)
+	return t.instance
+}
+
+func balancingKeyFromContext(ctx context.Context) string {
+	t, _ := ctx.Value(targetKey{}).(target)
+	return t.key
+}
+
+type clientIPKey struct{}
+
+// Returns a copy of the context of a request with the IP of the client
+// that sent it, as resolved by the router, for the proxy logs
+func WithClientIP(ctx context.Context, ip string) context.Context {
+	return context.WithValue(ctx, clientIPKey{}, ip)
+}
+
+func clientIPFromContext(ctx context.Context) string {
+	ip, _ := ctx.Value(clientIPKey{}).(string)
+	return ip
+}
+
+type timeoutsKey struct{}
+
+// Returns a copy of the context of a request with the timeouts of its
+// route, which override the connect and response header timeouts of
+// the upstream when not zero
+func WithTimeouts(ctx context.Context, timeouts config.Timeouts) context.Context {
+	return context.WithValue(ctx, timeoutsKey{}, timeouts)
+}
+
+func timeoutsFromContext(ctx context.Context) config.Timeouts {
+	timeouts, _ := ctx.Value(timeoutsKey{}).(config.Timeouts)
+	return timeouts
+}
+
+// Builds the transport shared by every request sent to the upstream.
+// Dials are bounded by the connect timeout of the route of the request
+// if it sets one, or else by the one of the upstream. The response
+// header timeout is applied by headerTimeoutTransport.
+func newTransport(settings config.Transport) *http.Transport {
+	dialer := &net.Dialer{KeepAlive: settings.KeepAlive}
+	dial := func(ctx context.Context, network, address string) (net.Conn, error) {
+		timeout := settings.ConnectTimeout
+		if routeTimeout := timeoutsFromContext(ctx).Connect; routeTimeout > 0 {
+			timeout = routeTimeout
+		}
+		if timeout > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, timeout)
+			defer cancel()
+		}
+		return dialer.DialContext(ctx, network, address)
+	}
+	return &http.Transport{
+		Proxy:               http.ProxyFromEnvironment,
+		DialContext:         dial,
+		TLSHandshakeTimeout: settings.ConnectTimeout,
+		MaxIdleConns:        settings.MaxIdleConns,
+		MaxIdleConnsPerHost: settings.MaxIdleConnsPerHost,
+		IdleConnTimeout:     settings.IdleConnTimeout,
+		DisableKeepAlives:   settings.DisableKeepAlives,
+		ForceAttemptHTTP2:   settings.HTTP2,
+	}
+}
+
+// Builds the reverse proxy of the upstream, it forwards each request to
+// the instance set with WithInstance.
+func (u *Upstream) newProxy() *httputil.ReverseProxy {
+	return &httputil.ReverseProxy{
+		Director:     director,
+		Transport:    &retryTransport{upstream: u, next: &tracedTransport{upstream: u, next: u.headerTimeoutTransport()}},
+		ErrorHandler: u.handleError,
+	}
+}
+
+// Traces each attempt to send a request to an instance and propagates
+// the trace to it
+type tracedTransport struct {
+	upstream *Upstream
+	next     http.RoundTripper
+}
+
+func (t *tracedTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	ctx, span := tracing.StartSpan(r.Context(), "upstream "+t.upstream.Name)
+	defer span.End()
+	span.SetAttribute(tracing.KindAttribute, "client")
+	span.SetAttribute("http.method", r.Method)
+	span.SetAttribute("http.url", r.URL.String())
+	span.SetAttribute("upstream", t.upstream.Name)
+
+	req := r.Clone(ctx)
+	tracing.Inject(ctx, req.Header)
+	response, err := t.next.RoundTrip(req)
+	if err != nil {
+		span.SetError(err)
+		return nil, err
+	}
+	span.SetAttribute("http.status_code", response.StatusCode)
+	if response.StatusCode >= http.StatusInternalServerError {
+		span.SetError(errors.New(response.Status))
+	}
+	return response, nil
+}
+
+// Gives up on each request whose response headers don't arrive within
+// the response header timeout of its route, or else of the upstream.
+// Under the retry transport it bounds each attempt on its own.
+type headerTimeoutTransport struct {
+	timeout time.Duration
+	next    http.RoundTripper
+}
+
+func (u *Upstream) headerTimeoutTransport() *headerTimeoutTransport {
+	return &headerTimeoutTransport{timeout: u.options.Transport.ResponseHeaderTimeout, next: u.transport}
+}
+
+func (t *headerTimeoutTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	timeout := t.timeout
+	if routeTimeout := timeoutsFromContext(r.Context()).ResponseHeader; routeTimeout > 0 {
+		timeout = routeTimeout
+	}
+	if timeout <= 0 {
+		return t.next.RoundTrip(r)
+	}
+
+	ctx, cancel := context.WithCancel(r.Context())
+	timer := time.AfterFunc(timeout, cancel)
+	response, err := t.next.RoundTrip(r.WithContext(ctx))
+	if !timer.Stop() {
+		cancel()
+		if response != nil {
+			response.Body.Close()
+		}
+		return nil, errResponseHeaderTimeout
+	}
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	// The request must outlive the headers until its body is read
+	response.Body = &outstandingBody{ReadCloser: response.Body, done: cancel}
+	return response, nil
+}
+
+// Error of a request whose response headers didn't arrive in time,
+// it's a timeout but, unlike the deadline of the request, it doesn't
+// prevent retrying on another instance
+var errResponseHeaderTimeout error = headerTimeoutError{}
+
+type headerTimeoutError struct{}
+
+func (headerTimeoutError) Error() string {
+	return "timeout awaiting response headers"
+}
+
+func (headerTimeoutError) Timeout() bool {
+	return true
+}
+
+func (headerTimeoutError) Temporary() bool {
+	return true
+}
+
+// Same as the director of httputil.NewSingleHostReverseProxy, but the
+// target is the instance of the request
+func director(r *http.Request) {
+	instance := instanceFromContext(r.Context())
+	if instance == nil {
+		return
+	}
+	target := instance.URL
+	targetQuery := target.RawQuery
+	r.URL.Scheme = target.Scheme
+	r.URL.Host = target.Host
+	r.URL.Path, r.URL.RawPath = joinURLPath(target, r.URL)
+	if targetQuery == "" || r.URL.RawQuery == "" {
+		r.URL.RawQuery = targetQuery + r.URL.RawQuery
+	} else {
+		r.URL.RawQuery = targetQuery + "&" + r.URL.RawQuery
+	}
+	r.Host = target.Host
+}
+
+func joinURLPath(a, b *url.URL) (path, rawpath string) {
+	if a.RawPath == "" && b.RawPath == "" {
+		return singleJoiningSlash(a.Path, b.Path), ""
+	}
+	apath := a.EscapedPath()
+	bpath := b.EscapedPath()
+
+	aslash := strings.HasSuffix(apath, "/")
+	bslash := strings.HasPrefix(bpath, "/")
+
+	switch {
+	case aslash && bslash:
+		return a.Path + b.Path[1:], apath + bpath[1:]
+	case !aslash && !bslash:
+		return a.Path + "/" + b.Path, apath + "/" + bpath
+	}
+	return a.Path + b.Path, apath + bpath
+}
+
+func singleJoiningSlash(a, b string) string {
+	aslash := strings.HasSuffix(a, "/")
+	bslash := strings.HasPrefix(b, "/")
+	switch {
+	case aslash && bslash:
+		return a + b[1:]
+	case !aslash && !bslash:
+		return a + "/" + b
+	}
+	return a + b
+}
+
+// Responds 504 if the request timed out and 502 otherwise. The failure
+// was already reported against the instance of the last attempt.
+func (u *Upstream) handleError(rw http.ResponseWriter, r *http.Request, e error) {
+	fields := log.Fields{
+		"uri":        r.RequestURI,
+		"client_ip":  clientIPFromContext(r.Context()),
+		"upstream":   u.Name,
+		"error":      e.Error(),
+		"request_id": r.Header.Get(problem.RequestIDHeader),
+	}
+	var attemptErr *attemptError
+	if errors.As(e, &attemptErr) && attemptErr.instance != nil {
+		fields["instance"] = attemptErr.instance.URL.String()
+	}
+	log.WithFields(fields).Info("Reverse proxy failed")
+	switch {
+	case errors.Is(e, context.Canceled):
+		metrics.ProxyErrors.Inc(u.Name, "canceled")
+	case IsTimeout(e):
+		metrics.ProxyErrors.Inc(u.Name, "timeout")
+	default:
+		metrics.ProxyErrors.Inc(u.Name, "connection")
+	}
+
+	if IsTimeout(e) {
+		problem.Write(rw, r, problem.New(http.StatusGatewayTimeout, problem.UpstreamTimeout, "upstream "+u.Name+" timed out"))
+		return
+	}
+	problem.Write(rw, r, problem.New(http.StatusBadGateway, problem.BadGateway, "upstream "+u.Name+" couldn't be reached"))
+}
+
+// Returns whether the error was caused by a deadline or a connection
+// timeout
+func IsTimeout(err error) bool {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// Forwards the request to the instance set with WithInstance
+func (u *Upstream) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	u.proxy.ServeHTTP(w, r)
+}
+
+// Returns a client that sends requests through the upstream transport
+// and gives up after the timeout of the upstream
+func (u *Upstream) Client() *http.Client {
+	return u.client
+}
+
+// Returns the time a request to the upstream may take when the route
+// doesn't set a deadline, zero means no limit.
+func (u *Upstream) Timeout() time.Duration {
+	return u.options.Timeout
+}
+
+// Returns the retry policy used when the route doesn't set one
+func (u *Upstream) Retry() config.Retry {
+	return u.options.Retry
+}
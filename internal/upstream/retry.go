@@ -0,0 +1,240 @@
+package upstream
+
+import (
+	"context"
+	"errors"
+	"io"
+	"math/rand"
+	"net/http"
+	"sync"
+	"time"
+
+	"fiufit.api.gateway/internal/config"
+	"fiufit.api.gateway/internal/problem"
+	log "github.com/sirupsen/logrus"
+)
+
+// Retries a budget can accumulate while the upstream is healthy
+const maxRetryTokens = 10
+
+type retryKey struct{}
+
+// Returns a copy of the context of a request that will be retried
+// following policy. The body of the request must be replayable through
+// GetBody.
+func WithRetry(ctx context.Context, policy config.Retry) context.Context {
+	return context.WithValue(ctx, retryKey{}, policy)
+}
+
+func retryFromContext(ctx context.Context) (config.Retry, bool) {
+	policy, found := ctx.Value(retryKey{}).(config.Retry)
+	return policy, found && policy.Attempts > 1
+}
+
+// Bounds the retries to a fraction of the requests. Every request
+// deposits ratio tokens and every retry takes one, so when the upstream
+// is failing the load multiplies by at most 1 + ratio.
+type retryBudget struct {
+	mu     sync.Mutex
+	tokens float64
+	ratio  float64
+}
+
+func newRetryBudget(ratio float64) *retryBudget {
+	return &retryBudget{tokens: maxRetryTokens, ratio: ratio}
+}
+
+func (b *retryBudget) deposit() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.tokens += b.ratio
+	if b.tokens > maxRetryTokens {
+		b.tokens = maxRetryTokens
+	}
+}
+
+func (b *retryBudget) withdraw() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// Sends the request to the upstream and, if its context carries a retry
+// policy, retries it on connection errors and retryable statuses. Each
+// retry goes to the instance chosen by the balancer at that moment, and
+// the outcome of every attempt is reported against the instance it was
+// sent to.
+type retryTransport struct {
+	upstream *Upstream
+	next     http.RoundTripper
+}
+
+func (t *retryTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	t.upstream.budget.deposit()
+	policy, found := retryFromContext(r.Context())
+
+	req := r
+	for attempt := 1; ; attempt++ {
+		response, err := t.send(req)
+		if !found || attempt >= policy.Attempts || !shouldRetry(policy, response, err) {
+			return response, err
+		}
+		if !t.upstream.budget.withdraw() {
+			log.WithFields(log.Fields{
+				"upstream":   t.upstream.Name,
+				"request_id": r.Header.Get(problem.RequestIDHeader),
+			}).Warn("Retry budget exhausted")
+			return response, err
+		}
+		if allowed, _ := t.upstream.Allow(); !allowed {
+			return response, err
+		}
+
+		status := 0
+		if response != nil {
+			status = response.StatusCode
+			io.Copy(io.Discard, response.Body)
+			response.Body.Close()
+		}
+
+		last := instanceFromContext(req.Context())
+		if err := sleep(r.Context(), backoff(policy, attempt)); err != nil {
+			// The retry was let through the breaker but won't be sent
+			t.upstream.breaker.release()
+			return nil, &attemptError{instance: last, err: err}
+		}
+		req, err = t.nextAttempt(r)
+		if err != nil {
+			t.upstream.breaker.release()
+			return nil, &attemptError{instance: last, err: err}
+		}
+		log.WithFields(log.Fields{
+			"upstream":   t.upstream.Name,
+			"attempt":    attempt + 1,
+			"status":     status,
+			"instance":   req.URL.Host,
+			"request_id": r.Header.Get(problem.RequestIDHeader),
+		}).Info("Retrying upstream request")
+	}
+}
+
+// Sends one attempt to the instance set in the context of the request
+// and reports its outcome. The instance counts the attempt as
+// outstanding until the body of the response is closed. Attempts
+// cancelled by the client aren't reported as failures of the instance.
+func (t *retryTransport) send(r *http.Request) (*http.Response, error) {
+	instance := instanceFromContext(r.Context())
+	if instance == nil {
+		return t.next.RoundTrip(r)
+	}
+
+	done := instance.Begin()
+	response, err := t.next.RoundTrip(r)
+	if err != nil {
+		done()
+		if !errors.Is(err, context.Canceled) {
+			t.upstream.Report(instance, 0, err)
+		}
+		return nil, &attemptError{instance: instance, err: err}
+	}
+	t.upstream.Report(instance, response.StatusCode, nil)
+	response.Body = &outstandingBody{ReadCloser: response.Body, done: done}
+	return response, nil
+}
+
+// attemptError is the error of the last attempt to send a request,
+// with the instance it was sent to
+type attemptError struct {
+	instance *Instance
+	err      error
+}
+
+func (e *attemptError) Error() string {
+	return e.err.Error()
+}
+
+func (e *attemptError) Unwrap() error {
+	return e.err
+}
+
+// Body of a response that runs done once closed, ending the
+// outstanding request of the instance or the context of the attempt
+type outstandingBody struct {
+	io.ReadCloser
+	once sync.Once
+	done func()
+}
+
+func (b *outstandingBody) Close() error {
+	b.once.Do(b.done)
+	return b.ReadCloser.Close()
+}
+
+// Copies the original request with a fresh body and the instance
+// currently chosen by the balancer as target
+func (t *retryTransport) nextAttempt(r *http.Request) (*http.Request, error) {
+	key := balancingKeyFromContext(r.Context())
+	instance := t.upstream.Pick(key)
+	req := r.Clone(WithInstance(r.Context(), instance, key))
+	if r.GetBody != nil {
+		body, err := r.GetBody()
+		if err != nil {
+			return nil, err
+		}
+		req.Body = body
+	}
+	req.URL.Scheme = instance.URL.Scheme
+	req.URL.Host = instance.URL.Host
+	req.Host = instance.URL.Host
+	return req, nil
+}
+
+func shouldRetry(policy config.Retry, response *http.Response, err error) bool {
+	if err != nil {
+		return !errors.Is(err, context.Canceled) && !errors.Is(err, context.DeadlineExceeded)
+	}
+	for _, status := range policy.Statuses {
+		if response.StatusCode == status {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the time to wait before the next attempt, a random duration
+// up to the backoff doubled for each attempt made
+func backoff(policy config.Retry, attempt int) time.Duration {
+	wait := policy.Backoff << (attempt - 1)
+	if wait > policy.MaxBackoff || wait <= 0 {
+		wait = policy.MaxBackoff
+	}
+	if wait <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(wait) + 1))
+}
+
+func sleep(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// Returns whether the request may be sent more than once without
+// changing its outcome
+func IsIdempotent(r *http.Request) bool {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodPut, http.MethodDelete:
+		return true
+	}
+	return r.Header.Get("Idempotency-Key") != ""
+}
@@ -0,0 +1,215 @@
+package upstream
+
+import (
+	"context"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"fiufit.api.gateway/internal/config"
+	log "github.com/sirupsen/logrus"
+)
+
+// Instance is one of the hosts serving an upstream service
+type Instance struct {
+	URL *url.URL
+
+	outstanding  int64
+	failures     int64
+	ejectedUntil int64 // Unix nanoseconds
+	unhealthy    int32
+}
+
+// Returns the number of requests the instance is currently handling
+func (i *Instance) Outstanding() int64 {
+	return atomic.LoadInt64(&i.outstanding)
+}
+
+// Returns whether the instance passed its last health probe and isn't
+// ejected because of consecutive failures
+func (i *Instance) Available(now time.Time) bool {
+	if atomic.LoadInt32(&i.unhealthy) == 1 {
+		return false
+	}
+	return now.UnixNano() >= atomic.LoadInt64(&i.ejectedUntil)
+}
+
+// Must be called when the instance starts handling a request, the
+// returned function when it finishes.
+func (i *Instance) Begin() func() {
+	atomic.AddInt64(&i.outstanding, 1)
+	return func() { atomic.AddInt64(&i.outstanding, -1) }
+}
+
+type Options struct {
+	Balancer string
+	// Path probed to check the health of each instance, active health
+	// checks are disabled when empty
+	HealthPath     string
+	HealthInterval time.Duration
+	// Consecutive failed requests after which an instance is ejected
+	MaxFailures  int
+	EjectionTime time.Duration
+	// Time a request may take when the route doesn't set a deadline
+	Timeout time.Duration
+	// Retry policy used when the route doesn't set one
+	Retry       config.Retry
+	RetryBudget float64
+	Transport   config.Transport
+	Breaker     config.Breaker
+}
+
+// Upstream is a backend service served by one or more instances. The
+// transport and reverse proxy are built once and shared by every
+// request sent to the service.
+type Upstream struct {
+	Name      string
+	instances []*Instance
+	balancer  Balancer
+	options   Options
+	transport *http.Transport
+	proxy     *httputil.ReverseProxy
+	client    *http.Client
+	budget    *retryBudget
+	breaker   *Breaker
+}
+
+// Set of upstreams indexed by the service keys in config
+type Set map[int]*Upstream
+
+func New(name string, urls []*url.URL, options Options) *Upstream {
+	instances := make([]*Instance, 0, len(urls))
+	for _, u := range urls {
+		instances = append(instances, &Instance{URL: u})
+	}
+
+	u := &Upstream{
+		Name:      name,
+		instances: instances,
+		balancer:  NewBalancer(options.Balancer, instances),
+		options:   options,
+		transport: newTransport(options.Transport),
+		budget:    newRetryBudget(options.RetryBudget),
+		breaker:   newBreaker(name, options.Breaker),
+	}
+	u.proxy = u.newProxy()
+	u.client = &http.Client{Transport: u.headerTimeoutTransport(), Timeout: options.Timeout}
+	return u
+}
+
+// Builds the upstreams of every service in the configuration
+func NewSet(services config.Services) Set {
+	set := make(Set)
+	for key, service := range services {
+		set[key] = New(service.Name, service.URLs, Options{
+			Balancer:       service.Balancer,
+			HealthPath:     service.HealthPath,
+			HealthInterval: service.HealthInterval,
+			MaxFailures:    service.MaxFailures,
+			EjectionTime:   service.EjectionTime,
+			Timeout:        service.Timeout,
+			Retry:          service.Retry,
+			RetryBudget:    service.RetryBudget,
+			Transport:      service.Transport,
+			Breaker:        service.Breaker,
+		})
+	}
+	return set
+}
+
+// Starts the active health checks of every upstream in the set
+func (s Set) Start(ctx context.Context) {
+	for _, u := range s {
+		go u.Start(ctx)
+	}
+}
+
+// Closes the idle connections of every upstream in the set, it must be
+// called once the set is no longer used
+func (s Set) Close() {
+	for _, u := range s {
+		u.transport.CloseIdleConnections()
+	}
+}
+
+// Returns the state of the circuit breaker of every upstream, sorted by
+// service name
+func (s Set) BreakerStates() []BreakerState {
+	states := make([]BreakerState, 0, len(s))
+	for _, u := range s {
+		states = append(states, u.breaker.State())
+	}
+	sort.Slice(states, func(i, j int) bool { return states[i].Service < states[j].Service })
+	return states
+}
+
+// Returns whether the circuit breaker lets requests through to the
+// upstream, and if it doesn't, the time until it does.
+func (u *Upstream) Allow() (bool, time.Duration) {
+	return u.breaker.Allow()
+}
+
+// Returns the instances of the upstream
+func (u *Upstream) Instances() []*Instance {
+	return u.instances
+}
+
+// Chooses the instance that handles the request of the client
+// identified by key. If no instance is available it falls back to
+// balancing among all of them rather than rejecting the request.
+func (u *Upstream) Pick(key string) *Instance {
+	now := time.Now()
+	available := u.instances
+	if !allAvailable(u.instances, now) {
+		available = make([]*Instance, 0, len(u.instances))
+		for _, instance := range u.instances {
+			if instance.Available(now) {
+				available = append(available, instance)
+			}
+		}
+	}
+
+	if len(available) == 0 {
+		log.WithFields(log.Fields{"upstream": u.Name}).Warn("No available instances, balancing among all of them")
+		available = u.instances
+	}
+	return u.balancer.Pick(available, key)
+}
+
+func allAvailable(instances []*Instance, now time.Time) bool {
+	for _, instance := range instances {
+		if !instance.Available(now) {
+			return false
+		}
+	}
+	return true
+}
+
+// Records the outcome of a request sent to an instance. Connection
+// errors and 5xx responses count as failures, after MaxFailures
+// consecutive ones the instance is ejected for EjectionTime.
+func (u *Upstream) Report(instance *Instance, status int, err error) {
+	if err == nil && status < http.StatusInternalServerError {
+		u.breaker.Record(true)
+		atomic.StoreInt64(&instance.failures, 0)
+		return
+	}
+
+	u.breaker.Record(false)
+	failures := atomic.AddInt64(&instance.failures, 1)
+	if u.options.MaxFailures <= 0 || failures < int64(u.options.MaxFailures) {
+		return
+	}
+
+	atomic.StoreInt64(&instance.failures, 0)
+	until := time.Now().Add(u.options.EjectionTime)
+	atomic.StoreInt64(&instance.ejectedUntil, until.UnixNano())
+	log.WithFields(log.Fields{
+		"upstream": u.Name,
+		"instance": instance.URL.String(),
+		"until":    until,
+	}).Warn("Instance ejected after consecutive failures")
+}